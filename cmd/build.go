@@ -0,0 +1,477 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"cos-customizer/config"
+	"cos-customizer/fs"
+
+	"github.com/google/subcommands"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// buildSpec describes an entire image build in a single document. It is the
+// input format of the "build" command. Since YAML is a superset of JSON, specs
+// can be written in either format.
+type buildSpec struct {
+	BuildContext         string          `yaml:"buildContext"`
+	IgnoreFile           string          `yaml:"ignoreFile"`
+	GCSBucket            string          `yaml:"gcsBucket"`
+	GCSWorkdir           string          `yaml:"gcsWorkdir"`
+	KeepStaging          bool            `yaml:"keepStaging"`
+	KeepStagingOnFailure bool            `yaml:"keepStagingOnFailure"`
+	KeepOnFailure        bool            `yaml:"keepOnFailure"`
+	ProgressFormat       string          `yaml:"progressFormat"`
+	Report               string          `yaml:"report"`
+	Project              string          `yaml:"project"`
+	Zone                 string          `yaml:"zone"`
+	Timeout              string          `yaml:"timeout"`
+	SourceImage          sourceImageSpec `yaml:"sourceImage"`
+	BuildEnv             *buildEnvSpec   `yaml:"buildEnv"`
+	Steps                []stepSpec      `yaml:"steps"`
+	Disk                 diskSpec        `yaml:"disk"`
+	VM                   vmSpec          `yaml:"vm"`
+	OutputImage          outputImageSpec `yaml:"outputImage"`
+}
+
+// sourceImageSpec mirrors the source image flags of "start-image-build".
+type sourceImageSpec struct {
+	Project   string `yaml:"project"`
+	Name      string `yaml:"name"`
+	Milestone int    `yaml:"milestone"`
+	Family    string `yaml:"family"`
+}
+
+// buildEnvSpec mirrors the flags of "set-build-env".
+type buildEnvSpec struct {
+	Env     map[string]string `yaml:"env"`
+	EnvFile string            `yaml:"envFile"`
+	Secrets []string          `yaml:"secrets"`
+}
+
+// stepSpec describes a single build step. Exactly one of its fields must be set.
+type stepSpec struct {
+	RunScript              *runScriptSpec              `yaml:"runScript"`
+	CopyFile               *copyFileSpec               `yaml:"copyFile"`
+	PreloadContainerImages *preloadContainerImagesSpec `yaml:"preloadContainerImages"`
+	InstallGPU             *installGPUSpec             `yaml:"installGPU"`
+	SealOEM                *struct{}                   `yaml:"sealOEM"`
+}
+
+// runScriptSpec mirrors the flags of "run-script".
+type runScriptSpec struct {
+	Script       string            `yaml:"script"`
+	Args         []string          `yaml:"args"`
+	Env          map[string]string `yaml:"env"`
+	EnvFile      string            `yaml:"envFile"`
+	Secrets      []string          `yaml:"secrets"`
+	Timeout      string            `yaml:"timeout"`
+	Retries      int               `yaml:"retries"`
+	AllowFailure bool              `yaml:"allowFailure"`
+	Interpreter  string            `yaml:"interpreter"`
+}
+
+// copyFileSpec mirrors the flags of "copy-file".
+type copyFileSpec struct {
+	Src   string `yaml:"src"`
+	Dst   string `yaml:"dst"`
+	Mode  string `yaml:"mode"`
+	Owner string `yaml:"owner"`
+}
+
+// preloadContainerImagesSpec mirrors the flags of "preload-container-images".
+type preloadContainerImagesSpec struct {
+	Images   []string `yaml:"images"`
+	Tarballs []string `yaml:"tarballs"`
+}
+
+// installGPUSpec mirrors the flags of "install-gpu".
+type installGPUSpec struct {
+	Version    string `yaml:"version"`
+	Md5sum     string `yaml:"md5sum"`
+	InstallDir string `yaml:"installDir"`
+	GPUType    string `yaml:"gpuType"`
+	DepsDir    string `yaml:"depsDir"`
+}
+
+// diskSpec mirrors the disk and OEM partition flags of "finish-image-build".
+type diskSpec struct {
+	SizeGB  int    `yaml:"sizeGB"`
+	OEMSize string `yaml:"oemSize"`
+}
+
+// vmSpec mirrors the preload VM flags of "finish-image-build".
+type vmSpec struct {
+	MachineType    string   `yaml:"machineType"`
+	Network        string   `yaml:"network"`
+	Subnet         string   `yaml:"subnet"`
+	NoExternalIP   bool     `yaml:"noExternalIP"`
+	ServiceAccount string   `yaml:"serviceAccount"`
+	Scopes         []string `yaml:"scopes"`
+}
+
+// outputImageSpec mirrors the output image flags of "finish-image-build".
+type outputImageSpec struct {
+	Project            string            `yaml:"project"`
+	Name               string            `yaml:"name"`
+	Suffix             string            `yaml:"suffix"`
+	Family             string            `yaml:"family"`
+	DeprecateOldImages bool              `yaml:"deprecateOldImages"`
+	OldImageTTLSec     int               `yaml:"oldImageTTLSec"`
+	Labels             map[string]string `yaml:"labels"`
+	Licenses           []string          `yaml:"licenses"`
+	InheritLabels      bool              `yaml:"inheritLabels"`
+	ReuseIfUnchanged   bool              `yaml:"reuseIfUnchanged"`
+}
+
+// loadBuildSpec reads a build spec from the given path. Unknown fields are
+// rejected so that typos in the spec are caught early.
+func loadBuildSpec(path string) (*buildSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec := &buildSpec{}
+	if err := yaml.UnmarshalStrict(data, spec); err != nil {
+		return nil, fmt.Errorf("cannot parse build spec %q, error msg:(%v)", path, err)
+	}
+	return spec, nil
+}
+
+// buildCommand is a configured subcommand that is run as part of a "build" command.
+type buildCommand struct {
+	subcommands.Command
+	flags *flag.FlagSet
+}
+
+// newBuildCommand initializes the given subcommand with its default flag values.
+func newBuildCommand(c subcommands.Command) *buildCommand {
+	flags := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	c.SetFlags(flags)
+	return &buildCommand{c, flags}
+}
+
+// Build implements subcommands.Command for the "build" command.
+// This command runs an entire image build described by a build spec file.
+type Build struct {
+	specPath string
+}
+
+// Name implements subcommands.Command.Name.
+func (*Build) Name() string {
+	return "build"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*Build) Synopsis() string {
+	return "Build a COS image from a build spec file."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*Build) Usage() string {
+	return `build -spec=<path>
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (b *Build) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&b.specPath, "spec", "", "Path to a YAML or JSON build spec file.")
+}
+
+// startCommand converts the spec into a configured "start-image-build" command.
+func (spec *buildSpec) startCommand() (*buildCommand, error) {
+	start := &StartImageBuild{}
+	c := newBuildCommand(start)
+	if spec.BuildContext != "" {
+		start.buildContext = spec.BuildContext
+	}
+	start.ignoreFile = spec.IgnoreFile
+	start.gcsBucket = spec.GCSBucket
+	start.gcsWorkdir = spec.GCSWorkdir
+	start.imageProject = spec.SourceImage.Project
+	start.imageName = spec.SourceImage.Name
+	start.milestone = spec.SourceImage.Milestone
+	start.imageFamily = spec.SourceImage.Family
+	if err := start.validate(); err != nil {
+		return nil, fmt.Errorf("invalid sourceImage: %v", err)
+	}
+	return c, nil
+}
+
+// buildEnvCommand converts the spec into a configured "set-build-env" command. It returns nil if the
+// spec does not set a build environment.
+func (spec *buildSpec) buildEnvCommand() *buildCommand {
+	if spec.BuildEnv == nil {
+		return nil
+	}
+	setBuildEnv := &SetBuildEnv{}
+	c := newBuildCommand(setBuildEnv)
+	for k, v := range spec.BuildEnv.Env {
+		setBuildEnv.env.m[k] = v
+	}
+	setBuildEnv.envFile = spec.BuildEnv.EnvFile
+	setBuildEnv.secrets.l = append(setBuildEnv.secrets.l, spec.BuildEnv.Secrets...)
+	return c
+}
+
+// stepCommands converts the spec steps into configured commands. The returned
+// commands are in the order given in the spec.
+func (spec *buildSpec) stepCommands() ([]*buildCommand, bool, error) {
+	var cmds []*buildCommand
+	gpuConfigured := false
+	sealOEM := false
+	for i, step := range spec.Steps {
+		numSet := 0
+		for _, val := range []bool{step.RunScript != nil, step.CopyFile != nil, step.PreloadContainerImages != nil,
+			step.InstallGPU != nil, step.SealOEM != nil} {
+			if val {
+				numSet++
+			}
+		}
+		if numSet != 1 {
+			return nil, false, fmt.Errorf("step %d: exactly one of runScript, copyFile, preloadContainerImages, installGPU, "+
+				"sealOEM must be set", i)
+		}
+		switch {
+		case step.RunScript != nil:
+			runScript := &RunScript{}
+			c := newBuildCommand(runScript)
+			if step.RunScript.Script == "" {
+				return nil, false, fmt.Errorf("step %d: runScript: script must be set", i)
+			}
+			runScript.script = step.RunScript.Script
+			runScript.args.l = append(runScript.args.l, step.RunScript.Args...)
+			for k, v := range step.RunScript.Env {
+				runScript.env.m[k] = v
+			}
+			runScript.envFile = step.RunScript.EnvFile
+			runScript.secrets.l = append(runScript.secrets.l, step.RunScript.Secrets...)
+			if step.RunScript.Timeout != "" {
+				timeout, err := time.ParseDuration(step.RunScript.Timeout)
+				if err != nil {
+					return nil, false, fmt.Errorf("step %d: runScript: invalid timeout %q: %v", i, step.RunScript.Timeout, err)
+				}
+				runScript.timeout = timeout
+			}
+			runScript.retries = step.RunScript.Retries
+			runScript.allowFailure = step.RunScript.AllowFailure
+			runScript.interpreter = step.RunScript.Interpreter
+			if err := validateRunOptions(runScript.timeout, runScript.retries); err != nil {
+				return nil, false, fmt.Errorf("step %d: runScript: %v", i, err)
+			}
+			cmds = append(cmds, c)
+		case step.CopyFile != nil:
+			copyFile := &CopyFile{}
+			c := newBuildCommand(copyFile)
+			copyFile.src = step.CopyFile.Src
+			copyFile.dst = step.CopyFile.Dst
+			if step.CopyFile.Mode != "" {
+				copyFile.mode = step.CopyFile.Mode
+			}
+			if step.CopyFile.Owner != "" {
+				copyFile.owner = step.CopyFile.Owner
+			}
+			if err := copyFile.validateFlags(); err != nil {
+				return nil, false, fmt.Errorf("step %d: copyFile: %v", i, err)
+			}
+			if sealOEM && inDirs(copyFile.dst, []string{oemDir}) {
+				return nil, false, fmt.Errorf("step %d: copyFile: cannot copy to %q after the OEM partition is sealed",
+					i, copyFile.dst)
+			}
+			cmds = append(cmds, c)
+		case step.PreloadContainerImages != nil:
+			preload := &PreloadContainerImages{}
+			c := newBuildCommand(preload)
+			preload.images.l = append(preload.images.l, step.PreloadContainerImages.Images...)
+			preload.tarballs.l = append(preload.tarballs.l, step.PreloadContainerImages.Tarballs...)
+			if err := preload.validateFlags(); err != nil {
+				return nil, false, fmt.Errorf("step %d: preloadContainerImages: %v", i, err)
+			}
+			cmds = append(cmds, c)
+		case step.InstallGPU != nil:
+			if gpuConfigured {
+				return nil, false, fmt.Errorf("step %d: installGPU can only be used once in a build", i)
+			}
+			gpuConfigured = true
+			installGPU := &InstallGPU{}
+			c := newBuildCommand(installGPU)
+			if step.InstallGPU.Version == "" {
+				return nil, false, fmt.Errorf("step %d: installGPU: version must be set", i)
+			}
+			installGPU.NvidiaDriverVersion = step.InstallGPU.Version
+			installGPU.NvidiaDriverMd5sum = step.InstallGPU.Md5sum
+			if step.InstallGPU.InstallDir != "" {
+				installGPU.NvidiaInstallDirHost = step.InstallGPU.InstallDir
+			}
+			if step.InstallGPU.GPUType != "" {
+				installGPU.gpuType = step.InstallGPU.GPUType
+			}
+			installGPU.gpuDataDir = step.InstallGPU.DepsDir
+			if !isValidGPU(installGPU.gpuType) {
+				return nil, false, fmt.Errorf("step %d: installGPU: %q is an invalid GPU type. Must be one of: %v",
+					i, installGPU.gpuType, validGPUs)
+			}
+			cmds = append(cmds, c)
+		case step.SealOEM != nil:
+			if sealOEM {
+				return nil, false, fmt.Errorf("step %d: sealOEM can only be used once in a build", i)
+			}
+			sealOEM = true
+			cmds = append(cmds, newBuildCommand(&SealOEM{}))
+		}
+	}
+	return cmds, sealOEM, nil
+}
+
+// finishCommand converts the spec into a configured "finish-image-build" command.
+func (spec *buildSpec) finishCommand(sealOEM bool) (*buildCommand, error) {
+	finish := &FinishImageBuild{}
+	c := newBuildCommand(finish)
+	finish.project = spec.Project
+	finish.zone = spec.Zone
+	finish.keepStaging = spec.KeepStaging
+	finish.keepStagingOnFailure = spec.KeepStagingOnFailure
+	finish.keepOnFailure = spec.KeepOnFailure
+	if spec.ProgressFormat != "" {
+		finish.progressFormat = spec.ProgressFormat
+	}
+	finish.reportPath = spec.Report
+	if spec.Timeout != "" {
+		timeout, err := time.ParseDuration(spec.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %v", spec.Timeout, err)
+		}
+		finish.timeout = timeout
+	}
+	finish.diskSize = spec.Disk.SizeGB
+	finish.oemSize = spec.Disk.OEMSize
+	finish.machineType = spec.VM.MachineType
+	finish.network = spec.VM.Network
+	finish.subnet = spec.VM.Subnet
+	finish.noExternalIP = spec.VM.NoExternalIP
+	finish.serviceAccount = spec.VM.ServiceAccount
+	finish.scopes.l = append(finish.scopes.l, spec.VM.Scopes...)
+	finish.imageProject = spec.OutputImage.Project
+	finish.imageName = spec.OutputImage.Name
+	finish.imageSuffix = spec.OutputImage.Suffix
+	finish.imageFamily = spec.OutputImage.Family
+	finish.deprecateOld = spec.OutputImage.DeprecateOldImages
+	finish.oldImageTTLSec = spec.OutputImage.OldImageTTLSec
+	finish.inheritLabels = spec.OutputImage.InheritLabels
+	finish.reuse = spec.OutputImage.ReuseIfUnchanged
+	for k, v := range spec.OutputImage.Labels {
+		finish.labels.m[k] = v
+	}
+	finish.licenses.l = append(finish.licenses.l, spec.OutputImage.Licenses...)
+	if err := finish.validate(); err != nil {
+		return nil, fmt.Errorf("invalid outputImage: %v", err)
+	}
+	// The OEM settings depend on both the steps and the disk settings, so they
+	// can be checked here before any work is done.
+	if err := validateOEM(&config.Build{
+		DiskSize: finish.diskSize,
+		OEMSize:  finish.oemSize,
+		SealOEM:  sealOEM,
+	}); err != nil {
+		return nil, fmt.Errorf("invalid disk: %v", err)
+	}
+	return c, nil
+}
+
+// commands validates the spec and converts it into the ordered sequence of
+// commands that implement the build.
+func (spec *buildSpec) commands() ([]*buildCommand, error) {
+	start, err := spec.startCommand()
+	if err != nil {
+		return nil, err
+	}
+	steps, sealOEM, err := spec.stepCommands()
+	if err != nil {
+		return nil, err
+	}
+	finish, err := spec.finishCommand(sealOEM)
+	if err != nil {
+		return nil, err
+	}
+	cmds := []*buildCommand{start}
+	if buildEnv := spec.buildEnvCommand(); buildEnv != nil {
+		cmds = append(cmds, buildEnv)
+	}
+	cmds = append(cmds, steps...)
+	return append(cmds, finish), nil
+}
+
+// Execute implements subcommands.Command.Execute. It validates the build spec and
+// runs each of the build steps it describes in-process.
+func (b *Build) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	if b.specPath == "" {
+		log.Println("spec must be set")
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	spec, err := loadBuildSpec(b.specPath)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	cmds, err := spec.commands()
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	// abort deletes the persistent state of the build, so it must never run for
+	// an image build that this command did not start.
+	exists, err := files.BuildExists()
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if exists {
+		log.Printf("image build %q has already been started; finish it with finish-image-build, discard it "+
+			"with abort-build, or run the build with a different -build-id\n", files.BuildID)
+		return subcommands.ExitFailure
+	}
+	abort := func(ret subcommands.ExitStatus) subcommands.ExitStatus {
+		// finish-image-build cleans up after itself; earlier steps leave
+		// state behind that would prevent the build from being retried.
+		if err := files.CleanupAllPersistent(); err != nil {
+			log.Println(err)
+		}
+		return ret
+	}
+	for i, c := range cmds {
+		if ctx.Err() != nil {
+			log.Printf("build cancelled before build step %s\n", c.Name())
+			return abort(subcommands.ExitFailure)
+		}
+		log.Printf("Running build step %d/%d: %s\n", i+1, len(cmds), c.Name())
+		if ret := c.Execute(ctx, c.flags, args...); ret != subcommands.ExitSuccess {
+			log.Printf("build step %s failed\n", c.Name())
+			return abort(ret)
+		}
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,348 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cos-customizer/fs"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/subcommands"
+)
+
+func writeBuildSpec(dir, contents string) (string, error) {
+	path := filepath.Join(dir, "build.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+const validBuildSpec = `
+gcsBucket: b
+gcsWorkdir: w
+project: p
+zone: z
+timeout: 30m
+sourceImage:
+  project: cos-cloud
+  name: cos-stable-68-10718-86-0
+steps:
+- runScript:
+    script: preload.sh
+    args: [--verbose, a b]
+    env:
+      HELLO: world,with,commas
+    timeout: 10m
+    retries: 2
+    interpreter: /usr/bin/python3
+- copyFile:
+    src: daemon.json
+    dst: /var/lib/docker/daemon.json
+- preloadContainerImages:
+    images: [gcr.io/p/app:1.0, busybox]
+- installGPU:
+    version: "396.26"
+- sealOEM: {}
+disk:
+  sizeGB: 12
+  oemSize: 500M
+vm:
+  machineType: n1-standard-4
+  subnet: private
+  noExternalIP: true
+  scopes: [devstorage.read_write]
+outputImage:
+  project: p
+  name: out
+  labels:
+    a: b
+`
+
+func TestBuildSpecCommands(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path, err := writeBuildSpec(tmpDir, validBuildSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := loadBuildSpec(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := spec.commands()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range cmds {
+		got = append(got, c.Name())
+	}
+	want := []string{"start-image-build", "run-script", "copy-file", "preload-container-images", "install-gpu",
+		"seal-oem", "finish-image-build"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("buildSpec.commands(); got %v, want %v", got, want)
+	}
+	runScript := cmds[1].Command.(*RunScript)
+	if got := runScript.env.m["HELLO"]; got != "world,with,commas" {
+		t.Errorf("buildSpec.commands(); run-script env HELLO = %q, want %q", got, "world,with,commas")
+	}
+	if runScript.timeout != 10*time.Minute || runScript.retries != 2 {
+		t.Errorf("buildSpec.commands(); run-script timeout, retries = %s, %d; want 10m0s, 2", runScript.timeout, runScript.retries)
+	}
+	if got, want := runScript.args.l, []string{"--verbose", "a b"}; !cmp.Equal(got, want) {
+		t.Errorf("buildSpec.commands(); run-script args = %v, want %v", got, want)
+	}
+	if got := runScript.interpreter; got != "/usr/bin/python3" {
+		t.Errorf("buildSpec.commands(); run-script interpreter = %q, want %q", got, "/usr/bin/python3")
+	}
+	copyFile := cmds[2].Command.(*CopyFile)
+	if copyFile.dst != "/var/lib/docker/daemon.json" || copyFile.mode != "0644" || copyFile.owner != "root:root" {
+		t.Errorf("buildSpec.commands(); copy-file dst, mode, owner = %q, %q, %q; want /var/lib/docker/daemon.json "+
+			"and the flag defaults 0644, root:root", copyFile.dst, copyFile.mode, copyFile.owner)
+	}
+	preload := cmds[3].Command.(*PreloadContainerImages)
+	if got, want := preload.images.l, []string{"gcr.io/p/app:1.0", "busybox"}; !cmp.Equal(got, want) {
+		t.Errorf("buildSpec.commands(); preload-container-images images = %v, want %v", got, want)
+	}
+	installGPU := cmds[4].Command.(*InstallGPU)
+	if got := installGPU.NvidiaInstallDirHost; got != "/var/lib/nvidia" {
+		t.Errorf("buildSpec.commands(); install-gpu install dir = %q, want flag default /var/lib/nvidia", got)
+	}
+	finish := cmds[6].Command.(*FinishImageBuild)
+	if got := finish.timeout.String(); got != "30m0s" {
+		t.Errorf("buildSpec.commands(); finish-image-build timeout = %s, want 30m0s", got)
+	}
+	if finish.machineType != "n1-standard-4" || finish.subnet != "private" || !finish.noExternalIP {
+		t.Errorf("buildSpec.commands(); finish-image-build machine type, subnet, no external IP = %q, %q, %v; "+
+			"want n1-standard-4, private, true", finish.machineType, finish.subnet, finish.noExternalIP)
+	}
+	if got, want := finish.scopes.l, []string{"devstorage.read_write"}; !cmp.Equal(got, want) {
+		t.Errorf("buildSpec.commands(); finish-image-build scopes = %v, want %v", got, want)
+	}
+}
+
+func TestBuildSpecBuildEnv(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path, err := writeBuildSpec(tmpDir, validBuildSpec+"buildEnv:\n  env:\n    TOKEN: secret\n  secrets: [TOKEN]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := loadBuildSpec(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := spec.commands()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cmds[1].Name(); got != "set-build-env" {
+		t.Fatalf("buildSpec.commands(); second command = %s, want set-build-env", got)
+	}
+	setBuildEnv := cmds[1].Command.(*SetBuildEnv)
+	if got := setBuildEnv.env.m["TOKEN"]; got != "secret" {
+		t.Errorf("buildSpec.commands(); set-build-env env TOKEN = %q, want %q", got, "secret")
+	}
+	if !cmp.Equal(setBuildEnv.secrets.l, []string{"TOKEN"}) {
+		t.Errorf("buildSpec.commands(); set-build-env secrets = %v, want [TOKEN]", setBuildEnv.secrets.l)
+	}
+}
+
+func TestLoadBuildSpecUnknownField(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path, err := writeBuildSpec(tmpDir, validBuildSpec+"unknown: field\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBuildSpec(path); err == nil {
+		t.Errorf("loadBuildSpec(_); got nil, want error for unknown field")
+	}
+}
+
+func TestBuildSpecInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*buildSpec)
+	}{
+		{
+			name:   "NoSourceImage",
+			modify: func(s *buildSpec) { s.SourceImage = sourceImageSpec{Project: "cos-cloud"} },
+		},
+		{
+			name:   "EmptyStep",
+			modify: func(s *buildSpec) { s.Steps = []stepSpec{{}} },
+		},
+		{
+			name: "TwoStepTypes",
+			modify: func(s *buildSpec) {
+				s.Steps = []stepSpec{{RunScript: &runScriptSpec{Script: "s"}, SealOEM: &struct{}{}}}
+			},
+		},
+		{
+			name:   "NoScript",
+			modify: func(s *buildSpec) { s.Steps = []stepSpec{{RunScript: &runScriptSpec{}}} },
+		},
+		{
+			name: "BadScriptTimeout",
+			modify: func(s *buildSpec) {
+				s.Steps = []stepSpec{{RunScript: &runScriptSpec{Script: "s", Timeout: "soon"}}}
+			},
+		},
+		{
+			name: "NegativeScriptRetries",
+			modify: func(s *buildSpec) {
+				s.Steps = []stepSpec{{RunScript: &runScriptSpec{Script: "s", Retries: -1}}}
+			},
+		},
+		{
+			name: "CopyFileNoSrc",
+			modify: func(s *buildSpec) {
+				s.Steps = []stepSpec{{CopyFile: &copyFileSpec{Dst: "/var/f"}}}
+			},
+		},
+		{
+			name: "CopyFileReadOnlyDst",
+			modify: func(s *buildSpec) {
+				s.Steps = []stepSpec{{CopyFile: &copyFileSpec{Src: "f", Dst: "/usr/bin/f"}}}
+			},
+		},
+		{
+			name: "CopyFileBadMode",
+			modify: func(s *buildSpec) {
+				s.Steps = []stepSpec{{CopyFile: &copyFileSpec{Src: "f", Dst: "/var/f", Mode: "rw"}}}
+			},
+		},
+		{
+			name: "CopyFileAfterSealOEM",
+			modify: func(s *buildSpec) {
+				s.Steps = append(s.Steps, stepSpec{CopyFile: &copyFileSpec{Src: "f", Dst: "/usr/share/oem/f"}})
+			},
+		},
+		{
+			name: "PreloadNoImages",
+			modify: func(s *buildSpec) {
+				s.Steps = []stepSpec{{PreloadContainerImages: &preloadContainerImagesSpec{}}}
+			},
+		},
+		{
+			name: "PreloadBadImage",
+			modify: func(s *buildSpec) {
+				s.Steps = []stepSpec{{PreloadContainerImages: &preloadContainerImagesSpec{Images: []string{"Image"}}}}
+			},
+		},
+		{
+			name: "TwoGPUs",
+			modify: func(s *buildSpec) {
+				s.Steps = append(s.Steps, stepSpec{InstallGPU: &installGPUSpec{Version: "v"}})
+			},
+		},
+		{
+			name: "BadGPUType",
+			modify: func(s *buildSpec) {
+				s.Steps = []stepSpec{{InstallGPU: &installGPUSpec{Version: "v", GPUType: "bad"}}}
+			},
+		},
+		{
+			name:   "TwoSealOEM",
+			modify: func(s *buildSpec) { s.Steps = append(s.Steps, stepSpec{SealOEM: &struct{}{}}) },
+		},
+		{
+			name:   "BadTimeout",
+			modify: func(s *buildSpec) { s.Timeout = "t" },
+		},
+		{
+			name:   "NoOutputImage",
+			modify: func(s *buildSpec) { s.OutputImage.Name = "" },
+		},
+		{
+			name:   "SmallDisk",
+			modify: func(s *buildSpec) { s.Disk.SizeGB = 10 },
+		},
+	}
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path, err := writeBuildSpec(tmpDir, validBuildSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec, err := loadBuildSpec(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.modify(spec)
+			if _, err := spec.commands(); err == nil {
+				t.Errorf("buildSpec.commands(); got nil, want error; spec: %+v", spec)
+			}
+		})
+	}
+}
+
+// TestBuildExistingBuild checks that a build that fails because its build ID is
+// already in use leaves the existing image build alone.
+func TestBuildExistingBuild(t *testing.T) {
+	files, cleanup, err := setupBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path, err := writeBuildSpec(tmpDir, validBuildSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagSet := &flag.FlagSet{}
+	build := &Build{}
+	build.SetFlags(flagSet)
+	if err := flagSet.Parse([]string{"-spec", path}); err != nil {
+		t.Fatal(err)
+	}
+	if got := build.Execute(context.Background(), flagSet, files, nil); got != subcommands.ExitFailure {
+		t.Errorf("Build.Execute(%s) = %v; want %v", path, got, subcommands.ExitFailure)
+	}
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		t.Fatalf("Build.Execute(%s): existing image build was deleted: %v", path, err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Build.Execute(%s): existing image build has %d steps; want 1", path, len(entries))
+	}
+}
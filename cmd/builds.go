@@ -0,0 +1,140 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"cos-customizer/fs"
+
+	"github.com/google/subcommands"
+)
+
+// ListBuilds implements subcommands.Command for the "list-builds" command.
+// This command lists the image builds in the local state workdir.
+type ListBuilds struct{}
+
+// Name implements subcommands.Command.Name.
+func (*ListBuilds) Name() string {
+	return "list-builds"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*ListBuilds) Synopsis() string {
+	return "List the pending image builds."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*ListBuilds) Usage() string {
+	return `list-builds
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (*ListBuilds) SetFlags(f *flag.FlagSet) {}
+
+// writeBuildList writes a line for each image build in the local state workdir. The image build
+// selected by the given files is marked with a '*'.
+func writeBuildList(w io.Writer, files *fs.Files) error {
+	buildIDs, err := files.ListBuilds()
+	if err != nil {
+		return err
+	}
+	for _, buildID := range buildIDs {
+		marker := " "
+		if buildID == files.BuildID {
+			marker = "*"
+		}
+		summary := "incomplete; start-image-build did not finish"
+		if status, err := loadBuildStatus(files.ForBuild(buildID)); err == nil {
+			summary = fmt.Sprintf("%s, steps: %d", status.SourceImage, len(status.Steps))
+		}
+		if _, err := fmt.Fprintf(w, "%s %s: %s\n", marker, buildID, summary); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Execute implements subcommands.Command.Execute. It prints the image builds in the local state
+// workdir.
+func (*ListBuilds) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	if err := writeBuildList(os.Stdout, files); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// AbortBuild implements subcommands.Command for the "abort-build" command.
+// This command deletes the local state of an image build without building an image.
+type AbortBuild struct{}
+
+// Name implements subcommands.Command.Name.
+func (*AbortBuild) Name() string {
+	return "abort-build"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*AbortBuild) Synopsis() string {
+	return "Discard a pending image build."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*AbortBuild) Usage() string {
+	return `abort-build
+
+Discards the image build selected by the global -build-id flag. Other image
+builds are not affected.
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (*AbortBuild) SetFlags(f *flag.FlagSet) {}
+
+// Execute implements subcommands.Command.Execute. It deletes the local state of the selected image
+// build.
+func (*AbortBuild) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	exists, err := files.BuildExists()
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if !exists {
+		log.Printf("no image build with ID %q found\n", files.BuildID)
+		return subcommands.ExitFailure
+	}
+	if err := files.CleanupAllPersistent(); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	log.Printf("Aborted image build %q\n", files.BuildID)
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"cos-customizer/fs"
+
+	"github.com/google/subcommands"
+)
+
+// setupBuilds creates a workdir in a temporary $HOME with a started image build with the ID
+// "started" and an incomplete image build with the ID "incomplete". It returns the Files of the
+// started image build, and a function that restores $HOME and deletes the temporary $HOME.
+func setupBuilds() (*fs.Files, func(), error) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", tmpDir)
+	cleanup := func() {
+		os.Setenv("HOME", oldHome)
+		os.RemoveAll(tmpDir)
+	}
+	files := fs.DefaultFiles("workdir", "started")
+	if err := saveImage("im", "p", files.SourceImageConfig); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := saveBuildConfig("b", "d", files.BuildConfig); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := fs.CreateStateFile(files); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := fs.AppendStateFile(files.StateFile, fs.Builtin, sealOEMScript, ""); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := fs.CreateStateFile(files.ForBuild("incomplete")); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return files, cleanup, nil
+}
+
+func TestWriteBuildList(t *testing.T) {
+	files, cleanup, err := setupBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	got := new(strings.Builder)
+	if err := writeBuildList(got, files); err != nil {
+		t.Fatal(err)
+	}
+	want := `  incomplete: incomplete; start-image-build did not finish
+* started: projects/p/global/images/im, steps: 1
+`
+	if got.String() != want {
+		t.Errorf("writeBuildList(_, _) = %q; want %q", got.String(), want)
+	}
+}
+
+func TestAbortBuild(t *testing.T) {
+	files, cleanup, err := setupBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	incomplete := files.ForBuild("incomplete")
+	if ret := (&AbortBuild{}).Execute(context.Background(), &flag.FlagSet{}, incomplete); ret != subcommands.ExitSuccess {
+		t.Fatalf("abort-build for build %q: got %v, want subcommands.ExitSuccess", incomplete.BuildID, ret)
+	}
+	buildIDs, err := files.ListBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buildIDs) != 1 || buildIDs[0] != files.BuildID {
+		t.Errorf("abort-build for build %q: got builds %v, want only %q", incomplete.BuildID, buildIDs, files.BuildID)
+	}
+	if ret := (&AbortBuild{}).Execute(context.Background(), &flag.FlagSet{}, incomplete); ret == subcommands.ExitSuccess {
+		t.Errorf("abort-build for missing build %q: got subcommands.ExitSuccess, want failure", incomplete.BuildID)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"cos-customizer/gce"
+	"cos-customizer/preloader"
+
+	"github.com/google/subcommands"
+)
+
+// CleanupDebugResources implements subcommands.Command for the "cleanup-debug-resources" command.
+// This command deletes the preload VM and the boot disk that "finish-image-build -keep-on-failure"
+// kept after a failed image build.
+type CleanupDebugResources struct {
+	project string
+	zone    string
+	name    string
+}
+
+// Name implements subcommands.Command.Name.
+func (*CleanupDebugResources) Name() string {
+	return "cleanup-debug-resources"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*CleanupDebugResources) Synopsis() string {
+	return "Delete the preload VM kept by a failed image build."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*CleanupDebugResources) Usage() string {
+	return `cleanup-debug-resources -project=<project> -zone=<zone> -name=<preload VM>
+
+Deletes the preload VM and its boot disk that 'finish-image-build -keep-on-failure'
+kept for debugging. The name of the preload VM is printed when the image build
+fails.
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (c *CleanupDebugResources) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.project, "project", "", "Project of the preload VM.")
+	f.StringVar(&c.zone, "zone", "", "Zone of the preload VM.")
+	f.StringVar(&c.name, "name", "", "Name of the preload VM and its boot disk, like preload-vm-1a2b3c4d.")
+}
+
+func (c *CleanupDebugResources) validate() error {
+	switch {
+	case c.project == "":
+		return fmt.Errorf("'project' must be set")
+	case c.zone == "":
+		return fmt.Errorf("'zone' must be set")
+	case c.name == "":
+		return fmt.Errorf("'name' must be set")
+	case !preloader.PreloadVMNameRegexp.MatchString(c.name):
+		return fmt.Errorf("'name' %q is not the name of a preload VM; it must look like preload-vm-<8 hex digits>", c.name)
+	default:
+		return nil
+	}
+}
+
+// Execute implements subcommands.Command.Execute. It deletes the preload VM and then its boot disk,
+// since a disk cannot be deleted while it is attached to a VM. Resources that were already deleted
+// are skipped.
+func (c *CleanupDebugResources) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	if err := c.validate(); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	svc, _, err := args[1].(ServiceClients)(ctx, false)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := gce.DeleteInstance(svc, c.project, c.zone, c.name); err != nil {
+		log.Printf("cannot delete the preload VM %s: %v\n", c.name, err)
+		return subcommands.ExitFailure
+	}
+	if err := gce.DeleteDisk(svc, c.project, c.zone, c.name); err != nil {
+		log.Printf("cannot delete the boot disk %s: %v\n", c.name, err)
+		return subcommands.ExitFailure
+	}
+	log.Printf("Deleted the preload VM %s and its boot disk\n", c.name)
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"flag"
+	"testing"
+
+	"cos-customizer/fakes"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/subcommands"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestCleanupDebugResources(t *testing.T) {
+	testData := []struct {
+		testName      string
+		flags         []string
+		want          subcommands.ExitStatus
+		wantInstances int
+		wantDisks     int
+	}{
+		{"Delete", []string{"-project=p", "-zone=z", "-name=preload-vm-1a2b3c4d"}, subcommands.ExitSuccess, 1, 0},
+		{"AlreadyDeleted", []string{"-project=p", "-zone=z", "-name=preload-vm-5e6f7a8b"}, subcommands.ExitSuccess, 2, 1},
+		{"NoName", []string{"-project=p", "-zone=z"}, subcommands.ExitFailure, 2, 1},
+		{"OtherVM", []string{"-project=p", "-zone=z", "-name=other"}, subcommands.ExitFailure, 2, 1},
+		{"NotHex", []string{"-project=p", "-zone=z", "-name=preload-vm-xyzxyzxy"}, subcommands.ExitFailure, 2, 1},
+		{"TooLong", []string{"-project=p", "-zone=z", "-name=preload-vm-1a2b3c4d-x"}, subcommands.ExitFailure, 2, 1},
+		{"NoZone", []string{"-project=p", "-name=preload-vm-1a2b3c4d"}, subcommands.ExitFailure, 2, 1},
+	}
+	gce, svc := fakes.GCEForTest(t, "p")
+	defer gce.Close()
+	gcs := fakes.GCSForTest(t)
+	defer gcs.Close()
+	clients := ServiceClients(func(_ context.Context, _ bool) (*compute.Service, *storage.Client, error) {
+		return svc, gcs.Client, nil
+	})
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			gce.Instances = []*compute.Instance{{Name: "preload-vm-1a2b3c4d", Zone: "z"}, {Name: "other", Zone: "z"}}
+			gce.Disks = []*compute.Disk{{Name: "preload-vm-1a2b3c4d", Zone: "z"}}
+			gce.Operations = []*compute.Operation{{Name: "op-1", Status: "DONE"}, {Name: "op-2", Status: "DONE"}}
+			flagSet := &flag.FlagSet{}
+			cleanup := &CleanupDebugResources{}
+			cleanup.SetFlags(flagSet)
+			if err := flagSet.Parse(input.flags); err != nil {
+				t.Fatal(err)
+			}
+			if got := cleanup.Execute(context.Background(), flagSet, nil, clients); got != input.want {
+				t.Errorf("CleanupDebugResources.Execute(%v) = %v; want %v", input.flags, got, input.want)
+			}
+			if got := len(gce.Instances); got != input.wantInstances {
+				t.Errorf("CleanupDebugResources.Execute(%v): %d instances left; want %d", input.flags, got,
+					input.wantInstances)
+			}
+			if got := len(gce.Disks); got != input.wantDisks {
+				t.Errorf("CleanupDebugResources.Execute(%v): %d disks left; want %d", input.flags, got, input.wantDisks)
+			}
+		})
+	}
+}
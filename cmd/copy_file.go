@@ -0,0 +1,166 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"cos-customizer/fs"
+
+	"github.com/google/subcommands"
+)
+
+const (
+	copyFileScript = "copy_file.sh"
+	oemDir         = "/usr/share/oem"
+)
+
+var (
+	// writableDirs are the directories on a COS image that are not on the read-only root
+	// filesystem.
+	writableDirs = []string{"/etc", "/home", "/mnt/stateful_partition", "/tmp", oemDir, "/var"}
+	// persistentDirs are the directories on a COS image that are backed by the stateful
+	// partition or the OEM partition, and so persist in the output image.
+	persistentDirs = []string{"/home", "/mnt/stateful_partition", oemDir, "/var"}
+)
+
+// CopyFile implements subcommands.Command for the "copy-file" command.
+// This command configures the current image build process to copy a file from the
+// user build context onto the result image.
+type CopyFile struct {
+	src   string
+	dst   string
+	mode  string
+	owner string
+}
+
+// Name implements subcommands.Command.Name.
+func (*CopyFile) Name() string {
+	return "copy-file"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*CopyFile) Synopsis() string {
+	return "Configure the image build to copy a file from the build context onto the image."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*CopyFile) Usage() string {
+	return `copy-file -src=<path in build context> -dst=<absolute path on image> [flags]
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (c *CopyFile) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.src, "src", "", "Path of the file to copy. The path should be relative to the root of the "+
+		"build context.")
+	f.StringVar(&c.dst, "dst", "", "Absolute path on the image to copy the file to.")
+	f.StringVar(&c.mode, "mode", "0644", "File mode to set on the copied file, in octal.")
+	f.StringVar(&c.owner, "owner", "root:root", "Owner to set on the copied file, in the form 'user:group'.")
+}
+
+// inDirs checks if the given absolute path is contained by any of the given directories.
+func inDirs(p string, dirs []string) bool {
+	for _, dir := range dirs {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFlags checks the flags that can be checked without the build context.
+func (c *CopyFile) validateFlags() error {
+	if c.src == "" {
+		return fmt.Errorf("src must be set")
+	}
+	if !path.IsAbs(c.dst) || path.Clean(c.dst) != c.dst {
+		return fmt.Errorf("dst must be a clean absolute path; got %q", c.dst)
+	}
+	if !inDirs(c.dst, writableDirs) {
+		return fmt.Errorf("dst %q is on the read-only root filesystem; it must be in one of: %v", c.dst, writableDirs)
+	}
+	if mode, err := strconv.ParseUint(c.mode, 8, 32); err != nil || mode > 07777 {
+		return fmt.Errorf("mode must be an octal file mode like 0644; got %q", c.mode)
+	}
+	if split := strings.Split(c.owner, ":"); len(split) != 2 || split[0] == "" || split[1] == "" {
+		return fmt.Errorf("owner must be formatted as 'user:group'; got %q", c.owner)
+	}
+	return nil
+}
+
+func (c *CopyFile) validate(files *fs.Files) error {
+	if err := c.validateFlags(); err != nil {
+		return err
+	}
+	isValid, err := fs.ArchiveHasObject(files.UserBuildContextArchive, c.src)
+	if err != nil {
+		return err
+	}
+	if !isValid {
+		return fmt.Errorf("could not find file %s in build context", c.src)
+	}
+	if inDirs(c.dst, []string{oemDir}) {
+		sealed, err := fs.StateFileContains(files.StateFile, fs.Builtin, sealOEMScript)
+		if err != nil {
+			return err
+		}
+		if sealed {
+			return fmt.Errorf("cannot copy to %q after the OEM partition is sealed", c.dst)
+		}
+	}
+	return nil
+}
+
+// Execute implements subcommands.Command.Execute. It configures the current image build process to
+// copy a file from the user build context onto the result image.
+func (c *CopyFile) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	if err := c.validate(files); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if !inDirs(c.dst, persistentDirs) {
+		log.Printf("Warning: dst %q is not on the stateful partition or the OEM partition; "+
+			"the copied file will not persist in the result image. Persistent directories are: %v\n",
+			c.dst, persistentDirs)
+	}
+	env := map[string]string{
+		"COPY_FILE_SRC":   c.src,
+		"COPY_FILE_DST":   c.dst,
+		"COPY_FILE_MODE":  c.mode,
+		"COPY_FILE_OWNER": c.owner,
+	}
+	envFileName, err := createEnvFile(fs.CopyFileEnvFilePrefix, files, env, nil)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := fs.AppendStateFile(files.StateFile, fs.Builtin, copyFileScript, envFileName); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cos-customizer/fs"
+
+	"github.com/google/subcommands"
+)
+
+func TestCopyFile(t *testing.T) {
+	tmpDir, files, err := setupRunScriptFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := createNonEmptyUserCtxArchive(files, "file"); err != nil {
+		t.Fatal(err)
+	}
+	flags := []string{"-src=file", "-dst=/etc/file.conf", "-mode=0600", "-owner=chronos:chronos"}
+	if ret := executeEditStep(&CopyFile{}, files, flags...); ret != subcommands.ExitSuccess {
+		t.Fatalf("copy-file(%v): got %v, want subcommands.ExitSuccess", flags, ret)
+	}
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].BuildContext != fs.Builtin || entries[0].Script != copyFileScript {
+		t.Fatalf("copy-file(%v): state file: got %v, want a single %s step", flags, entries, copyFileScript)
+	}
+	env, err := ioutil.ReadFile(filepath.Join(files.PersistBuiltinBuildContext, entries[0].Env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"export COPY_FILE_SRC='file'",
+		"export COPY_FILE_DST='/etc/file.conf'",
+		"export COPY_FILE_MODE='0600'",
+		"export COPY_FILE_OWNER='chronos:chronos'",
+	} {
+		if !strings.Contains(string(env), want) {
+			t.Errorf("copy-file(%v): env file: got %q, want it to contain %q", flags, string(env), want)
+		}
+	}
+}
+
+func TestCopyFileInvalid(t *testing.T) {
+	var testData = []struct {
+		testName  string
+		stateFile string
+		flags     []string
+	}{
+		{"NoSrc", "", []string{"-dst=/etc/file"}},
+		{"MissingSrc", "", []string{"-src=missing", "-dst=/etc/file"}},
+		{"RelativeDst", "", []string{"-src=file", "-dst=etc/file"}},
+		{"UncleanDst", "", []string{"-src=file", "-dst=/etc/../usr/file"}},
+		{"ReadOnlyDst", "", []string{"-src=file", "-dst=/usr/bin/file"}},
+		{"DstPrefixNotDir", "", []string{"-src=file", "-dst=/etcetera/file"}},
+		{"BadMode", "", []string{"-src=file", "-dst=/etc/file", "-mode=0999"}},
+		{"ModeTooLarge", "", []string{"-src=file", "-dst=/etc/file", "-mode=17777"}},
+		{"BadOwner", "", []string{"-src=file", "-dst=/etc/file", "-owner=root"}},
+		{"OEMSealed", "builtin\tseal_oem.sh\t\n", []string{"-src=file", "-dst=/usr/share/oem/file"}},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupRunScriptFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			if err := createNonEmptyUserCtxArchive(files, "file"); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(files.StateFile, []byte(input.stateFile), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if ret := executeEditStep(&CopyFile{}, files, input.flags...); ret == subcommands.ExitSuccess {
+				t.Errorf("copy-file(%v): got subcommands.ExitSuccess, want failure", input.flags)
+			}
+			got, err := ioutil.ReadFile(files.StateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != input.stateFile {
+				t.Errorf("copy-file(%v): state file: got %q, want %q", input.flags, string(got), input.stateFile)
+			}
+		})
+	}
+}
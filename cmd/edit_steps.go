@@ -0,0 +1,258 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"cos-customizer/fs"
+
+	"github.com/google/subcommands"
+)
+
+// checkSealOEMLast checks that no step runs after the OEM partition is sealed.
+// Once the OEM partition is sealed, changes made to it by later steps, like user
+// scripts or copy-file steps, would fail verification at boot time.
+func checkSealOEMLast(entries []*fs.StateFileEntry) error {
+	sealed := false
+	for _, entry := range entries {
+		switch {
+		case entry.BuildContext == fs.Builtin && entry.Script == sealOEMScript:
+			sealed = true
+		case sealed:
+			return fmt.Errorf("%s step %s cannot run after %s", entry.BuildContext, entry.Script, sealOEMScript)
+		}
+	}
+	return nil
+}
+
+// checkStepNumber checks that a 1-based step number given on the command line refers to an
+// existing step.
+func checkStepNumber(flagName string, step, numSteps int) error {
+	if step < 1 || step > numSteps {
+		return fmt.Errorf("'%s' must be between 1 and %d; got %d", flagName, numSteps, step)
+	}
+	return nil
+}
+
+// RemoveStep implements subcommands.Command for the "remove-step" command.
+// This command removes a queued step from the current image build process.
+type RemoveStep struct {
+	step int
+}
+
+// Name implements subcommands.Command.Name.
+func (*RemoveStep) Name() string {
+	return "remove-step"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*RemoveStep) Synopsis() string {
+	return "Remove a queued step from the image build."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*RemoveStep) Usage() string {
+	return `remove-step -step=<step number>
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (r *RemoveStep) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&r.step, "step", 0, "Number of the step to remove, as shown by the 'status' command.")
+}
+
+// Execute implements subcommands.Command.Execute. It removes a queued step from the current
+// image build process.
+func (r *RemoveStep) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := checkStepNumber("step", r.step, len(entries)); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	entry := entries[r.step-1]
+	if entry.BuildContext == fs.Builtin && (entry.Script == gpuScript || entry.Script == sealOEMScript) {
+		// These steps also modify the build config (e.g. install-gpu sets the GPU type), which
+		// removing the state file entry would not undo.
+		log.Printf("step %d (%s) changed the build config; it cannot be removed\n", r.step, entry.Script)
+		return subcommands.ExitFailure
+	}
+	if err := fs.RemoveStateFileEntry(files, r.step-1); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if entry.BuildContext == fs.Builtin && entry.Script == preloadImagesScript {
+		if err := removeContainerImages(files.BuildConfig, entry.ID); err != nil {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+	}
+	return subcommands.ExitSuccess
+}
+
+// MoveStep implements subcommands.Command for the "move-step" command.
+// This command changes the position of a queued step in the current image build process.
+type MoveStep struct {
+	from int
+	to   int
+}
+
+// Name implements subcommands.Command.Name.
+func (*MoveStep) Name() string {
+	return "move-step"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*MoveStep) Synopsis() string {
+	return "Move a queued step to a different position in the image build."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*MoveStep) Usage() string {
+	return `move-step -from=<step number> -to=<step number>
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (m *MoveStep) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&m.from, "from", 0, "Number of the step to move, as shown by the 'status' command.")
+	f.IntVar(&m.to, "to", 0, "Step number that the moved step should have after it is moved.")
+}
+
+// validate checks that the move does not put a builtin step ahead of user steps that
+// it currently runs after.
+func (m *MoveStep) validate(entries []*fs.StateFileEntry) error {
+	if err := checkStepNumber("from", m.from, len(entries)); err != nil {
+		return err
+	}
+	if err := checkStepNumber("to", m.to, len(entries)); err != nil {
+		return err
+	}
+	moved := entries[m.from-1]
+	if moved.BuildContext == fs.Builtin && m.to < m.from {
+		for _, entry := range entries[m.to-1 : m.from-1] {
+			if entry.BuildContext == fs.User {
+				return fmt.Errorf("builtin step %s cannot be moved ahead of user step %s", moved.Script, entry.Script)
+			}
+		}
+	}
+	reordered := make([]*fs.StateFileEntry, 0, len(entries))
+	reordered = append(reordered, entries[:m.from-1]...)
+	reordered = append(reordered, entries[m.from:]...)
+	reordered = append(reordered[:m.to-1], append([]*fs.StateFileEntry{moved}, reordered[m.to-1:]...)...)
+	return checkSealOEMLast(reordered)
+}
+
+// Execute implements subcommands.Command.Execute. It changes the position of a queued step
+// in the current image build process.
+func (m *MoveStep) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := m.validate(entries); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := fs.MoveStateFileEntry(files.StateFile, m.from-1, m.to-1); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// InsertStep implements subcommands.Command for the "insert-step" command.
+// This command configures the current image build process to run a script at a given
+// position in the sequence of queued steps.
+type InsertStep struct {
+	step int
+	userScriptFlags
+}
+
+// Name implements subcommands.Command.Name.
+func (*InsertStep) Name() string {
+	return "insert-step"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*InsertStep) Synopsis() string {
+	return "Insert a script to run at a given position in the image build."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*InsertStep) Usage() string {
+	return `insert-step -step=<step number> -script=<script> [flags]
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (i *InsertStep) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&i.step, "step", 0, "Step number that the inserted step should have. Steps at or after this "+
+		"position are moved back by one.")
+	i.setFlags(f)
+}
+
+// Execute implements subcommands.Command.Execute. It configures the current image build process
+// to run a script at a given position in the sequence of queued steps.
+func (i *InsertStep) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := checkStepNumber("step", i.step, len(entries)+1); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	inserted := &fs.StateFileEntry{BuildContext: fs.User, Script: i.script}
+	if err := checkSealOEMLast(append(entries[:i.step-1:i.step-1], append([]*fs.StateFileEntry{inserted},
+		entries[i.step-1:]...)...)); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	entry, err := i.newEntry(i.Name(), files)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if err := fs.InsertStateFileEntry(files.StateFile, i.step-1, entry); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
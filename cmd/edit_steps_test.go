@@ -0,0 +1,265 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"cos-customizer/config"
+	"cos-customizer/fs"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/subcommands"
+)
+
+func executeEditStep(c subcommands.Command, files *fs.Files, flags ...string) subcommands.ExitStatus {
+	flagSet := &flag.FlagSet{}
+	c.SetFlags(flagSet)
+	if err := flagSet.Parse(flags); err != nil {
+		return subcommands.ExitUsageError
+	}
+	return c.Execute(context.Background(), flagSet, files)
+}
+
+// jsonStep formats a state file entry for a script step without an env file or run options.
+func jsonStep(id int, buildContext fs.BuildContext, script string) string {
+	return fmt.Sprintf(`{"version":2,"id":%d,"type":"script","buildContext":"%s","script":"%s"}`+"\n",
+		id, buildContext, script)
+}
+
+func TestEditSteps(t *testing.T) {
+	const stateFile = "user\ta\t\nbuiltin\tinstall_gpu.sh\t\nuser\tb\t\nbuiltin\tseal_oem.sh\t\n"
+	var testData = []struct {
+		testName    string
+		command     subcommands.Command
+		flags       []string
+		wantSuccess bool
+		want        string
+	}{
+		{
+			"RemoveUserStep",
+			&RemoveStep{},
+			[]string{"-step=1"},
+			true,
+			jsonStep(2, fs.Builtin, "install_gpu.sh") + jsonStep(3, fs.User, "b") + jsonStep(4, fs.Builtin, "seal_oem.sh"),
+		},
+		{
+			"RemoveBuiltinStep",
+			&RemoveStep{},
+			[]string{"-step=2"},
+			false,
+			stateFile,
+		},
+		{
+			"RemoveOutOfRange",
+			&RemoveStep{},
+			[]string{"-step=5"},
+			false,
+			stateFile,
+		},
+		{
+			"MoveUserStep",
+			&MoveStep{},
+			[]string{"-from=3", "-to=1"},
+			true,
+			jsonStep(3, fs.User, "b") + jsonStep(1, fs.User, "a") + jsonStep(2, fs.Builtin, "install_gpu.sh") +
+				jsonStep(4, fs.Builtin, "seal_oem.sh"),
+		},
+		{
+			"MoveBuiltinStepBack",
+			&MoveStep{},
+			[]string{"-from=2", "-to=3"},
+			true,
+			jsonStep(1, fs.User, "a") + jsonStep(3, fs.User, "b") + jsonStep(2, fs.Builtin, "install_gpu.sh") +
+				jsonStep(4, fs.Builtin, "seal_oem.sh"),
+		},
+		{
+			"MoveBuiltinStepAheadOfUserStep",
+			&MoveStep{},
+			[]string{"-from=2", "-to=1"},
+			false,
+			stateFile,
+		},
+		{
+			"MoveSealOEMAheadOfUserStep",
+			&MoveStep{},
+			[]string{"-from=4", "-to=3"},
+			false,
+			stateFile,
+		},
+		{
+			"MoveUserStepAfterSealOEM",
+			&MoveStep{},
+			[]string{"-from=3", "-to=4"},
+			false,
+			stateFile,
+		},
+		{
+			"MoveBuiltinStepAfterSealOEM",
+			&MoveStep{},
+			[]string{"-from=2", "-to=4"},
+			false,
+			stateFile,
+		},
+		{
+			"InsertStep",
+			&InsertStep{},
+			[]string{"-step=2", "-script=script"},
+			true,
+			jsonStep(1, fs.User, "a") + jsonStep(5, fs.User, "script") + jsonStep(2, fs.Builtin, "install_gpu.sh") +
+				jsonStep(3, fs.User, "b") + jsonStep(4, fs.Builtin, "seal_oem.sh"),
+		},
+		{
+			"InsertStepWithRunOptions",
+			&InsertStep{},
+			[]string{"-step=1", "-script=script", "-timeout=1m", "-retries=2", "-allow-failure",
+				"-interpreter=/usr/bin/python3"},
+			true,
+			`{"version":2,"id":5,"type":"script","buildContext":"user","script":"script","timeoutSec":60,` +
+				`"retries":2,"allowFailure":true,"interpreter":"/usr/bin/python3"}` + "\n" + jsonStep(1, fs.User, "a") +
+				jsonStep(2, fs.Builtin, "install_gpu.sh") + jsonStep(3, fs.User, "b") + jsonStep(4, fs.Builtin, "seal_oem.sh"),
+		},
+		{
+			"InsertStepNegativeRetries",
+			&InsertStep{},
+			[]string{"-step=1", "-script=script", "-retries=-1"},
+			false,
+			stateFile,
+		},
+		{
+			"InsertStepUnknownSecret",
+			&InsertStep{},
+			[]string{"-step=1", "-script=script", "-env=A=b", "-secret=B"},
+			false,
+			stateFile,
+		},
+		{
+			"InsertStepAfterSealOEM",
+			&InsertStep{},
+			[]string{"-step=5", "-script=script"},
+			false,
+			stateFile,
+		},
+		{
+			"InsertStepBadScript",
+			&InsertStep{},
+			[]string{"-step=1", "-script=missing"},
+			false,
+			stateFile,
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupRunScriptFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			if err := createNonEmptyUserCtxArchive(files, "script"); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(files.StateFile, []byte(stateFile), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ret := executeEditStep(input.command, files, input.flags...)
+			if gotSuccess := ret == subcommands.ExitSuccess; gotSuccess != input.wantSuccess {
+				t.Errorf("%s(%v) succeeded: got %t, want %t", input.command.Name(), input.flags, gotSuccess, input.wantSuccess)
+			}
+			got, err := ioutil.ReadFile(files.StateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != input.want {
+				t.Errorf("%s(%v): state file: got %q, want %q", input.command.Name(), input.flags, string(got), input.want)
+			}
+		})
+	}
+}
+
+func TestRemoveStepCleansUpEnv(t *testing.T) {
+	tmpDir, files, err := setupRunScriptFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := createNonEmptyUserCtxArchive(files, "script"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := executeRunScript(files, "-script=script", "-env=HELLO=world"); err != nil {
+		t.Fatal(err)
+	}
+	stateFile, err := ioutil.ReadFile(files.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(stateFile), fs.UserEnvFilePrefix) {
+		t.Fatalf("run-script(-env=HELLO=world): state file %q does not reference an env file", string(stateFile))
+	}
+	if ret := executeEditStep(&RemoveStep{}, files, "-step=1"); ret != subcommands.ExitSuccess {
+		t.Fatalf("remove-step(-step=1): got %v, want subcommands.ExitSuccess", ret)
+	}
+	outputFiles, err := ioutil.ReadDir(files.PersistBuiltinBuildContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputFiles) != 0 {
+		t.Errorf("remove-step(-step=1): env file not cleaned up; builtin context contains %d files", len(outputFiles))
+	}
+}
+
+// TestRemoveStepPreloadContainerImages checks that removing a preload-container-images step also
+// removes its images from the build config, and that builtin steps that don't change the build
+// config can be removed.
+func TestRemoveStepPreloadContainerImages(t *testing.T) {
+	tmpDir, files, err := setupPreloadFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, flags := range [][]string{{"-images=busybox"}, {"-tarballs=images.tar"}} {
+		if ret := executeEditStep(&PreloadContainerImages{}, files, flags...); ret != subcommands.ExitSuccess {
+			t.Fatalf("preload-container-images(%v): got %v, want subcommands.ExitSuccess", flags, ret)
+		}
+	}
+	if err := fs.AppendStateFile(files.StateFile, fs.Builtin, copyFileScript, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, flags := range [][]string{{"-step=3"}, {"-step=1"}} {
+		if ret := executeEditStep(&RemoveStep{}, files, flags...); ret != subcommands.ExitSuccess {
+			t.Fatalf("remove-step(%v): got %v, want subcommands.ExitSuccess", flags, ret)
+		}
+	}
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != 2 {
+		t.Errorf("remove-step: state file has %d steps; want only step 2", len(entries))
+	}
+	buildConfig := &config.Build{}
+	if err := config.LoadFromFile(files.BuildConfig, buildConfig); err != nil {
+		t.Fatal(err)
+	}
+	want := []config.ContainerImage{{Ref: "app:1.0", Tarball: "images.tar", Digest: testImageID, Step: 2}}
+	if diff := cmp.Diff(buildConfig.ContainerImages, want); diff != "" {
+		t.Errorf("remove-step: build config images diff (-got +want)\n%s", diff)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"strconv"
 	"time"
@@ -30,27 +31,42 @@ import (
 	"cos-customizer/tools/partutil"
 
 	"github.com/google/subcommands"
+	compute "google.golang.org/api/compute/v1"
 )
 
 // FinishImageBuild implements subcommands.Command for the "finish-image-build" command.
 // This command finishes an image build by converting saved image configurations into
 // an actual GCE image.
 type FinishImageBuild struct {
-	imageProject   string
-	zone           string
-	project        string
-	imageName      string
-	imageSuffix    string
-	imageFamily    string
-	deprecateOld   bool
-	oldImageTTLSec int
-	labels         *mapVar
-	licenses       *listVar
-	inheritLabels  bool
-	oemSize        string
-	oemFSSize4K    uint64
-	diskSize       int
-	timeout        time.Duration
+	imageProject         string
+	zone                 string
+	project              string
+	imageName            string
+	imageSuffix          string
+	imageFamily          string
+	deprecateOld         bool
+	oldImageTTLSec       int
+	labels               *mapVar
+	licenses             *listVar
+	inheritLabels        bool
+	reuse                bool
+	oemSize              string
+	oemFSSize4K          uint64
+	diskSize             int
+	timeout              time.Duration
+	keepStaging          bool
+	keepStagingOnFailure bool
+	keepOnFailure        bool
+	machineType          string
+	network              string
+	subnet               string
+	noExternalIP         bool
+	serviceAccount       string
+	scopes               *listVar
+	progressFormat       string
+	reportPath           string
+	dryRun               bool
+	dryRunDir            string
 }
 
 // Name implements subcommands.Command.Name.
@@ -97,6 +113,9 @@ func (f *FinishImageBuild) SetFlags(flags *flag.FlagSet) {
 	flags.BoolVar(&f.inheritLabels, "inherit-labels", false, "Indicates if the result image should inherit labels "+
 		"from the source image. Labels specified through the '-labels' flag take precedence over inherited "+
 		"labels.")
+	flags.BoolVar(&f.reuse, "reuse-if-unchanged", false, "If an image in the output image project was built "+
+		"from the same inputs, reuse it instead of building a new image. The reused image is added to "+
+		"'image-family' if it is set.")
 	flags.StringVar(&f.oemSize, "oem-size", "", "Size of the new OEM partition, "+
 		"can be a number with unit like 10G, 10M, 10K or 10B, "+
 		"or without unit indicating the number of 512B sectors.")
@@ -104,6 +123,40 @@ func (f *FinishImageBuild) SetFlags(flags *flag.FlagSet) {
 		"indicates the default size.")
 	flags.DurationVar(&f.timeout, "timeout", time.Hour, "Timeout value of the image build process. Must be formatted "+
 		"according to Golang's time.Duration string format.")
+	flags.BoolVar(&f.keepStaging, "keep-staging", false, "Keep the files staged in GCS after a successful image "+
+		"build. Later image builds with the same 'gcs-workdir' only upload the files that changed.")
+	flags.BoolVar(&f.keepStagingOnFailure, "keep-staging-on-failure", false, "Keep the files staged in GCS, like the "+
+		"build contexts and the state file, after a failed image build for debugging.")
+	flags.BoolVar(&f.keepOnFailure, "keep-on-failure", false, "Keep the preload VM and its boot disk after a failed "+
+		"image build for debugging. The name of the preload VM is printed along with how to connect to it. Delete "+
+		"them with 'cleanup-debug-resources' when done.")
+	flags.StringVar(&f.machineType, "machine-type", "", "Machine type of the preload VM, like 'n1-standard-4'. "+
+		"Defaults to the Daisy default machine type.")
+	flags.StringVar(&f.network, "network", "", "Network of the preload VM. Defaults to the 'default' network, "+
+		"unless 'subnet' is set.")
+	flags.StringVar(&f.subnet, "subnet", "", "Subnetwork of the preload VM. It must be in the region of 'zone'.")
+	flags.BoolVar(&f.noExternalIP, "no-external-ip", false, "Create the preload VM without an external IP "+
+		"address. The subnetwork of the preload VM then needs Private Google Access to reach GCS.")
+	flags.StringVar(&f.serviceAccount, "service-account", "", "Email of the service account of the preload VM. "+
+		"Defaults to the Compute Engine default service account.")
+	if f.scopes == nil {
+		f.scopes = &listVar{}
+	}
+	flags.Var(f.scopes, "scopes", "OAuth scopes of the service account of the preload VM, as URLs or as names "+
+		"like 'devstorage.read_write'. Format is 'scope1,scope2,...'. The preload VM needs to read and write "+
+		"the GCS bucket of the image build. Defaults to 'devstorage.read_write,cloud-platform'.")
+	flags.StringVar(&f.progressFormat, "progress-format", preloader.ProgressText, "Format of the progress of the "+
+		"steps that run on the preload VM. With 'text', progress and step durations are reported along with the "+
+		"Daisy output. With 'json', a stream of JSON progress events is written to stdout, one per line, and the "+
+		"Daisy output is written to stderr.")
+	flags.StringVar(&f.reportPath, "report", "", "Path to write a JSON report of the image build to. The report "+
+		"describes the source and result images, the steps that ran and how long they took, the staged files "+
+		"and the exit status of Daisy. It is also written if the image build fails.")
+	flags.BoolVar(&f.dryRun, "dry-run", false, "Render the Daisy workflow, the cloud-config of the preload VM and "+
+		"the Daisy arguments of the image build without running it. Nothing is uploaded to GCS and the local "+
+		"build state is kept, so that the real image build can follow.")
+	flags.StringVar(&f.dryRunDir, "dry-run-dir", "cos-customizer-dry-run", "Local directory to write the output "+
+		"of 'dry-run' to.")
 }
 
 func (f *FinishImageBuild) validate() error {
@@ -118,6 +171,11 @@ func (f *FinishImageBuild) validate() error {
 			return fmt.Errorf("oem-size must be at least %dM", defaultOEMSizeMB)
 		}
 	}
+	for _, scope := range f.scopes.l {
+		if scope == "" {
+			return fmt.Errorf("'scopes' must not contain empty scopes")
+		}
+	}
 	switch {
 	case f.imageName == "" && f.imageSuffix == "":
 		return fmt.Errorf("one of 'image-name' or 'image-suffix' must be set")
@@ -131,6 +189,8 @@ func (f *FinishImageBuild) validate() error {
 		return fmt.Errorf("'zone' must be set")
 	case f.project == "":
 		return fmt.Errorf("'project' must be set")
+	case f.progressFormat != preloader.ProgressText && f.progressFormat != preloader.ProgressJSON:
+		return fmt.Errorf("'progress-format' must be %q or %q", preloader.ProgressText, preloader.ProgressJSON)
 	default:
 		return nil
 	}
@@ -154,6 +214,16 @@ func (f *FinishImageBuild) loadConfigs(files *fs.Files) (*config.Image, *config.
 	buildConfig.DiskSize = f.diskSize
 	buildConfig.Timeout = f.timeout.String()
 	buildConfig.OEMSize = f.oemSize
+	buildConfig.KeepStaging = f.keepStaging
+	buildConfig.KeepStagingOnFailure = f.keepStagingOnFailure
+	buildConfig.KeepOnFailure = f.keepOnFailure
+	buildConfig.MachineType = f.machineType
+	buildConfig.Network = f.network
+	buildConfig.Subnet = f.subnet
+	buildConfig.NoExternalIP = f.noExternalIP
+	buildConfig.ServiceAccount = f.serviceAccount
+	buildConfig.Scopes = f.scopes.l
+	buildConfig.ProgressFormat = f.progressFormat
 	outputImageConfig := config.NewImage(imageName, f.imageProject)
 	outputImageConfig.Labels = f.labels.m
 	outputImageConfig.Licenses = f.licenses.l
@@ -237,67 +307,163 @@ func update(dst, src map[string]string) {
 	}
 }
 
+// reuseImage uses the given image, which was built from the same inputs as the result image, in place
+// of the result image. The image is added to the result image family, and the old images in the
+// family are deprecated if requested.
+func (f *FinishImageBuild) reuseImage(ctx context.Context, svc *compute.Service, image *compute.Image,
+	outputImage *config.Image) error {
+	if f.imageFamily == "" {
+		return nil
+	}
+	if image.Family != f.imageFamily {
+		if err := gce.SetImageFamily(svc, outputImage.Project, image.Name, f.imageFamily); err != nil {
+			return fmt.Errorf("cannot add image %s to family %s: %v", image.Name, f.imageFamily, err)
+		}
+		log.Printf("Added image %s to family %s\n", image.Name, f.imageFamily)
+	}
+	if f.deprecateOld {
+		reused := &config.Image{Image: image, Project: outputImage.Project}
+		reused.Family = f.imageFamily
+		if err := gce.DeprecateInFamily(ctx, svc, reused, f.oldImageTTLSec); err != nil {
+			return fmt.Errorf("deprecating images failed: %v", err)
+		}
+	}
+	return nil
+}
+
 // Execute implements subcommands.Command.Execute. It gathers image configuration parameters
 // and creates a GCE image.
-func (f *FinishImageBuild) Execute(ctx context.Context, flags *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+func (f *FinishImageBuild) Execute(ctx context.Context, flags *flag.FlagSet, args ...interface{}) (status subcommands.ExitStatus) {
 	if flags.NArg() != 0 {
 		flags.Usage()
 		return subcommands.ExitUsageError
 	}
 	files := args[0].(*fs.Files)
-	defer files.CleanupAllPersistent()
-	svc, gcsClient, err := args[1].(ServiceClients)(ctx, false)
-	if err != nil {
+	if !f.dryRun {
+		defer files.CleanupAllPersistent()
+	}
+	report := newBuildReport(files)
+	var buildErr error
+	fail := func(err error) subcommands.ExitStatus {
 		log.Println(err)
+		buildErr = err
 		return subcommands.ExitFailure
 	}
-	defer gcsClient.Close()
+	if f.reportPath != "" {
+		defer func() {
+			report.fill(status == subcommands.ExitSuccess, buildErr)
+			if err := report.write(f.reportPath); err != nil {
+				log.Printf("Cannot write the build report: %v\n", err)
+				status = subcommands.ExitFailure
+			}
+		}()
+	}
+	// A dry run can run offline; the API calls it makes are only used to mirror what the real
+	// image build would do.
+	offline := false
+	svc, gcsClient, err := args[1].(ServiceClients)(ctx, false)
+	switch {
+	case err != nil && f.dryRun:
+		log.Printf("Cannot create API clients, continuing the dry run offline: %v\n", err)
+		offline = true
+	case err != nil:
+		return fail(err)
+	default:
+		defer gcsClient.Close()
+	}
 	if err := f.validate(); err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
+		return fail(err)
 	}
 	sourceImage, buildConfig, outputImage, err := f.loadConfigs(files)
 	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
+		return fail(err)
 	}
+	report.setConfigs(sourceImage, buildConfig, outputImage)
 	if err := validateOEM(buildConfig); err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
+		return fail(err)
 	}
-	if err := fs.CreateBuildContextArchive(files.PersistBuiltinBuildContext, files.BuiltinBuildContextArchive); err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
+	if !f.dryRun {
+		if err := fs.CreateBuildContextArchive(files.PersistBuiltinBuildContext, files.BuiltinBuildContextArchive); err != nil {
+			return fail(err)
+		}
 	}
-	exists, err := gce.ImageExists(svc, outputImage.Project, outputImage.Name)
+	if !offline {
+		exists, err := gce.ImageExists(svc, outputImage.Project, outputImage.Name)
+		switch {
+		case err != nil && f.dryRun:
+			log.Printf("Cannot check if the result image exists, continuing the dry run offline: %v\n", err)
+			offline = true
+		case err != nil:
+			return fail(err)
+		case exists:
+			log.Printf("Result image %s already exists in project %s. Exiting.\n", outputImage.Name, outputImage.Project)
+			report.Status = reportExists
+			return subcommands.ExitSuccess
+		}
+	}
+	if f.inheritLabels {
+		if offline {
+			log.Printf("Cannot inherit labels from source image %s while offline; skipping\n", sourceImage.URL())
+		} else {
+			image, err := svc.Images.Get(sourceImage.Project, sourceImage.Name).Do()
+			if err != nil {
+				return fail(err)
+			}
+			update(outputImage.Labels, image.Labels)
+		}
+	}
+	inputHash, err := preloader.InputHash(files, sourceImage, outputImage, buildConfig)
 	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
+		return fail(err)
 	}
-	if exists {
-		log.Printf("Result image %s already exists in project %s. Exiting.\n", outputImage.Name, outputImage.Project)
-		return subcommands.ExitSuccess
+	outputImage.Labels[preloader.InputHashLabel] = inputHash
+	if f.reuse {
+		if offline {
+			log.Println("Cannot look for an image built from the same inputs while offline; skipping")
+		} else {
+			image, err := gce.FindImageByLabel(ctx, svc, outputImage.Project, preloader.InputHashLabel, inputHash)
+			switch {
+			case err != nil && f.dryRun:
+				log.Printf("Cannot look for an image built from the same inputs, continuing the dry run: %v\n", err)
+			case err != nil:
+				return fail(err)
+			case image != nil:
+				log.Printf("Image %s in project %s was built from the same inputs (%s=%s); reusing it instead of "+
+					"building %s\n", image.Name, outputImage.Project, preloader.InputHashLabel, inputHash, outputImage.Name)
+				report.ReusedImage = (&config.Image{Image: image, Project: outputImage.Project}).URL()
+				if f.dryRun {
+					report.Status = reportDryRun
+					return subcommands.ExitSuccess
+				}
+				report.Status = reportReused
+				if err := f.reuseImage(ctx, svc, image, outputImage); err != nil {
+					return fail(err)
+				}
+				return subcommands.ExitSuccess
+			}
+		}
 	}
-	if f.inheritLabels {
-		image, err := svc.Images.Get(sourceImage.Project, sourceImage.Name).Do()
-		if err != nil {
-			log.Println(err)
-			return subcommands.ExitFailure
+	if f.dryRun {
+		report.Status = reportDryRun
+		if err := preloader.DryRun(ctx, files, sourceImage, outputImage, buildConfig, f.dryRunDir, os.Stdout); err != nil {
+			return fail(err)
 		}
-		update(outputImage.Labels, image.Labels)
+		return subcommands.ExitSuccess
 	}
-	if err := preloader.BuildImage(ctx, gcsClient, files, sourceImage, outputImage, buildConfig); err != nil {
+	store := preloader.NewGCSStore(gcsClient, buildConfig.GCSBucket, buildConfig.GCSDir, files.BuildID)
+	result, err := preloader.BuildImage(ctx, store, files, sourceImage, outputImage, buildConfig)
+	report.result = result
+	if err != nil {
 		if _, ok := err.(*exec.ExitError); ok {
 			log.Printf("command failed: %s. See stdout logs for details", err)
+			buildErr = err
 			return subcommands.ExitFailure
 		}
-		log.Println(err)
-		return subcommands.ExitFailure
+		return fail(err)
 	}
 	if f.deprecateOld {
 		if err := gce.DeprecateInFamily(ctx, svc, outputImage, f.oldImageTTLSec); err != nil {
-			log.Printf("deprecating images failed: %s", err)
-			return subcommands.ExitFailure
+			return fail(fmt.Errorf("deprecating images failed: %v", err))
 		}
 	}
 	return subcommands.ExitSuccess
@@ -16,6 +16,7 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -26,6 +27,7 @@ import (
 	"cos-customizer/config"
 	"cos-customizer/fakes"
 	"cos-customizer/fs"
+	"cos-customizer/preloader"
 
 	"cloud.google.com/go/storage"
 	"github.com/google/subcommands"
@@ -81,11 +83,6 @@ func setupFinishBuildFiles() (string, *fs.Files, error) {
 		os.RemoveAll(tmpDir)
 		return "", nil, err
 	}
-	files.DaisyWorkflow, err = createTempFile(tmpDir)
-	if err != nil {
-		os.RemoveAll(tmpDir)
-		return "", nil, err
-	}
 	buildConfigFile, err := ioutil.TempFile(tmpDir, "")
 	if err != nil {
 		os.RemoveAll(tmpDir)
@@ -170,6 +167,71 @@ func TestDeprecateImages(t *testing.T) {
 	}
 }
 
+func TestFinishBuildReport(t *testing.T) {
+	tmpDir, files, err := setupFinishBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := fs.AppendStateFile(files.StateFile, fs.User, "script.sh", ""); err != nil {
+		t.Fatal(err)
+	}
+	gcs := fakes.GCSForTest(t)
+	_, svc := fakes.GCEForTest(t, "p")
+	files.DaisyBin = "/bin/false"
+	reportPath := filepath.Join(tmpDir, "report.json")
+	if _, err := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-name=out", "-image-project=p",
+		"-report="+reportPath); err == nil {
+		t.Fatalf("FinishImageBuild.Execute(-report=%s) with a failing Daisy = nil; want error", reportPath)
+	}
+	data, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("FinishImageBuild.Execute(-report=%s): cannot read report: %v", reportPath, err)
+	}
+	report := &buildReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		t.Fatalf("FinishImageBuild.Execute(-report=%s): report %s is not JSON: %v", reportPath, data, err)
+	}
+	if report.Status != reportFailed || report.DaisyExitStatus == nil || *report.DaisyExitStatus != 1 {
+		t.Errorf("FinishImageBuild.Execute(-report=%s): report = %s; want a failed build with Daisy exit status 1",
+			reportPath, data)
+	}
+	if report.OutputImage != "projects/p/global/images/out" || report.Labels[preloader.InputHashLabel] == "" {
+		t.Errorf("FinishImageBuild.Execute(-report=%s): report = %s; want output image out with an input hash label",
+			reportPath, data)
+	}
+	if len(report.Steps) != 1 || report.Steps[0].Script != "script.sh" || len(report.StagedFiles) == 0 {
+		t.Errorf("FinishImageBuild.Execute(-report=%s): report = %s; want step script.sh and staged files", reportPath, data)
+	}
+}
+
+func TestReuseIfUnchanged(t *testing.T) {
+	tmpDir, files, err := setupFinishBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	inputHash, err := preloader.InputHash(files, config.NewImage("in", "p"), config.NewImage("out", "p"), &config.Build{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcs := fakes.GCSForTest(t)
+	gce, svc := fakes.GCEForTest(t, "p")
+	gce.Images = &compute.ImageList{Items: []*compute.Image{
+		{Name: "other", Labels: map[string]string{preloader.InputHashLabel: "other"}},
+		{Name: "reused", Family: "old", Labels: map[string]string{preloader.InputHashLabel: inputHash}},
+	}}
+	gce.Operations = []*compute.Operation{{Status: "DONE"}}
+	files.DaisyBin = "/bin/false"
+	if _, err := executeFinishBuild(files, svc, gcs.Client, "-project=p", "-zone=z", "-image-name=out", "-image-project=p",
+		"-image-family=f", "-reuse-if-unchanged"); err != nil {
+		t.Fatalf("FinishImageBuild.Execute(-reuse-if-unchanged); daisy shouldn't execute if an image was built from the same inputs; err: %q", err)
+	}
+	if got := gce.Images.Items[1].Family; got != "f" {
+		t.Errorf("FinishImageBuild.Execute(-reuse-if-unchanged -image-family=f): reused image family = %q; want \"f\"", got)
+	}
+}
+
 func TestValidateFailure(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -187,6 +249,16 @@ func TestValidateFailure(t *testing.T) {
 			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-image-family=f", "-disk-size-gb=12", "-oem-size=1025M"},
 			expectErr: true,
 			msg:       "disk size should be invalid",
+		}, {
+			name:      "ProgressFormat",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-progress-format=xml"},
+			expectErr: true,
+			msg:       "'progress-format' value should be invalid",
+		}, {
+			name:      "EmptyScope",
+			flags:     []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-scopes=cloud-platform,"},
+			expectErr: true,
+			msg:       "empty scope should be invalid",
 		},
 	}
 	for _, test := range tests {
@@ -204,3 +276,35 @@ func TestValidateFailure(t *testing.T) {
 		})
 	}
 }
+
+func TestFinishBuildDryRunOffline(t *testing.T) {
+	tmpDir, files, err := setupFinishBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	files.DaisyBin = "/bin/false"
+	clients := ServiceClients(func(_ context.Context, _ bool) (*compute.Service, *storage.Client, error) {
+		return nil, nil, fmt.Errorf("offline")
+	})
+	dryRunDir := filepath.Join(tmpDir, "dry_run")
+	flags := []string{"-project=p", "-zone=z", "-image-name=out", "-image-project=p", "-inherit-labels",
+		"-dry-run", "-dry-run-dir=" + dryRunDir}
+	flagSet := &flag.FlagSet{}
+	finishBuild := &FinishImageBuild{}
+	finishBuild.SetFlags(flagSet)
+	if err := flagSet.Parse(flags); err != nil {
+		t.Fatal(err)
+	}
+	if ret := finishBuild.Execute(context.Background(), flagSet, files, clients); ret != subcommands.ExitSuccess {
+		t.Fatalf("FinishImageBuild.Execute(%v) = %v; want subcommands.ExitSuccess", flags, ret)
+	}
+	for _, name := range []string{"daisy_args", "cloud_config.yaml", "build_image.wf.json"} {
+		if _, err := os.Stat(filepath.Join(dryRunDir, name)); err != nil {
+			t.Errorf("FinishImageBuild.Execute(%v): dry run output %s: %v", flags, name, err)
+		}
+	}
+	if _, err := os.Stat(files.BuiltinBuildContextArchive); !os.IsNotExist(err) {
+		t.Errorf("FinishImageBuild.Execute(%v): builtin build context archive created; want the build state untouched", flags)
+	}
+}
@@ -68,3 +68,22 @@ func (lv *listVar) Set(s string) error {
 	lv.l = append(lv.l, list...)
 	return nil
 }
+
+// repeatedVar implements flag.Value for a flag that can be given multiple times. Unlike listVar, the
+// values are not split on commas. Example:
+// "-my-flag a,b -my-flag c" results in {"a,b", "c"}
+type repeatedVar struct {
+	l []string
+}
+
+// String implements flag.Value.String.
+func (rv *repeatedVar) String() string {
+	listJSON, _ := json.Marshal(rv.l)
+	return string(listJSON)
+}
+
+// Set implements flag.Value.Set. It adds the given string to the repeatedVar.
+func (rv *repeatedVar) Set(s string) error {
+	rv.l = append(rv.l, s)
+	return nil
+}
@@ -88,3 +88,16 @@ func TestListVar(t *testing.T) {
 		})
 	}
 }
+
+func TestRepeatedVar(t *testing.T) {
+	rv := &repeatedVar{}
+	flags := []string{"a,b", "", "c d"}
+	for _, flag := range flags {
+		if err := rv.Set(flag); err != nil {
+			t.Fatalf("repeatedVar.Set(%s) = %s; want nil", flag, err)
+		}
+	}
+	if got := rv.l; !cmp.Equal(got, flags) {
+		t.Errorf("repeatedVar: got unexpected result with flags %v: got %v, want %v", flags, got, flags)
+	}
+}
@@ -110,15 +110,18 @@ func validDriverVersions(ctx context.Context, gcsClient *storage.Client) (map[st
 	return validDrivers, nil
 }
 
-func (i *InstallGPU) validate(ctx context.Context, gcsClient *storage.Client, files *fs.Files) error {
-	isValidGPU := false
+// isValidGPU checks if the given GPU type is supported.
+func isValidGPU(gpuType string) bool {
 	for _, g := range validGPUs {
-		if i.gpuType == g {
-			isValidGPU = true
-			break
+		if gpuType == g {
+			return true
 		}
 	}
-	if !isValidGPU {
+	return false
+}
+
+func (i *InstallGPU) validate(ctx context.Context, gcsClient *storage.Client, files *fs.Files) error {
+	if !isValidGPU(i.gpuType) {
 		return fmt.Errorf("%q is an invalid GPU type. Must be one of: %v", i.gpuType, validGPUs)
 	}
 	if i.NvidiaDriverVersion == "" {
@@ -174,31 +177,22 @@ func (i *InstallGPU) templateScript(scriptPath string) error {
 }
 
 func (i *InstallGPU) updateBuildConfig(configPath string) error {
-	buildConfig := &config.Build{}
-	configFile, err := os.OpenFile(configPath, os.O_RDWR, 0666)
-	if err != nil {
-		return err
-	}
-	defer configFile.Close()
-	if err := config.Load(configFile, buildConfig); err != nil {
-		return err
-	}
-	buildConfig.GPUType = i.gpuType
-	if i.gpuDataDir != "" {
-		files, err := ioutil.ReadDir(i.gpuDataDir)
-		if err != nil {
-			return fmt.Errorf("error reading dir %q: %v", i.gpuDataDir, err)
-		}
-		for _, f := range files {
-			if f.Mode().IsRegular() {
-				buildConfig.GCSFiles = append(buildConfig.GCSFiles, filepath.Join(i.gpuDataDir, f.Name()))
+	return updateBuildConfigFile(configPath, func(buildConfig *config.Build) error {
+		buildConfig.GPUType = i.gpuType
+		buildConfig.GPUDriverVersion = i.NvidiaDriverVersion
+		if i.gpuDataDir != "" {
+			files, err := ioutil.ReadDir(i.gpuDataDir)
+			if err != nil {
+				return fmt.Errorf("error reading dir %q: %v", i.gpuDataDir, err)
+			}
+			for _, f := range files {
+				if f.Mode().IsRegular() {
+					buildConfig.GCSFiles = append(buildConfig.GCSFiles, filepath.Join(i.gpuDataDir, f.Name()))
+				}
 			}
 		}
-	}
-	if _, err := configFile.Seek(0, 0); err != nil {
-		return err
-	}
-	return config.SaveBuildConfigToFile(configFile, buildConfig)
+		return nil
+	})
 }
 
 // Execute implements subcommands.Command.Execute. It configures the current image build process to
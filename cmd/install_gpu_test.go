@@ -182,6 +182,9 @@ func TestInstallGPUBuildConfig(t *testing.T) {
 	if got := buildConfig.GPUType; got != "nvidia-tesla-k80" {
 		t.Errorf("install-gpu(-version=390.46 -gpu-type=nvidia-tesla-k80); GPU; got %s, want nvidia-tesla-k80", buildConfig.GPUType)
 	}
+	if got := buildConfig.GPUDriverVersion; got != "390.46" {
+		t.Errorf("install-gpu(-version=390.46 -gpu-type=nvidia-tesla-k80); GPU driver version; got %s, want 390.46", got)
+	}
 }
 
 func TestInstallGPUBuildConfigGCSFiles(t *testing.T) {
@@ -276,7 +279,7 @@ func TestInstallGPUStateFile(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	want := []byte("builtin\tinstall_gpu.sh\t\n")
+	want := []byte(jsonStep(1, fs.Builtin, "install_gpu.sh"))
 	if !bytes.Equal(got, want) {
 		t.Errorf("install-gpu(_); state file; got %s, want %s", string(got), string(want))
 	}
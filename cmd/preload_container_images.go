@@ -0,0 +1,313 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+
+	"cos-customizer/config"
+	"cos-customizer/fs"
+
+	"github.com/google/subcommands"
+)
+
+const preloadImagesScript = "preload_container_images.sh"
+
+var (
+	digestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	tagRegexp    = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	repoRegexp   = regexp.MustCompile(`^[a-z0-9]+([._/-][a-z0-9]+)*$`)
+)
+
+// imageRef is a parsed container image reference, like gcr.io/my-project/my-image:tag.
+type imageRef struct {
+	// name is the image name as given by the user, without tag or digest.
+	name     string
+	registry string
+	repo     string
+	tag      string
+	digest   string
+}
+
+// parseImageRef parses a container image reference. Like docker, it treats references without a
+// registry as Docker Hub images and references without a tag or digest as having the "latest" tag.
+func parseImageRef(ref string) (*imageRef, error) {
+	r := &imageRef{name: ref}
+	if i := strings.Index(r.name, "@"); i >= 0 {
+		r.name, r.digest = r.name[:i], r.name[i+1:]
+		if !digestRegexp.MatchString(r.digest) {
+			return nil, fmt.Errorf("image %q has an invalid digest; digests must look like sha256:<64 hex digits>", ref)
+		}
+	}
+	if i := strings.LastIndex(r.name, ":"); i > strings.LastIndex(r.name, "/") {
+		r.name, r.tag = r.name[:i], r.name[i+1:]
+		if !tagRegexp.MatchString(r.tag) {
+			return nil, fmt.Errorf("image %q has an invalid tag", ref)
+		}
+	}
+	if r.tag == "" && r.digest == "" {
+		r.tag = "latest"
+	}
+	split := strings.SplitN(r.name, "/", 2)
+	if len(split) == 2 && (strings.ContainsAny(split[0], ".:") || split[0] == "localhost") {
+		r.registry, r.repo = split[0], split[1]
+	} else {
+		r.registry, r.repo = "docker.io", r.name
+		if len(split) == 1 {
+			r.repo = "library/" + r.name
+		}
+	}
+	if !repoRegexp.MatchString(r.repo) {
+		return nil, fmt.Errorf("image %q has an invalid repository name", ref)
+	}
+	return r, nil
+}
+
+// pulledDigest picks the digest of the given pulled image out of the repository digests that 'docker
+// inspect' reported for it on the preload VM, like "gcr.io/my-project/my-image@sha256:...". It returns
+// an empty string if none of them is from the repository of the image.
+func pulledDigest(image string, repoDigests []string) string {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return ""
+	}
+	for _, repoDigest := range repoDigests {
+		pulled, err := parseImageRef(repoDigest)
+		if err != nil || pulled.digest == "" {
+			continue
+		}
+		if pulled.registry == ref.registry && pulled.repo == ref.repo {
+			return pulled.digest
+		}
+	}
+	return ""
+}
+
+// dockerSaveManifest is an entry of the manifest.json file at the root of a tarball written by
+// 'docker save'.
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+}
+
+// tarballImages lists the images contained in the given 'docker save' tarball in the user build
+// context.
+func tarballImages(files *fs.Files, tarball string) ([]config.ContainerImage, error) {
+	var manifests []dockerSaveManifest
+	err := fs.ReadArchiveObject(files.UserBuildContextArchive, tarball, func(r io.Reader) error {
+		tarReader := tar.NewReader(r)
+		for {
+			hdr, err := tarReader.Next()
+			if err == io.EOF {
+				return fmt.Errorf("%s is not a 'docker save' tarball; it has no manifest.json", tarball)
+			}
+			if err != nil {
+				return fmt.Errorf("cannot read tarball %s: %v", tarball, err)
+			}
+			if path.Clean(hdr.Name) == "manifest.json" {
+				return json.NewDecoder(tarReader).Decode(&manifests)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	var images []config.ContainerImage
+	for _, manifest := range manifests {
+		// The config file is named after the image ID; either <ID>.json or blobs/sha256/<ID>.
+		digest := "sha256:" + strings.TrimSuffix(path.Base(manifest.Config), ".json")
+		if !digestRegexp.MatchString(digest) {
+			return nil, fmt.Errorf("tarball %s has an image with unexpected config file %q", tarball, manifest.Config)
+		}
+		if len(manifest.RepoTags) == 0 {
+			images = append(images, config.ContainerImage{Tarball: tarball, Digest: digest})
+		}
+		for _, tag := range manifest.RepoTags {
+			images = append(images, config.ContainerImage{Ref: tag, Tarball: tarball, Digest: digest})
+		}
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("tarball %s does not contain any images", tarball)
+	}
+	return images, nil
+}
+
+// PreloadContainerImages implements subcommands.Command for the "preload-container-images" command.
+// This command configures the current image build process to preload container images into the
+// Docker storage of the result image.
+type PreloadContainerImages struct {
+	images   *listVar
+	tarballs *listVar
+}
+
+// Name implements subcommands.Command.Name.
+func (*PreloadContainerImages) Name() string {
+	return "preload-container-images"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*PreloadContainerImages) Synopsis() string {
+	return "Configure the image build to preload container images."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*PreloadContainerImages) Usage() string {
+	return `preload-container-images [-images=<image>,...] [-tarballs=<tarball>,...]
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (p *PreloadContainerImages) SetFlags(f *flag.FlagSet) {
+	if p.images == nil {
+		p.images = &listVar{}
+	}
+	if p.tarballs == nil {
+		p.tarballs = &listVar{}
+	}
+	f.Var(p.images, "images", "Comma separated list of container images to pull. The preload VM logs the digests "+
+		"of the pulled images.")
+	f.Var(p.tarballs, "tarballs", "Comma separated list of tarballs written by 'docker save' to load. "+
+		"Paths should be relative to the root of the build context.")
+}
+
+// validateFlags checks the flags that can be checked without the build context.
+func (p *PreloadContainerImages) validateFlags() error {
+	if len(p.images.l) == 0 && len(p.tarballs.l) == 0 {
+		return fmt.Errorf("at least one of images or tarballs must be set")
+	}
+	for _, image := range p.images.l {
+		if _, err := parseImageRef(image); err != nil {
+			return err
+		}
+	}
+	for _, tarball := range p.tarballs.l {
+		if strings.Contains(tarball, "\n") {
+			return fmt.Errorf("tarball path %q must not contain a newline", tarball)
+		}
+	}
+	return nil
+}
+
+// listImages returns the images to pull and the images to load from tarballs.
+func (p *PreloadContainerImages) listImages(files *fs.Files) (pulled, loaded []config.ContainerImage, err error) {
+	if err := p.validateFlags(); err != nil {
+		return nil, nil, err
+	}
+	for _, image := range p.images.l {
+		ref, err := parseImageRef(image)
+		if err != nil {
+			return nil, nil, err
+		}
+		pulled = append(pulled, config.ContainerImage{Ref: image, Digest: ref.digest})
+	}
+	for _, tarball := range p.tarballs.l {
+		images, err := tarballImages(files, tarball)
+		if err != nil {
+			return nil, nil, err
+		}
+		loaded = append(loaded, images...)
+	}
+	return pulled, loaded, nil
+}
+
+// preloadEnv builds the environment of the preload_container_images.sh script.
+func preloadEnv(pulled, loaded []config.ContainerImage) map[string]string {
+	var pullLines, tarballLines, idLines []string
+	for _, image := range pulled {
+		pullLines = append(pullLines, image.Ref)
+	}
+	seenTarballs := make(map[string]bool)
+	seenIDs := make(map[string]bool)
+	for _, image := range loaded {
+		if !seenTarballs[image.Tarball] {
+			seenTarballs[image.Tarball] = true
+			tarballLines = append(tarballLines, image.Tarball)
+		}
+		if !seenIDs[image.Digest] {
+			seenIDs[image.Digest] = true
+			idLines = append(idLines, image.Digest)
+		}
+	}
+	return map[string]string{
+		"PRELOAD_PULL_IMAGES":      strings.Join(pullLines, "\n"),
+		"PRELOAD_LOAD_TARBALLS":    strings.Join(tarballLines, "\n"),
+		"PRELOAD_LOADED_IMAGE_IDS": strings.Join(idLines, "\n"),
+	}
+}
+
+func updateContainerImages(configPath string, images []config.ContainerImage) error {
+	return updateBuildConfigFile(configPath, func(buildConfig *config.Build) error {
+		buildConfig.ContainerImages = append(buildConfig.ContainerImages, images...)
+		return nil
+	})
+}
+
+// removeContainerImages removes the images preloaded by the step with the given ID from the build
+// config.
+func removeContainerImages(configPath string, step int) error {
+	return updateBuildConfigFile(configPath, func(buildConfig *config.Build) error {
+		var images []config.ContainerImage
+		for _, image := range buildConfig.ContainerImages {
+			if image.Step != step {
+				images = append(images, image)
+			}
+		}
+		buildConfig.ContainerImages = images
+		return nil
+	})
+}
+
+// Execute implements subcommands.Command.Execute. It configures the current image build process to
+// preload container images into the Docker storage of the result image.
+func (p *PreloadContainerImages) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	pulled, loaded, err := p.listImages(files)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	envFileName, err := createEnvFile(fs.PreloadImagesEnvFilePrefix, files, preloadEnv(pulled, loaded), nil)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	entry := &fs.StateFileEntry{BuildContext: fs.Builtin, Script: preloadImagesScript, Env: envFileName}
+	if err := fs.AppendStateFileEntry(files.StateFile, entry); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	images := append(pulled, loaded...)
+	for i := range images {
+		images[i].Step = entry.ID
+	}
+	if err := updateContainerImages(files.BuildConfig, images); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
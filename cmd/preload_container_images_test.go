@@ -0,0 +1,251 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cos-customizer/config"
+	"cos-customizer/fs"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/subcommands"
+)
+
+const testImageID = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseImageRef(t *testing.T) {
+	var testData = []struct {
+		testName string
+		ref      string
+		want     *imageRef
+	}{
+		{
+			"DockerHubOfficial",
+			"busybox",
+			&imageRef{name: "busybox", registry: "docker.io", repo: "library/busybox", tag: "latest"},
+		},
+		{
+			"DockerHubUser",
+			"user/image:1.0",
+			&imageRef{name: "user/image", registry: "docker.io", repo: "user/image", tag: "1.0"},
+		},
+		{
+			"GCR",
+			"gcr.io/my-project/image:tag",
+			&imageRef{name: "gcr.io/my-project/image", registry: "gcr.io", repo: "my-project/image", tag: "tag"},
+		},
+		{
+			"RegistryWithPort",
+			"localhost:5000/image",
+			&imageRef{name: "localhost:5000/image", registry: "localhost:5000", repo: "image", tag: "latest"},
+		},
+		{
+			"Digest",
+			"gcr.io/p/image@" + testImageID,
+			&imageRef{name: "gcr.io/p/image", registry: "gcr.io", repo: "p/image", digest: testImageID},
+		},
+		{
+			"TagAndDigest",
+			"gcr.io/p/image:tag@" + testImageID,
+			&imageRef{name: "gcr.io/p/image", registry: "gcr.io", repo: "p/image", tag: "tag", digest: testImageID},
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			got, err := parseImageRef(input.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, input.want, cmp.AllowUnexported(imageRef{})); diff != "" {
+				t.Errorf("parseImageRef(%q): mismatch: diff (-got +want)\n%s", input.ref, diff)
+			}
+		})
+	}
+}
+
+func TestParseImageRefInvalid(t *testing.T) {
+	for _, ref := range []string{"", "Image", "image:", "image:bad!tag", "image@sha256:abc", "gcr.io/"} {
+		if _, err := parseImageRef(ref); err == nil {
+			t.Errorf("parseImageRef(%q) = nil; want error", ref)
+		}
+	}
+}
+
+func TestPulledDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	other := "sha256:" + strings.Repeat("b", 64)
+	testData := []struct {
+		testName    string
+		image       string
+		repoDigests []string
+		want        string
+	}{
+		{"DockerHub", "busybox", []string{"busybox@" + digest}, digest},
+		{"DockerHubFullName", "docker.io/library/busybox:1.32", []string{"busybox@" + digest}, digest},
+		{"Registry", "gcr.io/p/app:1.0", []string{"gcr.io/mirror/app@" + other, "gcr.io/p/app@" + digest}, digest},
+		{"OtherRepository", "gcr.io/p/app:1.0", []string{"gcr.io/mirror/app@" + other}, ""},
+		{"Invalid", "gcr.io/p/app:1.0", []string{"gcr.io/p/app"}, ""},
+		{"None", "busybox", nil, ""},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			if got := pulledDigest(input.image, input.repoDigests); got != input.want {
+				t.Errorf("pulledDigest(%q, %v) = %q; want %q", input.image, input.repoDigests, got, input.want)
+			}
+		})
+	}
+}
+
+// createDockerSaveTarball writes a minimal 'docker save' tarball with a single image to the given
+// path.
+func createDockerSaveTarball(path string, repoTags []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tagsJSON := `[]`
+	if len(repoTags) > 0 {
+		tagsJSON = `["` + strings.Join(repoTags, `","`) + `"]`
+	}
+	manifest := fmt.Sprintf(`[{"Config":"%s.json","RepoTags":%s,"Layers":[]}]`,
+		strings.TrimPrefix(testImageID, "sha256:"), tagsJSON)
+	tarWriter := tar.NewWriter(f)
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifest))}); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write([]byte(manifest)); err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+func setupPreloadFiles() (string, *fs.Files, error) {
+	tmpDir, files, err := setupRunScriptFiles()
+	if err != nil {
+		return "", nil, err
+	}
+	files.BuildConfig = filepath.Join(tmpDir, "build")
+	if err := ioutil.WriteFile(files.BuildConfig, []byte("{}"), 0644); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	contextDir := filepath.Join(tmpDir, "context")
+	if err := os.Mkdir(contextDir, 0755); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	if err := createDockerSaveTarball(filepath.Join(contextDir, "images.tar"), []string{"app:1.0"}); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(contextDir, "not_images.tar"), nil, 0644); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	if err := os.Remove(files.UserBuildContextArchive); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	if err := fs.CreateBuildContextArchive(contextDir, files.UserBuildContextArchive); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	return tmpDir, files, nil
+}
+
+func TestPreloadContainerImages(t *testing.T) {
+	tmpDir, files, err := setupPreloadFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	taggedImage := "gcr.io/p/tagged:tag"
+	pinnedImage := "gcr.io/p/pinned@" + testImageID
+	flags := []string{"-images=" + taggedImage + "," + pinnedImage, "-tarballs=images.tar"}
+	if ret := executeEditStep(&PreloadContainerImages{}, files, flags...); ret != subcommands.ExitSuccess {
+		t.Fatalf("preload-container-images(%v): got %v, want subcommands.ExitSuccess", flags, ret)
+	}
+	buildConfig := &config.Build{}
+	if err := config.LoadFromFile(files.BuildConfig, buildConfig); err != nil {
+		t.Fatal(err)
+	}
+	want := []config.ContainerImage{
+		{Ref: taggedImage, Step: 1},
+		{Ref: pinnedImage, Digest: testImageID, Step: 1},
+		{Ref: "app:1.0", Tarball: "images.tar", Digest: testImageID, Step: 1},
+	}
+	if diff := cmp.Diff(buildConfig.ContainerImages, want); diff != "" {
+		t.Errorf("preload-container-images(%v): build config mismatch: diff (-got +want)\n%s", flags, diff)
+	}
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].BuildContext != fs.Builtin || entries[0].Script != preloadImagesScript {
+		t.Fatalf("preload-container-images(%v): state file: got %v, want a single %s step", flags, entries, preloadImagesScript)
+	}
+	env, err := ioutil.ReadFile(filepath.Join(files.PersistBuiltinBuildContext, entries[0].Env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, wantEnv := range []string{
+		fmt.Sprintf("export PRELOAD_PULL_IMAGES='%s\n%s'", taggedImage, pinnedImage),
+		"export PRELOAD_LOAD_TARBALLS='images.tar'",
+		fmt.Sprintf("export PRELOAD_LOADED_IMAGE_IDS='%s'", testImageID),
+	} {
+		if !strings.Contains(string(env), wantEnv) {
+			t.Errorf("preload-container-images(%v): env file: got %q, want it to contain %q", flags, string(env), wantEnv)
+		}
+	}
+}
+
+func TestPreloadContainerImagesInvalid(t *testing.T) {
+	var testData = []struct {
+		testName string
+		flags    []string
+	}{
+		{"NoImages", nil},
+		{"BadImage", []string{"-images=Image"}},
+		{"MissingTarball", []string{"-tarballs=missing.tar"}},
+		{"NotDockerSaveTarball", []string{"-tarballs=not_images.tar"}},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupPreloadFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			if ret := executeEditStep(&PreloadContainerImages{}, files, input.flags...); ret == subcommands.ExitSuccess {
+				t.Errorf("preload-container-images(%v): got subcommands.ExitSuccess, want failure", input.flags)
+			}
+			got, err := ioutil.ReadFile(files.StateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 0 {
+				t.Errorf("preload-container-images(%v): state file: got %q, want empty", input.flags, string(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"cos-customizer/config"
+	"cos-customizer/fs"
+	"cos-customizer/preloader"
+)
+
+// Statuses of build reports and their steps.
+const (
+	reportSucceeded  = "succeeded"
+	reportFailed     = "failed"
+	reportExists     = "exists"
+	reportReused     = "reused"
+	reportDryRun     = "dry-run"
+	reportUnfinished = "unfinished"
+	reportNotRun     = "not-run"
+)
+
+// stepReport describes how a step of the state file ran on the preload VM.
+type stepReport struct {
+	ID           int
+	BuildContext fs.BuildContext
+	Script       string
+	Args         []string `json:",omitempty"`
+	// EnvKeys are the names of the variables of the environment file of the step. Their values are
+	// not reported, since they can be secret.
+	EnvKeys []string `json:",omitempty"`
+	// Status is one of "succeeded", "failed", "unfinished" or "not-run".
+	Status      string
+	DurationSec float64 `json:",omitempty"`
+}
+
+// buildReport describes an image build. It is written by "finish-image-build -report".
+type buildReport struct {
+	// Status is one of "succeeded", "failed", "exists", "reused" or "dry-run".
+	Status            string
+	Error             string `json:",omitempty"`
+	SourceImage       string `json:",omitempty"`
+	OutputImage       string `json:",omitempty"`
+	OutputImageFamily string `json:",omitempty"`
+	// ReusedImage is the image that was reused in place of the output image.
+	ReusedImage      string            `json:",omitempty"`
+	Labels           map[string]string `json:",omitempty"`
+	Licenses         []string          `json:",omitempty"`
+	DiskSizeGB       int               `json:",omitempty"`
+	OEMSize          string            `json:",omitempty"`
+	OEMFSSize4K      uint64            `json:",omitempty"`
+	SealOEM          bool              `json:",omitempty"`
+	GPUType          string            `json:",omitempty"`
+	GPUDriverVersion string            `json:",omitempty"`
+	// ContainerImages are the preloaded container images. Images pulled by tag have the digest that
+	// the preload VM pulled, if it reported one.
+	ContainerImages []config.ContainerImage `json:",omitempty"`
+	Steps           []stepReport            `json:",omitempty"`
+	FailedStep      int                     `json:",omitempty"`
+	StagedFiles     []preloader.StagedFile  `json:",omitempty"`
+	// DaisyExitStatus is the exit status of Daisy. It is omitted if Daisy did not run, and -1 if Daisy
+	// was terminated by a signal.
+	DaisyExitStatus *int `json:",omitempty"`
+	// DebugVM is the preload VM that was kept for debugging after the image build failed.
+	DebugVM     string `json:",omitempty"`
+	DurationSec float64
+
+	start   time.Time
+	entries []*fs.StateFileEntry
+	envKeys map[int][]string
+	source  *config.Image
+	build   *config.Build
+	output  *config.Image
+	result  *preloader.BuildResult
+}
+
+// envKeys reads the names of the variables exported by the given environment file.
+func envKeys(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if match := exportLineRegex.FindStringSubmatch(scanner.Text()); match != nil {
+			keys = append(keys, match[1])
+		}
+	}
+	sort.Strings(keys)
+	return keys, scanner.Err()
+}
+
+// newBuildReport starts a report of the image build in the given local state. It reads the steps and
+// their environment files now, since the local state is deleted when the image build finishes. Steps
+// that cannot be read are left out of the report; the image build itself reports why they cannot be
+// read.
+func newBuildReport(files *fs.Files) *buildReport {
+	r := &buildReport{start: time.Now(), envKeys: make(map[int][]string)}
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		return r
+	}
+	r.entries = entries
+	for _, entry := range entries {
+		if entry.Env == "" {
+			continue
+		}
+		if keys, err := envKeys(filepath.Join(files.PersistBuiltinBuildContext, entry.Env)); err == nil {
+			r.envKeys[entry.ID] = keys
+		}
+	}
+	return r
+}
+
+// setConfigs sets the image configuration that the image build uses. It is read when the report is
+// written, so that changes made during the image build, like added labels, are reported.
+func (r *buildReport) setConfigs(source *config.Image, build *config.Build, output *config.Image) {
+	r.source = source
+	r.build = build
+	r.output = output
+}
+
+// fill fills the report with the outcome of the image build, given whether it succeeded and the error
+// that failed it, if known.
+func (r *buildReport) fill(succeeded bool, err error) {
+	switch {
+	case !succeeded:
+		r.Status = reportFailed
+	case r.Status == "":
+		r.Status = reportSucceeded
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.DurationSec = time.Since(r.start).Seconds()
+	if r.source != nil {
+		r.SourceImage = r.source.URL()
+	}
+	if r.output != nil {
+		r.OutputImage = r.output.URL()
+		r.OutputImageFamily = r.output.Family
+		r.Labels = r.output.Labels
+		r.Licenses = r.output.Licenses
+	}
+	if r.build != nil {
+		r.DiskSizeGB = r.build.DiskSize
+		r.OEMSize = r.build.OEMSize
+		r.OEMFSSize4K = r.build.OEMFSSize4K
+		r.SealOEM = r.build.SealOEM
+		r.GPUType = r.build.GPUType
+		r.GPUDriverVersion = r.build.GPUDriverVersion
+	}
+	progress := make(map[int]*preloader.StepProgress)
+	repoDigests := make(map[string][]string)
+	if r.result != nil {
+		r.StagedFiles = r.result.StagedFiles
+		r.DaisyExitStatus = r.result.DaisyExitCode
+		r.DebugVM = r.result.DebugVM
+		for _, step := range r.result.Steps {
+			progress[step.Entry.ID] = step
+			for image, digests := range step.RepoDigests {
+				repoDigests[image] = digests
+			}
+		}
+	}
+	r.ContainerImages = nil
+	if r.build != nil {
+		for _, image := range r.build.ContainerImages {
+			if image.Tarball == "" && image.Digest == "" {
+				image.Digest = pulledDigest(image.Ref, repoDigests[image.Ref])
+			}
+			r.ContainerImages = append(r.ContainerImages, image)
+		}
+	}
+	r.Steps = nil
+	for _, entry := range r.entries {
+		step := stepReport{
+			ID:           entry.ID,
+			BuildContext: entry.BuildContext,
+			Script:       entry.Script,
+			Args:         entry.Args,
+			EnvKeys:      r.envKeys[entry.ID],
+			Status:       reportNotRun,
+		}
+		if p, ok := progress[entry.ID]; ok {
+			step.DurationSec = p.Duration().Seconds()
+			switch {
+			case p.Failed:
+				step.Status = reportFailed
+				r.FailedStep = entry.ID
+			case p.End.IsZero():
+				step.Status = reportUnfinished
+			default:
+				step.Status = reportSucceeded
+			}
+		}
+		r.Steps = append(r.Steps, step)
+	}
+}
+
+// write writes the report to the given path as a JSON document.
+func (r *buildReport) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cos-customizer/config"
+	"cos-customizer/fs"
+	"cos-customizer/preloader"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildReport(t *testing.T) {
+	tmpDir, files, err := setupFinishBuildFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	env := "export B=b\nexport A='a'\n" + secretEnvMarker + "\nexport TOKEN=secret\n"
+	if err := ioutil.WriteFile(filepath.Join(files.PersistBuiltinBuildContext, "env"), []byte(env), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []*fs.StateFileEntry{
+		{BuildContext: fs.User, Script: "a.sh", Env: "env"},
+		{BuildContext: fs.User, Script: "b.sh", Args: []string{"arg"}},
+		{BuildContext: fs.Builtin, Script: "c.sh"},
+	} {
+		if err := fs.AppendStateFileEntry(files.StateFile, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := newBuildReport(files)
+	output := config.NewImage("out", "p")
+	output.Family = "f"
+	digest := "sha256:" + strings.Repeat("a", 64)
+	report.setConfigs(config.NewImage("in", "p"), &config.Build{SealOEM: true, GPUDriverVersion: "450.51.06",
+		ContainerImages: []config.ContainerImage{{Ref: "busybox"}, {Ref: "gcr.io/p/app:1.0"},
+			{Ref: "app:2.0", Tarball: "app.tar", Digest: digest}}}, output)
+	// Labels added during the image build are reported.
+	output.Labels["key"] = "value"
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	exitCode := 1
+	report.result = &preloader.BuildResult{
+		StagedFiles: []preloader.StagedFile{{File: "f", URL: "gs://b/d/f", CRC32C: "0000abcd"}},
+		Steps: []*preloader.StepProgress{
+			{Entry: report.entries[0], Start: start, End: start.Add(time.Minute), RepoDigests: map[string][]string{
+				"busybox": {"gcr.io/mirror/busybox@sha256:" + strings.Repeat("b", 64), "busybox@" + digest},
+			}},
+			{Entry: report.entries[1], Start: start.Add(time.Minute), End: start.Add(3 * time.Minute), Failed: true},
+		},
+		DaisyExitCode: &exitCode,
+		DebugVM:       "preload-vm-1234",
+	}
+	report.fill(false, errors.New("exit status 1"))
+	reportPath := filepath.Join(tmpDir, "report.json")
+	if err := report.write(reportPath); err != nil {
+		t.Fatalf("buildReport.write(%s): %v", reportPath, err)
+	}
+	data, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("report %s is not JSON: %v", data, err)
+	}
+	delete(got, "DurationSec")
+	want := map[string]interface{}{
+		"Status":            "failed",
+		"Error":             "exit status 1",
+		"SourceImage":       "projects/p/global/images/in",
+		"OutputImage":       "projects/p/global/images/out",
+		"OutputImageFamily": "f",
+		"Labels":            map[string]interface{}{"key": "value"},
+		"SealOEM":           true,
+		"GPUDriverVersion":  "450.51.06",
+		"ContainerImages": []interface{}{
+			map[string]interface{}{"Ref": "busybox", "Tarball": "", "Digest": digest, "Step": 0.0},
+			map[string]interface{}{"Ref": "gcr.io/p/app:1.0", "Tarball": "", "Digest": "", "Step": 0.0},
+			map[string]interface{}{"Ref": "app:2.0", "Tarball": "app.tar", "Digest": digest, "Step": 0.0},
+		},
+		"Steps": []interface{}{
+			map[string]interface{}{"ID": 1.0, "BuildContext": "user", "Script": "a.sh", "EnvKeys": []interface{}{"A", "B", "TOKEN"},
+				"Status": "succeeded", "DurationSec": 60.0},
+			map[string]interface{}{"ID": 2.0, "BuildContext": "user", "Script": "b.sh", "Args": []interface{}{"arg"},
+				"Status": "failed", "DurationSec": 120.0},
+			map[string]interface{}{"ID": 3.0, "BuildContext": "builtin", "Script": "c.sh", "Status": "not-run"},
+		},
+		"FailedStep":      2.0,
+		"StagedFiles":     []interface{}{map[string]interface{}{"File": "f", "URL": "gs://b/d/f", "CRC32C": "0000abcd"}},
+		"DaisyExitStatus": 1.0,
+		"DebugVM":         "preload-vm-1234",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("buildReport.write(%s): report diff (-got, +want): %s", reportPath, diff)
+	}
+}
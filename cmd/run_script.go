@@ -15,26 +15,44 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"cos-customizer/fs"
 
 	"github.com/google/subcommands"
 )
 
+// userScriptFlags are the flags of the commands that configure the image build to run a script from
+// the user build context.
+type userScriptFlags struct {
+	script       string
+	args         *repeatedVar
+	env          *mapVar
+	envFile      string
+	secrets      *listVar
+	timeout      time.Duration
+	retries      int
+	allowFailure bool
+	interpreter  string
+}
+
 // RunScript implements subcommands.Command for the "run-script" command.
 // This command configures the current image build process to customize the result image
 // with a shell script.
 type RunScript struct {
-	script string
-	env    *mapVar
+	userScriptFlags
 }
 
 // Name implements subcommands.Command.Name.
@@ -55,21 +73,200 @@ func (r *RunScript) Usage() string {
 
 // SetFlags implements subcommands.Command.SetFlags.
 func (r *RunScript) SetFlags(f *flag.FlagSet) {
+	r.setFlags(f)
+}
+
+func (r *userScriptFlags) setFlags(f *flag.FlagSet) {
 	f.StringVar(&r.script, "script", "", "Name of script to run.")
+	if r.args == nil {
+		r.args = &repeatedVar{}
+	}
+	f.Var(r.args, "arg", "Argument to pass to the script. Can be given multiple times to pass several arguments, "+
+		"in order. Arguments are printed in the build logs.")
 	if r.env == nil {
 		r.env = newMapVar()
 	}
 	f.Var(r.env, "env", "Env vars to set before running the script.")
+	f.StringVar(&r.envFile, "env-file", "", "Path to a file of env vars to set before running the script, "+
+		"with one KEY=VALUE pair per line. Values set with -env take precedence.")
+	if r.secrets == nil {
+		r.secrets = &listVar{}
+	}
+	f.Var(r.secrets, "secret", "Names of env vars whose values are secret. Secret values are redacted from "+
+		"the build logs.")
+	f.DurationVar(&r.timeout, "timeout", 0, "Timeout of each attempt to run the script. Must be formatted "+
+		"according to Golang's time.Duration string format. '0' indicates no timeout.")
+	f.IntVar(&r.retries, "retries", 0, "Number of times to run the script again if it fails or times out.")
+	f.BoolVar(&r.allowFailure, "allow-failure", false, "Continue the image build if all attempts to run the "+
+		"script fail.")
+	f.StringVar(&r.interpreter, "interpreter", "", "Absolute path of the program to run the script with, "+
+		"e.g. '/usr/bin/python3'. If set to 'exec', the script is executed directly, which honors its shebang "+
+		"line; the script must then be executable in the build context. Defaults to running the script with "+
+		"/bin/bash.")
+}
+
+// validateRunOptions checks the options that control how a script is run on the preload VM.
+func validateRunOptions(timeout time.Duration, retries int) error {
+	if timeout < 0 {
+		return fmt.Errorf("'timeout' must not be negative; got %s", timeout)
+	}
+	if timeout%time.Second != 0 {
+		return fmt.Errorf("'timeout' must be a whole number of seconds; got %s", timeout)
+	}
+	if retries < 0 {
+		return fmt.Errorf("'retries' must not be negative; got %d", retries)
+	}
+	return nil
+}
+
+// validateInterpreter checks that the given script in the user build context can be run with the
+// given interpreter.
+func validateInterpreter(files *fs.Files, script, interpreter string) error {
+	switch {
+	case interpreter == "":
+		return nil
+	case interpreter == fs.ExecInterpreter:
+		mode, found, err := fs.ArchiveObjectMode(files.UserBuildContextArchive, script)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("could not find script %s in build context", script)
+		}
+		if !mode.IsRegular() || mode&0111 == 0 {
+			return fmt.Errorf("script %s is not executable in the build context (mode %v); set its executable "+
+				"bit or provide an interpreter", script, mode)
+		}
+		return nil
+	case !filepath.IsAbs(interpreter) || filepath.Clean(interpreter) != interpreter:
+		return fmt.Errorf("'interpreter' must be a clean absolute path or %q; got %q", fs.ExecInterpreter, interpreter)
+	case strings.ContainsAny(interpreter, " \t\n"):
+		return fmt.Errorf("'interpreter' must not contain whitespace; got %q", interpreter)
+	default:
+		return nil
+	}
 }
 
 func quoteForShell(str string) string {
 	return fmt.Sprintf("'%s'", strings.Replace(str, "'", "'\"'\"'", -1))
 }
 
+// secretEnvMarker is the line of an environment file that separates the variables whose values can
+// be logged from the variables whose values are secret. The preload VM redacts the values of the
+// variables after this line from its logs.
+const secretEnvMarker = "# secret"
+
+var (
+	envVarNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	exportLineRegex = regexp.MustCompile(`^export ([A-Za-z_][A-Za-z0-9_]*)=`)
+)
+
+// readEnvFile reads environment variables from a file with one KEY=VALUE pair per line into the
+// given map. Empty lines and lines starting with '#' are ignored. Values are taken literally, so they
+// can contain any character other than a newline.
+func readEnvFile(path string, env map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			return fmt.Errorf("%s:%d: line is improperly formatted; does it have an '=' character?", path, lineNum)
+		}
+		env[strings.TrimPrefix(strings.TrimSpace(split[0]), "export ")] = split[1]
+	}
+	return scanner.Err()
+}
+
+// mergeEnv combines the variables of the given environment file, if any, with the given variables,
+// which take precedence. It checks that all variable names are valid and that all secrets name one of
+// the variables.
+func mergeEnv(envFile string, env map[string]string, secrets []string) (map[string]string, map[string]bool, error) {
+	merged := make(map[string]string)
+	if envFile != "" {
+		if err := readEnvFile(envFile, merged); err != nil {
+			return nil, nil, err
+		}
+	}
+	for k, v := range env {
+		merged[k] = v
+	}
+	for k := range merged {
+		if !envVarNameRegex.MatchString(k) {
+			return nil, nil, fmt.Errorf("invalid environment variable name %q", k)
+		}
+	}
+	secretSet := make(map[string]bool)
+	for _, k := range secrets {
+		if _, ok := merged[k]; !ok {
+			return nil, nil, fmt.Errorf("secret %q is not one of the given environment variables", k)
+		}
+		secretSet[k] = true
+	}
+	return merged, secretSet, nil
+}
+
+// writeEnv writes the given variables as shell export statements, sorted by name. The variables in
+// secrets are written after secretEnvMarker.
+func writeEnv(w io.Writer, env map[string]string, secrets map[string]bool) error {
+	var names, secretNames []string
+	for k := range env {
+		if secrets[k] {
+			secretNames = append(secretNames, k)
+		} else {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(secretNames)
+	for _, k := range names {
+		if _, err := fmt.Fprintf(w, "export %s=%s\n", k, quoteForShell(env[k])); err != nil {
+			return err
+		}
+	}
+	if len(secretNames) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintln(w, secretEnvMarker); err != nil {
+		return err
+	}
+	for _, k := range secretNames {
+		if _, err := fmt.Fprintf(w, "export %s=%s\n", k, quoteForShell(env[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactEnv replaces the values of the secret variables in the given environment file contents
+// with "<redacted>". It mirrors the redaction done by the preload VM.
+func redactEnv(contents string) string {
+	i := strings.Index("\n"+contents, "\n"+secretEnvMarker+"\n")
+	if i < 0 {
+		return contents
+	}
+	var sb strings.Builder
+	sb.WriteString(contents[:i])
+	for _, line := range strings.Split(contents[i+len(secretEnvMarker)+1:], "\n") {
+		if match := exportLineRegex.FindStringSubmatch(line); match != nil {
+			fmt.Fprintf(&sb, "export %s=<redacted>\n", match[1])
+		}
+	}
+	return sb.String()
+}
+
 // createEnvFile creates an environment variable file from the given map. During preloading, this file
-// is sourced before the script associated with this step is run. The resulting file is stored in
-// the builtin build context to avoid collisions with user data.
-func createEnvFile(prefix string, files *fs.Files, env map[string]string) (string, error) {
+// is sourced before the script associated with this step is run. The values of the variables in
+// secrets are redacted from the build logs. The resulting file is stored in the builtin build context
+// to avoid collisions with user data.
+func createEnvFile(prefix string, files *fs.Files, env map[string]string, secrets map[string]bool) (string, error) {
 	if env == nil || len(env) == 0 {
 		return "", nil
 	}
@@ -77,12 +274,10 @@ func createEnvFile(prefix string, files *fs.Files, env map[string]string) (strin
 	if err != nil {
 		return "", err
 	}
-	for k, v := range env {
-		if _, err := fmt.Fprintf(envFile, "export %s=%s\n", k, quoteForShell(v)); err != nil {
-			envFile.Close()
-			os.Remove(envFile.Name())
-			return "", err
-		}
+	if err := writeEnv(envFile, env, secrets); err != nil {
+		envFile.Close()
+		os.Remove(envFile.Name())
+		return "", err
 	}
 	if err := envFile.Close(); err != nil {
 		os.Remove(envFile.Name())
@@ -91,6 +286,53 @@ func createEnvFile(prefix string, files *fs.Files, env map[string]string) (strin
 	return filepath.Base(envFile.Name()), nil
 }
 
+// validateUserScript checks that the given script is set and exists in the user build context.
+func validateUserScript(step string, files *fs.Files, script string) error {
+	if script == "" {
+		return fmt.Errorf("script not provided for %s step; script is required", step)
+	}
+	isValid, err := fs.ArchiveHasObject(files.UserBuildContextArchive, script)
+	if err != nil {
+		return err
+	}
+	if !isValid {
+		return fmt.Errorf("could not find script %s in build context", script)
+	}
+	return nil
+}
+
+// newEntry validates the flags of the given step and creates the state file entry that runs the
+// script, along with its environment file.
+func (r *userScriptFlags) newEntry(step string, files *fs.Files) (*fs.StateFileEntry, error) {
+	if err := validateUserScript(step, files, r.script); err != nil {
+		return nil, err
+	}
+	if err := validateRunOptions(r.timeout, r.retries); err != nil {
+		return nil, err
+	}
+	if err := validateInterpreter(files, r.script, r.interpreter); err != nil {
+		return nil, err
+	}
+	env, secrets, err := mergeEnv(r.envFile, r.env.m, r.secrets.l)
+	if err != nil {
+		return nil, err
+	}
+	envFileName, err := createEnvFile(fs.UserEnvFilePrefix, files, env, secrets)
+	if err != nil {
+		return nil, err
+	}
+	return &fs.StateFileEntry{
+		BuildContext: fs.User,
+		Script:       r.script,
+		Args:         r.args.l,
+		Env:          envFileName,
+		Timeout:      r.timeout,
+		Retries:      r.retries,
+		AllowFailure: r.allowFailure,
+		Interpreter:  r.interpreter,
+	}, nil
+}
+
 // Execute implements subcommands.Command.Execute. It configures the current image build process to
 // customize the result image with a shell script.
 func (r *RunScript) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
@@ -99,25 +341,12 @@ func (r *RunScript) Execute(_ context.Context, f *flag.FlagSet, args ...interfac
 		return subcommands.ExitUsageError
 	}
 	files := args[0].(*fs.Files)
-	if r.script == "" {
-		log.Printf("script not provided for %s step; script is required\n", r.Name())
-		return subcommands.ExitFailure
-	}
-	isValid, err := fs.ArchiveHasObject(files.UserBuildContextArchive, r.script)
-	if err != nil {
-		log.Println(err)
-		return subcommands.ExitFailure
-	}
-	if !isValid {
-		log.Printf("could not find script %s in build context", r.script)
-		return subcommands.ExitFailure
-	}
-	envFileName, err := createEnvFile("user_env_", files, r.env.m)
+	entry, err := r.newEntry(r.Name(), files)
 	if err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	if err := fs.AppendStateFile(files.StateFile, fs.User, r.script, envFileName); err != nil {
+	if err := fs.AppendStateFileEntry(files.StateFile, entry); err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
@@ -65,6 +65,10 @@ func setupRunScriptFiles() (string, *fs.Files, error) {
 }
 
 func createNonEmptyUserCtxArchive(files *fs.Files, fileName string) error {
+	return createUserCtxArchiveWithMode(files, fileName, 0644)
+}
+
+func createUserCtxArchiveWithMode(files *fs.Files, fileName string, mode os.FileMode) error {
 	tmpDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		return err
@@ -77,6 +81,9 @@ func createNonEmptyUserCtxArchive(files *fs.Files, fileName string) error {
 	if err := newFile.Close(); err != nil {
 		return err
 	}
+	if err := os.Chmod(newFile.Name(), mode); err != nil {
+		return err
+	}
 	if err := os.Remove(files.UserBuildContextArchive); err != nil {
 		return err
 	}
@@ -107,15 +114,29 @@ func TestRunScript(t *testing.T) {
 		{
 			"NoEnv",
 			nil,
-			[]byte("user\tscript\t\n"),
+			[]byte(jsonStep(1, fs.User, "script")),
 			0,
 		},
 		{
 			"Env",
 			[]string{"-env=HELLO1=world1,HELLO2=world2"},
-			[]byte("user\tscript\tuser_env"),
+			[]byte(`{"version":2,"id":1,"type":"script","buildContext":"user","script":"script","env":"user_env_`),
 			1,
 		},
+		{
+			"Args",
+			[]string{"-arg=a b", "-arg=c,d"},
+			[]byte(`{"version":2,"id":1,"type":"script","buildContext":"user","script":"script","args":["a b","c,d"]}` +
+				"\n"),
+			0,
+		},
+		{
+			"RunOptions",
+			[]string{"-timeout=2m", "-retries=3", "-allow-failure"},
+			[]byte(`{"version":2,"id":1,"type":"script","buildContext":"user","script":"script","timeoutSec":120,` +
+				`"retries":3,"allowFailure":true}` + "\n"),
+			0,
+		},
 	}
 	for _, input := range testData {
 		t.Run(input.testName, func(t *testing.T) {
@@ -180,3 +201,176 @@ func TestRunScriptBadScript(t *testing.T) {
 		})
 	}
 }
+
+func TestRunScriptBadRunOptions(t *testing.T) {
+	var testData = []struct {
+		testName string
+		flags    []string
+	}{
+		{"NegativeTimeout", []string{"-timeout=-1s"}},
+		{"FractionalTimeout", []string{"-timeout=1500ms"}},
+		{"NegativeRetries", []string{"-retries=-1"}},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupRunScriptFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			if err := createNonEmptyUserCtxArchive(files, "script"); err != nil {
+				t.Fatal(err)
+			}
+			flags := append(input.flags, "-script=script")
+			if got, _ := executeRunScript(files, flags...); got == subcommands.ExitSuccess {
+				t.Errorf("run-script(%v); got subcommands.ExitSuccess, want failure", flags)
+			}
+		})
+	}
+}
+
+func TestRunScriptInterpreter(t *testing.T) {
+	var testData = []struct {
+		testName  string
+		mode      os.FileMode
+		flags     []string
+		wantState string
+		wantErr   bool
+	}{
+		{"Default", 0644, nil, jsonStep(1, fs.User, "script"), false},
+		{
+			"Path",
+			0644,
+			[]string{"-interpreter=/usr/bin/python3"},
+			`{"version":2,"id":1,"type":"script","buildContext":"user","script":"script","interpreter":"/usr/bin/python3"}` + "\n",
+			false,
+		},
+		{
+			"Exec",
+			0755,
+			[]string{"-interpreter=exec"},
+			`{"version":2,"id":1,"type":"script","buildContext":"user","script":"script","interpreter":"exec"}` + "\n",
+			false,
+		},
+		{"ExecNotExecutable", 0644, []string{"-interpreter=exec"}, "", true},
+		{"RelativePath", 0644, []string{"-interpreter=python3"}, "", true},
+		{"Whitespace", 0644, []string{"-interpreter=/usr/bin/env python3"}, "", true},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupRunScriptFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			if err := createUserCtxArchiveWithMode(files, "script", input.mode); err != nil {
+				t.Fatal(err)
+			}
+			flags := append(input.flags, "-script=script")
+			_, err = executeRunScript(files, flags...)
+			if gotErr := err != nil; gotErr != input.wantErr {
+				t.Fatalf("run-script(%v): got error %v, want error: %t", flags, err, input.wantErr)
+			}
+			got, err := ioutil.ReadFile(files.StateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != input.wantState {
+				t.Errorf("run-script(%v): state file: got %q, want %q", flags, string(got), input.wantState)
+			}
+		})
+	}
+}
+
+func TestRunScriptEnvFile(t *testing.T) {
+	tmpDir, files, err := setupRunScriptFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := createNonEmptyUserCtxArchive(files, "script"); err != nil {
+		t.Fatal(err)
+	}
+	envFile := filepath.Join(tmpDir, "env")
+	if err := ioutil.WriteFile(envFile, []byte("# comment\n\nA=1,2\nexport B=x=y\nTOKEN=hunter2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	flags := []string{"-script=script", "-env-file=" + envFile, "-env=A=override", "-secret=TOKEN"}
+	if _, err := executeRunScript(files, flags...); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Env == "" {
+		t.Fatalf("run-script(%v): state file: got %v, want a single step with an env file", flags, entries)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(files.PersistBuiltinBuildContext, entries[0].Env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "export A='override'\nexport B='x=y'\n# secret\nexport TOKEN='hunter2'\n"
+	if string(got) != want {
+		t.Errorf("run-script(%v): env file: got %q, want %q", flags, string(got), want)
+	}
+}
+
+func TestRunScriptBadEnv(t *testing.T) {
+	var testData = []struct {
+		testName string
+		envFile  string
+		flags    []string
+	}{
+		{"UnknownSecret", "", []string{"-env=A=1", "-secret=B"}},
+		{"InvalidName", "", []string{"-env=1A=1"}},
+		{"MissingEnvFile", "", []string{"-env-file=/does/not/exist"}},
+		{"MalformedEnvFile", "A\n", nil},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupRunScriptFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			if err := createNonEmptyUserCtxArchive(files, "script"); err != nil {
+				t.Fatal(err)
+			}
+			flags := append(input.flags, "-script=script")
+			if input.envFile != "" {
+				envFile := filepath.Join(tmpDir, "env")
+				if err := ioutil.WriteFile(envFile, []byte(input.envFile), 0644); err != nil {
+					t.Fatal(err)
+				}
+				flags = append(flags, "-env-file="+envFile)
+			}
+			if got, _ := executeRunScript(files, flags...); got == subcommands.ExitSuccess {
+				t.Errorf("run-script(%v); got subcommands.ExitSuccess, want failure", flags)
+			}
+		})
+	}
+}
+
+func TestRedactEnv(t *testing.T) {
+	var testData = []struct {
+		testName string
+		contents string
+		want     string
+	}{
+		{"NoSecrets", "export A='1'\n", "export A='1'\n"},
+		{"OnlySecrets", "# secret\nexport A='1'\n", "export A=<redacted>\n"},
+		{
+			"MultiLineSecret",
+			"export A='1'\n# secret\nexport B='line1\nline2'\nexport C='3'\n",
+			"export A='1'\nexport B=<redacted>\nexport C=<redacted>\n",
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			if got := redactEnv(input.contents); got != input.want {
+				t.Errorf("redactEnv(%q) = %q, want %q", input.contents, got, input.want)
+			}
+		})
+	}
+}
@@ -21,11 +21,14 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"os"
 
 	"github.com/google/subcommands"
 )
 
+const (
+	sealOEMScript = "seal_oem.sh"
+)
+
 // SealOEM implements subcommands.Command for the "seal-oem" command.
 // It builds a hash tree of the OEM partition and modifies the kernel
 // command line to verify the OEM partition at boot time.
@@ -58,22 +61,14 @@ func (s *SealOEM) Execute(_ context.Context, f *flag.FlagSet, args ...interface{
 		return subcommands.ExitUsageError
 	}
 	files := args[0].(*fs.Files)
-	configPath := files.BuildConfig
-	buildConfig := &config.Build{}
-	configFile, err := os.OpenFile(configPath, os.O_RDWR, 0666)
-	if err != nil {
-		return subcommands.ExitUsageError
-	}
-	defer configFile.Close()
-	if err := config.Load(configFile, buildConfig); err != nil {
-		return subcommands.ExitUsageError
-	}
-	buildConfig.SealOEM = true
-	if err := config.SaveBuildConfigToFile(configFile, buildConfig); err != nil {
+	if err := updateBuildConfigFile(files.BuildConfig, func(buildConfig *config.Build) error {
+		buildConfig.SealOEM = true
+		return nil
+	}); err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	if err := fs.AppendStateFile(files.StateFile, fs.Builtin, "seal_oem.sh", ""); err != nil {
+	if err := fs.AppendStateFile(files.StateFile, fs.Builtin, sealOEMScript, ""); err != nil {
 		log.Println(fmt.Errorf("cannot append state file, error msg:(%v)", err))
 		return subcommands.ExitFailure
 	}
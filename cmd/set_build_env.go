@@ -0,0 +1,98 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"cos-customizer/fs"
+
+	"github.com/google/subcommands"
+)
+
+// SetBuildEnv implements subcommands.Command for the "set-build-env" command.
+// This command configures environment variables that are set for every script run by the image
+// build.
+type SetBuildEnv struct {
+	env     *mapVar
+	envFile string
+	secrets *listVar
+}
+
+// Name implements subcommands.Command.Name.
+func (*SetBuildEnv) Name() string {
+	return "set-build-env"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*SetBuildEnv) Synopsis() string {
+	return "Set env vars for every script in the image build."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*SetBuildEnv) Usage() string {
+	return `set-build-env [flags]
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (s *SetBuildEnv) SetFlags(f *flag.FlagSet) {
+	if s.env == nil {
+		s.env = newMapVar()
+	}
+	f.Var(s.env, "env", "Env vars to set before running every script.")
+	f.StringVar(&s.envFile, "env-file", "", "Path to a file of env vars to set before running every script, "+
+		"with one KEY=VALUE pair per line. Values set with -env take precedence.")
+	if s.secrets == nil {
+		s.secrets = &listVar{}
+	}
+	f.Var(s.secrets, "secret", "Names of env vars whose values are secret. Secret values are redacted from "+
+		"the build logs.")
+}
+
+// Execute implements subcommands.Command.Execute. It replaces the build environment with the given
+// env vars. If no env vars are given, the build environment is cleared.
+func (s *SetBuildEnv) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	env, secrets, err := mergeEnv(s.envFile, s.env.m, s.secrets.l)
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	buildEnvFile := filepath.Join(files.PersistBuiltinBuildContext, fs.BuildEnvFile)
+	if len(env) == 0 {
+		if err := os.Remove(buildEnvFile); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+	if err := fs.WriteFileAtomic(buildEnvFile, 0600, func(w io.Writer) error {
+		return writeEnv(w, env, secrets)
+	}); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
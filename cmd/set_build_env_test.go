@@ -0,0 +1,101 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cos-customizer/fs"
+
+	"github.com/google/subcommands"
+)
+
+func executeSetBuildEnv(files *fs.Files, flags ...string) subcommands.ExitStatus {
+	f := &flag.FlagSet{}
+	setBuildEnv := &SetBuildEnv{}
+	setBuildEnv.SetFlags(f)
+	if err := f.Parse(flags); err != nil {
+		return subcommands.ExitUsageError
+	}
+	return setBuildEnv.Execute(nil, f, files)
+}
+
+func TestSetBuildEnv(t *testing.T) {
+	tmpDir, files, err := setupRunScriptFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	buildEnvFile := filepath.Join(files.PersistBuiltinBuildContext, fs.BuildEnvFile)
+	flags := []string{"-env=RELEASE=1,TOKEN=it's", "-secret=TOKEN"}
+	if ret := executeSetBuildEnv(files, flags...); ret != subcommands.ExitSuccess {
+		t.Fatalf("set-build-env(%v): got %v, want subcommands.ExitSuccess", flags, ret)
+	}
+	got, err := ioutil.ReadFile(buildEnvFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "export RELEASE='1'\n# secret\nexport TOKEN='it'\"'\"'s'\n"
+	if string(got) != want {
+		t.Errorf("set-build-env(%v): build env: got %q, want %q", flags, string(got), want)
+	}
+	flags = []string{"-env=RELEASE=2"}
+	if ret := executeSetBuildEnv(files, flags...); ret != subcommands.ExitSuccess {
+		t.Fatalf("set-build-env(%v): got %v, want subcommands.ExitSuccess", flags, ret)
+	}
+	got, err = ioutil.ReadFile(buildEnvFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "export RELEASE='2'\n"; string(got) != want {
+		t.Errorf("set-build-env(%v): build env: got %q, want %q", flags, string(got), want)
+	}
+	if ret := executeSetBuildEnv(files); ret != subcommands.ExitSuccess {
+		t.Fatalf("set-build-env(): got %v, want subcommands.ExitSuccess", ret)
+	}
+	if _, err := os.Stat(buildEnvFile); !os.IsNotExist(err) {
+		t.Errorf("set-build-env(): got build env file stat error %v, want not exist", err)
+	}
+}
+
+func TestSetBuildEnvInvalid(t *testing.T) {
+	var testData = []struct {
+		testName string
+		flags    []string
+	}{
+		{"UnknownSecret", []string{"-env=A=1", "-secret=B"}},
+		{"InvalidName", []string{"-env=A-B=1"}},
+		{"MissingEnvFile", []string{"-env-file=/does/not/exist"}},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupRunScriptFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			if ret := executeSetBuildEnv(files, input.flags...); ret == subcommands.ExitSuccess {
+				t.Errorf("set-build-env(%v): got subcommands.ExitSuccess, want failure", input.flags)
+			}
+			if _, err := os.Stat(filepath.Join(files.PersistBuiltinBuildContext, fs.BuildEnvFile)); !os.IsNotExist(err) {
+				t.Errorf("set-build-env(%v): got build env file stat error %v, want not exist", input.flags, err)
+			}
+		})
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -39,6 +40,7 @@ type ServiceClients func(ctx context.Context, anonymousCreds bool) (*compute.Ser
 // This command initializes a new image customization process.
 type StartImageBuild struct {
 	buildContext string
+	ignoreFile   string
 	gcsBucket    string
 	gcsWorkdir   string
 	imageProject string
@@ -65,7 +67,11 @@ func (*StartImageBuild) Usage() string {
 
 // SetFlags implements subcommands.Command.SetFlags.
 func (s *StartImageBuild) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&s.buildContext, "build-context", ".", "Path to the build context")
+	f.StringVar(&s.buildContext, "build-context", ".", "Path to the build context. Can be a directory, a .tar, "+
+		".tar.gz, .tgz or .zip file whose contents are the build context, or a single file.")
+	f.StringVar(&s.ignoreFile, "ignore-file", "", "Path to a file that lists build context entries to leave out "+
+		"of the build context, in .gitignore syntax. Defaults to the "+fs.IgnoreFileName+" file at the root of "+
+		"the build context, if there is one.")
 	f.StringVar(&s.gcsBucket, "gcs-bucket", "", "GCS bucket to use for scratch space")
 	f.StringVar(&s.gcsWorkdir, "gcs-workdir", "", "GCS directory to use for scratch space")
 	f.StringVar(&s.imageProject, "image-project", "", "Source image project")
@@ -137,12 +143,9 @@ func saveImage(imageName, imageProject, dst string) error {
 	if err := os.MkdirAll(filepath.Dir(dst), 0774); err != nil {
 		return err
 	}
-	outFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer outFile.Close()
-	return config.Save(outFile, image)
+	return fs.WriteFileAtomic(dst, 0644, func(w io.Writer) error {
+		return config.Save(w, image)
+	})
 }
 
 func saveBuildConfig(gcsBucket, gcsWorkdir, dst string) error {
@@ -150,12 +153,24 @@ func saveBuildConfig(gcsBucket, gcsWorkdir, dst string) error {
 	if err := os.MkdirAll(filepath.Dir(dst), 0774); err != nil {
 		return err
 	}
-	outFile, err := os.Create(dst)
-	if err != nil {
+	return fs.WriteFileAtomic(dst, 0644, func(w io.Writer) error {
+		return config.Save(w, buildConfig)
+	})
+}
+
+// updateBuildConfigFile applies the given update to the build config stored in the given file. The
+// file is replaced atomically, so that it is never left partially written.
+func updateBuildConfigFile(configPath string, update func(*config.Build) error) error {
+	buildConfig := &config.Build{}
+	if err := config.LoadFromFile(configPath, buildConfig); err != nil {
+		return err
+	}
+	if err := update(buildConfig); err != nil {
 		return err
 	}
-	defer outFile.Close()
-	return config.SaveBuildConfigToFile(outFile, buildConfig)
+	return fs.WriteFileAtomic(configPath, 0644, func(w io.Writer) error {
+		return config.Save(w, buildConfig)
+	})
 }
 
 // Execute implements subcommands.Command.Execute. It initializes persistent state for a new
@@ -166,6 +181,16 @@ func (s *StartImageBuild) Execute(ctx context.Context, f *flag.FlagSet, args ...
 		return subcommands.ExitUsageError
 	}
 	files := args[0].(*fs.Files)
+	exists, err := files.BuildExists()
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	if exists {
+		log.Printf("image build %q has already been started; finish it with finish-image-build, discard it "+
+			"with abort-build, or start another image build with a different -build-id\n", files.BuildID)
+		return subcommands.ExitFailure
+	}
 	svc, _, err := args[1].(ServiceClients)(ctx, false)
 	if err != nil {
 		log.Println(err)
@@ -179,7 +204,7 @@ func (s *StartImageBuild) Execute(ctx context.Context, f *flag.FlagSet, args ...
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
-	if err := fs.CreateBuildContextArchive(s.buildContext, files.UserBuildContextArchive); err != nil {
+	if err := fs.CreateBuildContextArchiveWithIgnoreFile(s.buildContext, files.UserBuildContextArchive, s.ignoreFile); err != nil {
 		log.Println(err)
 		return subcommands.ExitFailure
 	}
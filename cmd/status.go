@@ -0,0 +1,247 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cos-customizer/config"
+	"cos-customizer/fs"
+
+	"github.com/google/subcommands"
+)
+
+// stepStatus describes a single step queued in the state file.
+type stepStatus struct {
+	ID           int
+	BuildContext fs.BuildContext
+	Script       string
+	Args         []string `json:",omitempty"`
+	EnvFile      string   `json:",omitempty"`
+	Env          string   `json:",omitempty"`
+	Timeout      string   `json:",omitempty"`
+	Retries      int      `json:",omitempty"`
+	AllowFailure bool     `json:",omitempty"`
+	Interpreter  string   `json:",omitempty"`
+}
+
+// buildStatus describes the pending image build.
+type buildStatus struct {
+	SourceImage     string
+	GCSScratch      string
+	GPUType         string `json:",omitempty"`
+	SealOEM         bool
+	OEMSize         string                  `json:",omitempty"`
+	GCSFiles        []string                `json:",omitempty"`
+	ContainerImages []config.ContainerImage `json:",omitempty"`
+	BuildEnv        string                  `json:",omitempty"`
+	Steps           []stepStatus
+}
+
+// Status implements subcommands.Command for the "status" command.
+// This command prints the image build that is queued in the local state.
+type Status struct {
+	format string
+}
+
+// Name implements subcommands.Command.Name.
+func (*Status) Name() string {
+	return "status"
+}
+
+// Synopsis implements subcommands.Command.Synopsis.
+func (*Status) Synopsis() string {
+	return "Show the pending image build."
+}
+
+// Usage implements subcommands.Command.Usage.
+func (*Status) Usage() string {
+	return `status [flags]
+`
+}
+
+// SetFlags implements subcommands.Command.SetFlags.
+func (s *Status) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&s.format, "format", "text", "Output format. Must be one of: text, json")
+}
+
+// loadBuildStatus gathers the pending image build from the local state.
+func loadBuildStatus(files *fs.Files) (*buildStatus, error) {
+	sourceImage := &config.Image{}
+	if err := config.LoadFromFile(files.SourceImageConfig, sourceImage); err != nil {
+		return nil, err
+	}
+	buildConfig := &config.Build{}
+	if err := config.LoadFromFile(files.BuildConfig, buildConfig); err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	status := &buildStatus{
+		SourceImage:     sourceImage.URL(),
+		GCSScratch:      fmt.Sprintf("gs://%s/%s", buildConfig.GCSBucket, buildConfig.GCSDir),
+		GPUType:         buildConfig.GPUType,
+		SealOEM:         buildConfig.SealOEM,
+		OEMSize:         buildConfig.OEMSize,
+		GCSFiles:        buildConfig.GCSFiles,
+		ContainerImages: buildConfig.ContainerImages,
+		Steps:           []stepStatus{},
+	}
+	buildEnv, err := ioutil.ReadFile(filepath.Join(files.PersistBuiltinBuildContext, fs.BuildEnvFile))
+	switch {
+	case err == nil:
+		status.BuildEnv = redactEnv(string(buildEnv))
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	for _, entry := range entries {
+		step := stepStatus{
+			ID:           entry.ID,
+			BuildContext: entry.BuildContext,
+			Script:       entry.Script,
+			Args:         entry.Args,
+			EnvFile:      entry.Env,
+			Retries:      entry.Retries,
+			AllowFailure: entry.AllowFailure,
+			Interpreter:  entry.Interpreter,
+		}
+		if entry.Timeout != 0 {
+			step.Timeout = entry.Timeout.String()
+		}
+		if entry.Env != "" {
+			env, err := ioutil.ReadFile(filepath.Join(files.PersistBuiltinBuildContext, entry.Env))
+			if err != nil {
+				return nil, err
+			}
+			step.Env = redactEnv(string(env))
+		}
+		status.Steps = append(status.Steps, step)
+	}
+	return status, nil
+}
+
+// writeText writes the build status in a human readable format.
+func (b *buildStatus) writeText(w io.Writer) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Source image: %s\n", b.SourceImage)
+	fmt.Fprintf(&sb, "GCS scratch space: %s\n", b.GCSScratch)
+	if b.GPUType != "" {
+		fmt.Fprintf(&sb, "GPU type: %s\n", b.GPUType)
+	}
+	fmt.Fprintf(&sb, "Seal OEM: %t\n", b.SealOEM)
+	if b.OEMSize != "" {
+		fmt.Fprintf(&sb, "OEM size: %s\n", b.OEMSize)
+	}
+	for _, f := range b.GCSFiles {
+		fmt.Fprintf(&sb, "GCS file: %s\n", f)
+	}
+	for _, image := range b.ContainerImages {
+		source := image.Ref
+		if image.Tarball != "" {
+			source = fmt.Sprintf("%s (from %s)", image.Ref, image.Tarball)
+		}
+		if image.Digest != "" {
+			source += " " + image.Digest
+		}
+		fmt.Fprintf(&sb, "Container image: %s\n", strings.TrimSpace(source))
+	}
+	if b.BuildEnv != "" {
+		fmt.Fprintf(&sb, "Build environment:\n")
+		for _, line := range strings.Split(strings.TrimRight(b.BuildEnv, "\n"), "\n") {
+			fmt.Fprintf(&sb, "  %s\n", line)
+		}
+	}
+	fmt.Fprintf(&sb, "Steps (%d):\n", len(b.Steps))
+	for i, step := range b.Steps {
+		fmt.Fprintf(&sb, "  %d. [%s] %s\n", i+1, step.BuildContext, step.Script)
+		if len(step.Args) != 0 {
+			fmt.Fprintf(&sb, "     Args: %q\n", step.Args)
+		}
+		if step.Timeout != "" {
+			fmt.Fprintf(&sb, "     Timeout: %s\n", step.Timeout)
+		}
+		if step.Retries != 0 {
+			fmt.Fprintf(&sb, "     Retries: %d\n", step.Retries)
+		}
+		if step.AllowFailure {
+			fmt.Fprintf(&sb, "     Allow failure: true\n")
+		}
+		if step.Interpreter != "" {
+			fmt.Fprintf(&sb, "     Interpreter: %s\n", step.Interpreter)
+		}
+		if step.EnvFile == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "     Environment (%s):\n", step.EnvFile)
+		for _, line := range strings.Split(strings.TrimRight(step.Env, "\n"), "\n") {
+			fmt.Fprintf(&sb, "       %s\n", line)
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// writeJSON writes the build status as a JSON document.
+func (b *buildStatus) writeJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// Execute implements subcommands.Command.Execute. It prints the image build that is
+// queued in the local state.
+func (s *Status) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	if s.format != "text" && s.format != "json" {
+		log.Printf("invalid format %q; must be one of: text, json\n", s.format)
+		return subcommands.ExitUsageError
+	}
+	files := args[0].(*fs.Files)
+	status, err := loadBuildStatus(files)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Println("no pending image build found; has start-image-build been run?")
+			return subcommands.ExitFailure
+		}
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	write := status.writeText
+	if s.format == "json" {
+		write = status.writeJSON
+	}
+	if err := write(os.Stdout); err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cos-customizer/config"
+	"cos-customizer/fs"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func setupStatusFiles() (string, *fs.Files, error) {
+	tmpDir, files, err := setupRunScriptFiles()
+	if err != nil {
+		return "", nil, err
+	}
+	files.SourceImageConfig = filepath.Join(tmpDir, "source_image")
+	files.BuildConfig = filepath.Join(tmpDir, "build")
+	if err := saveImage("im", "p", files.SourceImageConfig); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	buildConfig := &config.Build{GCSBucket: "b", GCSDir: "d", GPUType: "nvidia-tesla-k80", SealOEM: true}
+	buildConfigFile, err := os.Create(files.BuildConfig)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	defer buildConfigFile.Close()
+	if err := config.SaveBuildConfigToFile(buildConfigFile, buildConfig); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(files.PersistBuiltinBuildContext, "user_env_1"),
+		[]byte("export HELLO='world'\n"), 0644); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(files.PersistBuiltinBuildContext, fs.BuildEnvFile),
+		[]byte("export RELEASE='1'\n# secret\nexport TOKEN='hunter2'\n"), 0644); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	stateFile := `{"version":2,"id":1,"type":"script","buildContext":"user","script":"script","env":"user_env_1",` +
+		`"timeoutSec":60,"retries":2,"allowFailure":true,"interpreter":"/usr/bin/python3"}` + "\n" +
+		"builtin\tinstall_gpu.sh\t\n"
+	if err := ioutil.WriteFile(files.StateFile, []byte(stateFile), 0644); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", nil, err
+	}
+	return tmpDir, files, nil
+}
+
+func TestLoadBuildStatus(t *testing.T) {
+	tmpDir, files, err := setupStatusFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	got, err := loadBuildStatus(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &buildStatus{
+		SourceImage: "projects/p/global/images/im",
+		GCSScratch:  "gs://b/d",
+		GPUType:     "nvidia-tesla-k80",
+		SealOEM:     true,
+		BuildEnv:    "export RELEASE='1'\nexport TOKEN=<redacted>\n",
+		Steps: []stepStatus{
+			{
+				ID:           1,
+				BuildContext: fs.User,
+				Script:       "script",
+				EnvFile:      "user_env_1",
+				Env:          "export HELLO='world'\n",
+				Timeout:      "1m0s",
+				Retries:      2,
+				AllowFailure: true,
+				Interpreter:  "/usr/bin/python3",
+			},
+			{ID: 2, BuildContext: fs.Builtin, Script: "install_gpu.sh"},
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("loadBuildStatus(_): mismatch: diff (-got +want)\n%s", diff)
+	}
+}
+
+func TestBuildStatusWriteText(t *testing.T) {
+	tmpDir, files, err := setupStatusFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	status, err := loadBuildStatus(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(strings.Builder)
+	if err := status.writeText(got); err != nil {
+		t.Fatal(err)
+	}
+	want := `Source image: projects/p/global/images/im
+GCS scratch space: gs://b/d
+GPU type: nvidia-tesla-k80
+Seal OEM: true
+Build environment:
+  export RELEASE='1'
+  export TOKEN=<redacted>
+Steps (2):
+  1. [user] script
+     Timeout: 1m0s
+     Retries: 2
+     Allow failure: true
+     Interpreter: /usr/bin/python3
+     Environment (user_env_1):
+       export HELLO='world'
+  2. [builtin] install_gpu.sh
+`
+	if got.String() != want {
+		t.Errorf("buildStatus.writeText(_) = %q, want %q", got.String(), want)
+	}
+}
+
+func TestBuildStatusWriteJSON(t *testing.T) {
+	tmpDir, files, err := setupStatusFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	status, err := loadBuildStatus(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := new(strings.Builder)
+	if err := status.writeJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	got := &buildStatus{}
+	if err := json.Unmarshal([]byte(data.String()), got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, status); diff != "" {
+		t.Errorf("buildStatus.writeJSON(_): round trip mismatch: diff (-got +want)\n%s", diff)
+	}
+}
@@ -72,6 +72,52 @@ type Build struct {
 	GPUType     string
 	Timeout     string
 	GCSFiles    []string
+	// GPUDriverVersion is the version of the GPU driver that is installed, if any.
+	GPUDriverVersion string
+	// KeepStaging indicates that the files staged in GCS are kept after a successful image build,
+	// so that later image builds in the same GCS directory only upload the files that changed.
+	KeepStaging bool
+	// KeepStagingOnFailure indicates that the files staged in GCS are kept after a failed image
+	// build, for debugging.
+	KeepStagingOnFailure bool
+	// KeepOnFailure indicates that the preload VM and its boot disk are kept after a failed image
+	// build, for debugging.
+	KeepOnFailure bool
+	// ProgressFormat is the format in which the progress of the image build is reported: "text" or
+	// "json". Empty means "text".
+	ProgressFormat string
+	// MachineType is the machine type of the preload VM. Empty means the Daisy default.
+	MachineType string
+	// Network and Subnet are the network and subnetwork of the preload VM. Empty means the default
+	// network.
+	Network string
+	Subnet  string
+	// NoExternalIP indicates that the preload VM has no external IP address.
+	NoExternalIP bool
+	// ServiceAccount is the email of the service account of the preload VM. Empty means the default
+	// service account.
+	ServiceAccount string
+	// Scopes are the OAuth scopes of the service account of the preload VM. Empty means the default
+	// scopes.
+	Scopes []string
+	// ContainerImages lists the container images preloaded into the result image.
+	ContainerImages []ContainerImage
+}
+
+// ContainerImage describes a container image preloaded into the result image.
+type ContainerImage struct {
+	// Ref is the reference the image was pulled from, or the repository tag of an image
+	// loaded from a tarball. It is empty for untagged images loaded from a tarball.
+	Ref string
+	// Tarball is the path in the build context of the tarball the image was loaded from.
+	// It is empty for images pulled from a registry.
+	Tarball string
+	// Digest is the digest a pulled image is pinned to, or the image ID of a loaded image. It is
+	// empty for images pulled by tag until the image build ran; the build report has the digests
+	// that the preload VM pulled.
+	Digest string
+	// Step is the ID of the state file step that preloads the image.
+	Step int
 }
 
 // SaveBuildConfigToFile clears the build config file and then saves the new config.Build.
@@ -0,0 +1,35 @@
+#!/bin/bash
+#
+# Copyright 2020 Google LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+set -o errexit
+set -o nounset
+
+# Copies a file from the user build context onto the image. The copy is
+# configured by cos-customizer through an environment file that sets
+# COPY_FILE_SRC, COPY_FILE_DST, COPY_FILE_MODE and COPY_FILE_OWNER.
+# This script runs from the builtin build context directory, which is a
+# sibling of the user build context directory.
+main() {
+  local -r src="../user_ctx_dir/${COPY_FILE_SRC}"
+  echo "Copying ${COPY_FILE_SRC} to ${COPY_FILE_DST}..."
+  mkdir -p "$(dirname "${COPY_FILE_DST}")"
+  cp "${src}" "${COPY_FILE_DST}"
+  chown "${COPY_FILE_OWNER}" "${COPY_FILE_DST}"
+  chmod "${COPY_FILE_MODE}" "${COPY_FILE_DST}"
+  echo "Copied ${COPY_FILE_SRC} to ${COPY_FILE_DST} with mode ${COPY_FILE_MODE} and owner ${COPY_FILE_OWNER}"
+}
+
+main
@@ -0,0 +1,78 @@
+#!/bin/bash
+#
+# Copyright 2020 Google LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+set -o errexit
+set -o pipefail
+set -o nounset
+
+# Preloads container images into the Docker storage of the image. The images
+# are configured by cos-customizer through an environment file that sets:
+#   PRELOAD_PULL_IMAGES: Lines of image references to pull. The digests of the
+#     pulled images are logged and reported to cos-customizer.
+#   PRELOAD_LOAD_TARBALLS: Lines of paths in the user build context of tarballs
+#     to load with 'docker load'.
+#   PRELOAD_LOADED_IMAGE_IDS: Lines of image IDs the tarballs are expected to
+#     contain.
+# This script runs from the builtin build context directory, which is a
+# sibling of the user build context directory.
+
+pull_image() {
+  local -r image="$1"
+  local i=1
+  while ! docker pull "${image}"; do
+    if [[ "${i}" -ge 5 ]]; then
+      echo "Pulling ${image} failed."
+      return 1
+    fi
+    i=$((i+1))
+    echo "Retrying pull of ${image}... [${i}/5]"
+    sleep 5
+  done
+  local digests
+  digests="$(docker inspect --format '{{json .RepoDigests}}' "${image}")"
+  echo "Pulled ${image} with digests ${digests}"
+  # Reports the digests to cos-customizer, which records them in the build
+  # report. The marker must match progressMarker in preloader/progress.go.
+  echo "__cos_customizer_progress__ image ${image} ${digests}"
+}
+
+main() {
+  local image
+  local tarball
+  local id
+  while read -r image; do
+    if [[ -n "${image}" ]]; then
+      echo "Pulling ${image}..."
+      pull_image "${image}"
+    fi
+  done <<< "${PRELOAD_PULL_IMAGES}"
+  while IFS= read -r tarball; do
+    if [[ -n "${tarball}" ]]; then
+      echo "Loading ${tarball}..."
+      docker load -i "../user_ctx_dir/${tarball}"
+    fi
+  done <<< "${PRELOAD_LOAD_TARBALLS}"
+  while read -r id; do
+    if [[ -n "${id}" ]] && ! docker image inspect "${id}" > /dev/null; then
+      echo "Image ${id} was not loaded from the given tarballs."
+      return 1
+    fi
+  done <<< "${PRELOAD_LOADED_IMAGE_IDS}"
+  echo "Preloaded container images:"
+  docker images --digests
+}
+
+main
@@ -22,8 +22,11 @@ set -o pipefail
 set -o nounset
 
 
-PYTHON_IMG="python:2.7.15-alpine"
+PYTHON_IMG="python:3.8.5-alpine"
 OEM_CHECK_FILE="/mnt/stateful_partition/oem"
+# Marks the lines that report the progress of state file steps to
+# cos-customizer. It must match progressMarker in preloader/progress.go.
+PROGRESS_MARKER="__cos_customizer_progress__"
 
 fatal() {
   echo -e "BuildFailed: ${*}"
@@ -40,6 +43,9 @@ enter_workdir() {
 exit_workdir() {
   echo "Exiting and cleaning up working directory..."
   cd /root
+  if mountpoint -q /var/lib/.cos-customizer/user_ctx_dir; then
+    umount /var/lib/.cos-customizer/user_ctx_dir
+  fi
   rm -rf /var/lib/.cos-customizer
   echo "Finished exiting working directory"
 }
@@ -77,7 +83,7 @@ download_gcs_object() {
   local -r bucket="$(echo "${url#gs://}" | cut -d/ -f 1)"
   local -r object="$(echo "${url#gs://}" | cut -d/ -f 2-)"
   local -r encoded_object="$(docker run --rm "${PYTHON_IMG}" \
-    python -c "import urllib; print(urllib.quote('''${object}''', safe=''))")"
+    python -c "import urllib.parse; print(urllib.parse.quote('''${object}''', safe=''))")"
   local -r creds="$(/usr/share/google/get_metadata_value \
     service-accounts/default/token)"
   local -r access_token="$(echo "${creds}" | docker run --rm -i "${PYTHON_IMG}" \
@@ -115,7 +121,9 @@ fetch_user_ctx() {
     attributes/UserBuildContext)"
   local -r user_ctx="$(download_gcs_object "${user_ctx_gcs}" | tail -n 1)"
   mkdir user_ctx_dir
-  if [[ -s "${user_ctx}" ]]; then
+  if [[ "${user_ctx}" == *.gz ]]; then
+    tar xzvf "${user_ctx}" -C user_ctx_dir
+  elif [[ -s "${user_ctx}" ]]; then
     tar xvf "${user_ctx}" -C user_ctx_dir
   fi
   echo "Done fetching user build context"
@@ -234,31 +242,182 @@ fetch_state_file() {
   local -r state_file_gcs="$(/usr/share/google/get_metadata_value \
     attributes/StateFile)"
   local -r state_file="$(download_gcs_object "${state_file_gcs}" | tail -n 1)"
-  if [[ "${state_file}" != "state_file" ]]; then
-    mv "${state_file}" state_file
+  if [[ "${state_file}" != "state_file.json" ]]; then
+    mv "${state_file}" state_file.json
   fi
+  convert_state_file state_file.json state_file.tmp
+  mv state_file.tmp state_file
+  rm state_file.json
   echo "Done fetching state file"
 }
 
-# Executes a state file instruction. State file instructions have the following
-# format:
-# <build_context>\t<script>\t<env>\n
+# Converts the state file from the format written by cos-customizer to a format
+# that can be consumed by execute_instr. cos-customizer writes one JSON object
+# per step (version 2), or one line of tab-separated fields per step (legacy).
+# Each step is converted into a line of shell variable assignments whose values
+# are quoted with $'...', so that the line can be evaluated by execute_instr.
+convert_state_file() {
+  local -r input="$1"
+  local -r output="$2"
+  echo "Converting state file..."
+  pull_python
+  docker run --rm -i "${PYTHON_IMG}" python -c '
+import json
+import sys
+
+def quote(value):
+  quoted = []
+  for byte in str(value).encode("utf-8"):
+    if byte in b"\x27\\":
+      quoted.append("\\" + chr(byte))
+    elif 0x20 <= byte < 0x7f:
+      quoted.append(chr(byte))
+    else:
+      quoted.append("\\x%02x" % byte)
+  return "$\x27" + "".join(quoted) + "\x27"
+
+def seconds(value):
+  value = float(value or 0)
+  if value == 0:
+    return ""
+  if value == int(value):
+    return str(int(value))
+  return repr(value)
+
+steps = []
+for line in sys.stdin:
+  line = line.rstrip("\n")
+  if not line:
+    continue
+  if line.startswith("{"):
+    step = json.loads(line)
+    if step.get("version") != 2 or step.get("type") != "script":
+      sys.exit("unsupported state file entry: " + line)
+  else:
+    fields = line.split("\t")
+    if len(fields) != 3:
+      sys.exit("unsupported state file entry: " + line)
+    step = {"id": 0, "buildContext": fields[0], "script": fields[1],
+            "env": fields[2]}
+  steps.append(step)
+
+# Legacy entries do not have IDs; assign them IDs that are not used by any
+# other entry, like cos-customizer does.
+next_id = max([step["id"] for step in steps] + [0]) + 1
+for step in steps:
+  if step["id"] == 0:
+    step["id"] = next_id
+    next_id += 1
+
+for step in steps:
+  print(" ".join([
+      "id=%d" % step["id"],
+      "ctx=" + quote(step["buildContext"]),
+      "script=" + quote(step["script"]),
+      "env=" + quote(step.get("env", "")),
+      "timeout_sec=" + quote(seconds(step.get("timeoutSec"))),
+      "retries=%d" % step.get("retries", 0),
+      "allow_failure=" + ("true" if step.get("allowFailure") else "false"),
+      "interpreter=" + quote(step.get("interpreter", "")),
+      "args=(" + " ".join(quote(arg) for arg in step.get("args", [])) + ")",
+  ]))
+' < "${input}" > "${output}"
+  echo "Done converting state file"
+}
+
+# /var is mounted noexec, so scripts in the user build context can only be
+# executed directly after remounting the build context with exec. The mount does
+# not survive reboots, so this needs to be checked before every such script.
+enable_exec_user_ctx() {
+  local -r user_ctx_dir="/var/lib/.cos-customizer/user_ctx_dir"
+  if mountpoint -q "${user_ctx_dir}"; then
+    return
+  fi
+  echo "Remounting user build context with exec..."
+  mount --bind "${user_ctx_dir}" "${user_ctx_dir}"
+  mount -o remount,exec "${user_ctx_dir}"
+  echo "Done remounting user build context with exec"
+}
+
+# Prints the given environment file. The values of the variables that follow the
+# "# secret" line are redacted.
+print_env() {
+  local -r env="$1"
+  sed -e '/^# secret$/,$ d' "${env}"
+  sed -n -e '/^# secret$/,$ s/^export \([A-Za-z_][A-Za-z0-9_]*\)=.*/export \1=<redacted>/p' "${env}"
+}
+
+# Runs a script once with the given arguments, sourcing the given build
+# environment file and environment file first if they are non-empty, and
+# bounding its run time if the given timeout is non-empty. The script is run
+# with the given interpreter, executed directly if the interpreter is "exec", or
+# run with /bin/bash if the interpreter is empty.
+# Returns the exit code of the script; 124 indicates that it timed out.
+run_script() {
+  local -r script="$1"
+  local -r env="$2"
+  local -r timeout_sec="$3"
+  local -r interpreter="$4"
+  local -r build_env="$5"
+  shift 5
+  local -a cmd
+  case "${interpreter}" in
+  "")
+    cmd=(/bin/bash "$(realpath "${script}")")
+    ;;
+  "exec")
+    cmd=("$(realpath "${script}")")
+    ;;
+  *)
+    cmd=("${interpreter}" "$(realpath "${script}")")
+    ;;
+  esac
+  cmd+=("$@")
+  if [[ -n "${timeout_sec}" ]]; then
+    cmd=(timeout --kill-after=30 "${timeout_sec}" "${cmd[@]}")
+  fi
+  (
+    if [[ -n "${build_env}" ]]; then
+      . "$(realpath "${build_env}")" || exit
+    fi
+    if [[ -n "${env}" ]]; then
+      . "$(realpath "${env}")" || exit
+    fi
+    "${cmd[@]}"
+  )
+}
+
+# Executes a state file instruction. State file instructions are lines of shell
+# variable assignments written by convert_state_file, which set the variables
+# declared below.
 execute_instr() {
   local line="$1"
+  local id
   local ctx
   local script
   local env
+  local timeout_sec
+  local retries
+  local allow_failure
+  local interpreter
+  local -a args
+  local build_env=""
   echo "Executing instruction ${line}..."
-  ctx="$(echo -e "${line}" | cut -f 1)"
-  script="$(echo -e "${line}" | cut -f 2)"
-  env="$(echo -e "${line}" | cut -f 3)"
+  eval "${line}"
+  echo "${PROGRESS_MARKER} step ${id} started"
   case "${ctx}" in
   "user")
+    if [[ "${interpreter}" == "exec" ]]; then
+      enable_exec_user_ctx
+    fi
     pushd user_ctx_dir
     echo "Executing user script ${script}"
     if [[ ! -z "${env}" ]]; then
       env="../builtin_ctx_dir/${env}"
     fi
+    if [[ -e "../builtin_ctx_dir/build_env" ]]; then
+      build_env="../builtin_ctx_dir/build_env"
+    fi
     ;;
   "builtin")
     pushd builtin_ctx_dir
@@ -268,16 +427,51 @@ execute_instr() {
     echo "Cannot find build context: ${ctx}"
     exit 1
   esac
+  if [[ -n "${interpreter}" ]]; then
+    echo "Using interpreter ${interpreter}"
+  fi
+  if [[ "${#args[@]}" -ne 0 ]]; then
+    echo "Using arguments:$(printf ' %q' "${args[@]}")"
+  fi
+  if [[ -n "${build_env}" ]]; then
+    echo "Using the following build environment:"
+    print_env "${build_env}"
+  fi
   if [[ ! -z "${env}" ]]; then
     echo "Using the following environment:"
-    cat "${env}"
-    (set -o errexit; . "$(realpath "${env}")"; /bin/bash "$(realpath "${script}")")
-  else
-    (/bin/bash "$(realpath "${script}")")
+    print_env "${env}"
   fi
+  local -r attempts="$(( ${retries:-0} + 1 ))"
+  local attempt=1
+  local status
+  while true; do
+    echo "Running script ${script} [attempt ${attempt}/${attempts}]..."
+    status=0
+    run_script "${script}" "${env}" "${timeout_sec}" "${interpreter}" \
+      "${build_env}" ${args[@]+"${args[@]}"} || status="$?"
+    if [[ "${status}" -eq 0 ]]; then
+      echo "Attempt ${attempt}/${attempts} of script ${script} succeeded."
+      break
+    elif [[ -n "${timeout_sec}" && "${status}" -eq 124 ]]; then
+      echo "Attempt ${attempt}/${attempts} of script ${script} timed out after ${timeout_sec}s."
+    else
+      echo "Attempt ${attempt}/${attempts} of script ${script} failed with exit code ${status}."
+    fi
+    if [[ "${attempt}" -ge "${attempts}" ]]; then
+      if [[ "${allow_failure}" == "true" ]]; then
+        echo "Script ${script} failed; continuing since failure is allowed."
+        break
+      fi
+      echo "Script ${script} failed after ${attempts} attempt(s)."
+      echo "${PROGRESS_MARKER} step ${id} failed"
+      exit "${status}"
+    fi
+    attempt=$((attempt+1))
+  done
   echo "Finished running script ${script}."
   popd
   echo "Done executing instruction ${line}"
+  echo "${PROGRESS_MARKER} step ${id} finished"
 }
 
 execute_state_file() {
@@ -356,7 +550,7 @@ main 2>&1 | sed "s/^/BuildStatus: /"
 trap - EXIT
 echo "BuildSucceeded: Build completed with no errors. Shutting down..."
 # We tell Daisy to check for serial logs every 2 seconds (see
-# data/build_image.wf.json). However, sometimes Daisy checks for logs
+# preloader/workflow.go). However, sometimes Daisy checks for logs
 # every 4-6 seconds. Sleep gives Daisy time to grab the serial logs
 # even when it is slow.
 sleep 15 || fatal "sleep returned non-zero error code $?"
@@ -52,6 +52,10 @@ type GCE struct {
 	Images *compute.ImageList
 	// Deprecated represents the set of deprecated images in the project.
 	Deprecated map[string]*compute.DeprecationStatus
+	// Instances represents the instances present in the project, in all zones.
+	Instances []*compute.Instance
+	// Disks represents the disks present in the project, in all zones.
+	Disks []*compute.Disk
 	// Operations is the sequence of operations that the fake GCE server should return.
 	Operations []*compute.Operation
 	// server is an HTTP server that serves fake GCE requests. Requests are served using the state stored in
@@ -71,6 +75,7 @@ func NewGCEServer(project string) *GCE {
 	mux.HandleFunc(fmt.Sprintf("/%s/global/images", project), gce.imagesListHandler)
 	mux.HandleFunc(fmt.Sprintf("/%s/global/images/", project), gce.imageHandler)
 	mux.HandleFunc(fmt.Sprintf("/%s/global/operations/", project), gce.operationsHandler)
+	mux.HandleFunc(fmt.Sprintf("/%s/zones/", project), gce.zoneHandler)
 	gce.server = httptest.NewServer(mux)
 	return gce
 }
@@ -118,6 +123,35 @@ func (g *GCE) imageHandler(w http.ResponseWriter, r *http.Request) {
 	// Path starts with /<project>/global/images/<name>
 	splitPath := strings.Split(r.URL.Path, "/")
 	switch {
+	case len(splitPath) == 5 && r.Method == http.MethodPatch:
+		image := g.image(splitPath[4])
+		if image == nil {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println("failed to read body")
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		patch := &compute.Image{}
+		if err := json.Unmarshal(body, patch); err != nil {
+			log.Printf("failed to parse body: %s", string(body))
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if patch.Family != "" {
+			image.Family = patch.Family
+		}
+		op := g.operation()
+		bytes, err := json.Marshal(op)
+		if err != nil {
+			log.Printf("failed to marshal operation: %v", op)
+			writeError(w, r, http.StatusInternalServerError)
+			return
+		}
+		w.Write(bytes)
 	case len(splitPath) == 5:
 		image := g.image(splitPath[4])
 		if image == nil {
@@ -171,6 +205,66 @@ func (g *GCE) operationsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
+// deleteInstance deletes the given instance. It returns false if the instance does not exist.
+func (g *GCE) deleteInstance(zone, name string) bool {
+	for i, instance := range g.Instances {
+		if instance.Zone == zone && instance.Name == name {
+			g.Instances = append(g.Instances[:i], g.Instances[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// deleteDisk deletes the given disk. It returns false if the disk does not exist.
+func (g *GCE) deleteDisk(zone, name string) bool {
+	for i, disk := range g.Disks {
+		if disk.Zone == zone && disk.Name == name {
+			g.Disks = append(g.Disks[:i], g.Disks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GCE) zoneHandler(w http.ResponseWriter, r *http.Request) {
+	// Path starts with /<project>/zones/<zone>/<collection>/<name>
+	splitPath := strings.Split(r.URL.Path, "/")
+	if len(splitPath) != 6 {
+		log.Printf("unrecognized path: %s", r.URL.Path)
+		writeError(w, r, http.StatusNotFound)
+		return
+	}
+	zone, collection, name := splitPath[3], splitPath[4], splitPath[5]
+	switch {
+	case collection == "operations":
+		g.operationsHandler(w, r)
+		return
+	case collection == "instances" && r.Method == http.MethodDelete:
+		if !g.deleteInstance(zone, name) {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+	case collection == "disks" && r.Method == http.MethodDelete:
+		if !g.deleteDisk(zone, name) {
+			writeError(w, r, http.StatusNotFound)
+			return
+		}
+	default:
+		log.Printf("unrecognized path: %s", r.URL.Path)
+		writeError(w, r, http.StatusNotFound)
+		return
+	}
+	op := g.operation()
+	bytes, err := json.Marshal(op)
+	if err != nil {
+		log.Printf("failed to marshal operation: %v", op)
+		writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+	w.Write(bytes)
+}
+
 // Close closes the fake GCE server.
 func (g *GCE) Close() {
 	g.server.Close()
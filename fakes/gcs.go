@@ -16,9 +16,13 @@ package fakes
 
 import (
 	"context"
+	"crypto/md5"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
@@ -27,16 +31,38 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/option"
 )
 
-type gcsObject struct{ Name, Bucket string }
+type gcsObject struct {
+	Name   string `json:"name"`
+	Bucket string `json:"bucket"`
+	Size   string `json:"size,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+	MD5    string `json:"md5Hash,omitempty"`
+}
 type gcsObjects struct{ Items []gcsObject }
 
+// newGCSObject builds the metadata of an object with the given data.
+func newGCSObject(bucket, name string, data []byte) gcsObject {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	md5Sum := md5.Sum(data)
+	return gcsObject{
+		Name:   name,
+		Bucket: bucket,
+		Size:   strconv.Itoa(len(data)),
+		CRC32C: base64.StdEncoding.EncodeToString(crc),
+		MD5:    base64.StdEncoding.EncodeToString(md5Sum[:]),
+	}
+}
+
 func setTransportAddr(transport *http.Transport, addr string) {
 	transport.DialTLS = func(_, _ string) (net.Conn, error) {
 		return tls.Dial("tcp", addr, transport.TLSClientConfig)
@@ -53,27 +79,37 @@ func setTransportAddr(transport *http.Transport, addr string) {
 // are implemented here. Documentation for the GCS JSON API is here:
 // https://cloud.google.com/storage/docs/json_api/v1/
 //
-// This struct should not be considered concurrency safe.
+// This struct should not be considered concurrency safe. The fake GCS server serializes the
+// requests that it serves, but the fields of this struct should not be accessed while requests
+// are in flight.
 type GCS struct {
 	// Objects represents the collection of objects that exist in the fake GCS server.
 	// Keys are strings of the form "/<bucket>/<object path>". Values are data that belong
 	// in each object.
 	Objects map[string][]byte
+	// Uploads counts the objects uploaded to the fake GCS server.
+	Uploads int
 	// Client is the client to use when accessing the fake GCS server.
 	Client *storage.Client
 	// Server is the fake GCS server. It uses state from this struct for serving requests.
 	Server *httptest.Server
+
+	mu sync.Mutex
 }
 
 // NewGCSServer constructs a fake GCS implementation.
 func NewGCSServer(ctx context.Context) (*GCS, error) {
 	var err error
-	gcs := &GCS{make(map[string][]byte), nil, nil}
+	gcs := &GCS{Objects: make(map[string][]byte)}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", gcs.objectHandler)
 	mux.HandleFunc("/storage/v1/b/", gcs.bucketHandler)
 	mux.HandleFunc("/upload/storage/v1/b/", gcs.uploadHandler)
-	gcs.Server = httptest.NewTLSServer(mux)
+	gcs.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gcs.mu.Lock()
+		defer gcs.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
 	httpClient := gcs.Server.Client()
 	setTransportAddr(httpClient.Transport.(*http.Transport), gcs.Server.Listener.Addr().String())
 	gcs.Client, err = storage.NewClient(ctx, option.WithHTTPClient(httpClient), option.WithoutAuthentication())
@@ -106,9 +142,9 @@ func (g *GCS) list(w http.ResponseWriter, r *http.Request, bucket string) {
 	bucketPrefix := fmt.Sprintf("/%s/", bucket)
 	prefix := bucketPrefix + r.Form.Get("prefix")
 	var all gcsObjects
-	for k := range g.Objects {
+	for k, data := range g.Objects {
 		if strings.HasPrefix(k, prefix) {
-			all.Items = append(all.Items, gcsObject{strings.TrimPrefix(k, bucketPrefix), bucket})
+			all.Items = append(all.Items, newGCSObject(bucket, strings.TrimPrefix(k, bucketPrefix), data))
 		}
 	}
 	bytes, err := json.Marshal(all)
@@ -134,6 +170,25 @@ func (g *GCS) del(w http.ResponseWriter, r *http.Request, bucket, objectPath str
 	delete(g.Objects, key)
 }
 
+// get handles a `get` request for object metadata.
+// See: https://cloud.google.com/storage/docs/json_api/v1/#Objects, `get` method.
+// Doesn't handle any optional parameters.
+func (g *GCS) get(w http.ResponseWriter, r *http.Request, bucket, objectPath string) {
+	data, ok := g.Objects[fmt.Sprintf("/%s/%s", bucket, objectPath)]
+	if !ok {
+		writeError(w, r, http.StatusNotFound)
+		return
+	}
+	bytes, err := json.Marshal(newGCSObject(bucket, objectPath, data))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(bytes); err != nil {
+		log.Printf("write %q failed: %v", r.URL.Path, err)
+	}
+}
+
 func (g *GCS) bucketHandler(w http.ResponseWriter, r *http.Request) {
 	// Path looks like:
 	// - /storage/v1/b/<bucket>/o
@@ -152,6 +207,8 @@ func (g *GCS) bucketHandler(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case objectPath != "" && r.Method == "DELETE":
 		g.del(w, r, bucket, objectPath)
+	case objectPath != "" && r.Method == "GET":
+		g.get(w, r, bucket, objectPath)
 	case objectPath == "":
 		g.list(w, r, bucket)
 	default:
@@ -210,7 +267,13 @@ func (g *GCS) uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	g.Objects[fmt.Sprintf("/%s/%s", object.Bucket, object.Name)] = objectData
-	if _, err := w.Write(objectMetadata); err != nil {
+	g.Uploads++
+	bytes, err := json.Marshal(newGCSObject(object.Bucket, object.Name, objectData))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(bytes); err != nil {
 		log.Printf("write %q failed: %v", r.URL.Path, err)
 	}
 }
@@ -19,45 +19,110 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-func tarFile(src, dst string) error {
-	dirPath := filepath.Dir(src)
-	baseName := filepath.Base(src)
-	cmd := exec.Command("tar", "cf", dst, "-C", dirPath, baseName)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// archiveModTime is the modification time of all entries in build context archives. Using a fixed
+// time makes archives of the same files identical, regardless of when the files were last changed.
+var archiveModTime = time.Unix(0, 0)
+
+// normalizeHeader clears the owners and times of the given tar header, so that the entry only
+// depends on the name, mode, type and contents of the file.
+func normalizeHeader(hdr *tar.Header) {
+	hdr.Uid = 0
+	hdr.Gid = 0
+	hdr.Uname = ""
+	hdr.Gname = ""
+	hdr.ModTime = archiveModTime
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
 }
 
-func tarDir(root, dst string) error {
-	args := []string{"cf", dst, "-C", root}
-	inputFiles, err := filepath.Glob(filepath.Join(root, "*"))
+// writeArchiveEntry writes the file at the given path to the given tar writer under the given name.
+// Only regular files, directories and symlinks are supported. Owners and times are normalized.
+func writeArchiveEntry(tarWriter *tar.Writer, path, name string, info os.FileInfo) error {
+	var link string
+	switch {
+	case info.Mode().IsRegular():
+	case info.IsDir():
+		name += "/"
+	case info.Mode()&os.ModeSymlink != 0:
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot archive %s: unsupported file type %v", path, info.Mode().Type())
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	normalizeHeader(hdr)
+	if err := tarWriter.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	var relInputFiles []string
-	for _, path := range inputFiles {
+	defer f.Close()
+	_, err = io.Copy(tarWriter, f)
+	return err
+}
+
+// tarFile writes an archive that contains the given regular file under its base name.
+func tarFile(tarWriter *tar.Writer, src string, info os.FileInfo) error {
+	return writeArchiveEntry(tarWriter, src, filepath.Base(src), info)
+}
+
+// tarDir writes an archive that contains the contents of the given directory. Entries are written
+// in lexical order, and the archive itself is skipped if it is in the directory. Like a shell glob of
+// the directory, entries at the root of the directory whose names start with '.' are skipped. Entries
+// excluded by the given ignore rules are skipped, along with the contents of excluded directories.
+func tarDir(tarWriter *tar.Writer, root string, archiveInfo os.FileInfo, rules ignoreRules) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || os.SameFile(info, archiveInfo) {
+			return nil
+		}
 		relPath, err := filepath.Rel(root, path)
 		if err != nil {
 			return err
 		}
-		relInputFiles = append(relInputFiles, relPath)
-	}
-	if relInputFiles == nil {
-		relInputFiles = []string{"."}
-	}
-	args = append(args, relInputFiles...)
-	cmd := exec.Command("tar", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+		relPath = filepath.ToSlash(relPath)
+		_, excluded := rules.match(relPath, info.IsDir())
+		if excluded || (!strings.Contains(relPath, "/") && strings.HasPrefix(relPath, ".")) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return writeArchiveEntry(tarWriter, path, relPath, info)
+	})
 }
 
-// CreateBuildContextArchive creates a tar archive of the given build context.
+// CreateBuildContextArchive creates a tar archive of the given build context. Archives are
+// reproducible: archiving the same files always yields the same bytes. If the build context is a
+// directory with an IgnoreFileName file at its root, entries matching the rules in that file are
+// left out of the archive. If the build context is a .tar, .tar.gz, .tgz or .zip file, its contents
+// are used as the build context; any other regular file is archived as a single file.
 func CreateBuildContextArchive(src, dst string) error {
+	return CreateBuildContextArchiveWithIgnoreFile(src, dst, "")
+}
+
+// CreateBuildContextArchiveWithIgnoreFile is like CreateBuildContextArchive, but it filters the
+// build context with the rules in the given ignore file instead. If ignoreFile is empty, the
+// IgnoreFileName file at the root of the build context is used if it exists.
+func CreateBuildContextArchiveWithIgnoreFile(src, dst, ignoreFile string) error {
 	if _, err := os.Stat(dst); !os.IsNotExist(err) {
 		return fmt.Errorf("dst path already exists: %s", dst)
 	}
@@ -68,21 +133,93 @@ func CreateBuildContextArchive(src, dst string) error {
 	if err != nil {
 		return err
 	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return fmt.Errorf("input path %s is neither a directory nor a regular file", src)
+	}
+	switch {
+	case ignoreFile != "" && !info.IsDir() && prepackagedFormat(src) == "":
+		return fmt.Errorf("ignore file %s cannot be used with build context %s; it is neither a directory nor "+
+			"a prepackaged build context", ignoreFile, src)
+	case ignoreFile == "" && info.IsDir():
+		defaultIgnoreFile := filepath.Join(src, IgnoreFileName)
+		if _, err := os.Stat(defaultIgnoreFile); err == nil {
+			ignoreFile = defaultIgnoreFile
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	var rules ignoreRules
+	if ignoreFile != "" {
+		if rules, err = readIgnoreRules(ignoreFile); err != nil {
+			return err
+		}
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := writeBuildContextArchive(out, src, info, rules); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	if err := saveIgnoreRules(dst, ignoreFile); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// RemoveBuildContextArchive deletes a build context archive created by CreateBuildContextArchive,
+// along with the ignore rules recorded next to it. Archives that don't exist are skipped.
+func RemoveBuildContextArchive(archive string) error {
+	for _, path := range []string{archive, ignoreRulesPath(archive)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBuildContextArchive writes a tar archive of the given build context to the given archive file.
+func writeBuildContextArchive(out *os.File, src string, info os.FileInfo, rules ignoreRules) error {
+	archiveInfo, err := out.Stat()
+	if err != nil {
+		return err
+	}
+	tarWriter := tar.NewWriter(out)
 	switch {
 	case info.IsDir():
-		return tarDir(src, dst)
-	case info.Mode().IsRegular():
-		return tarFile(src, dst)
+		err = tarDir(tarWriter, src, archiveInfo, rules)
+	case prepackagedFormat(src) != "":
+		err = tarPrepackaged(tarWriter, src, rules)
 	default:
-		return fmt.Errorf("input path %s is neither a directory nor a regular file", src)
+		err = tarFile(tarWriter, src, info)
+	}
+	if err != nil {
+		return err
 	}
+	return tarWriter.Close()
 }
 
-// ArchiveHasObject determines if the given tar archive contains the given object.
+// ArchiveHasObject determines if the given tar archive contains the given object. If the object
+// was left out of the archive by an ignore rule, an error naming the rule is returned.
 func ArchiveHasObject(archive string, path string) (bool, error) {
+	_, found, err := ArchiveObjectMode(archive, path)
+	return found, err
+}
+
+// ArchiveObjectMode gets the mode recorded in the tar header of the given object in the given tar
+// archive. The returned bool is false if the archive does not contain the object. If the object
+// was left out of the archive by an ignore rule, an error naming the rule is returned.
+func ArchiveObjectMode(archive string, path string) (os.FileMode, bool, error) {
 	reader, err := os.Open(archive)
 	if err != nil {
-		return false, err
+		return 0, false, err
 	}
 	defer reader.Close()
 	tarReader := tar.NewReader(reader)
@@ -92,13 +229,39 @@ func ArchiveHasObject(archive string, path string) (bool, error) {
 			break
 		}
 		if err != nil {
-			return false, err
+			return 0, false, err
+		}
+		if hdr.Name == path {
+			return hdr.FileInfo().Mode(), true, nil
+		}
+	}
+	return 0, false, excludedObjectError(archive, path)
+}
+
+// ReadArchiveObject calls f with a reader for the contents of the given object in the
+// given tar archive. It returns an error if the archive does not contain the object.
+func ReadArchiveObject(archive string, path string, f func(io.Reader) error) error {
+	reader, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tarReader := tar.NewReader(reader)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			if err := excludedObjectError(archive, path); err != nil {
+				return err
+			}
+			return fmt.Errorf("could not find object %s in archive %s", path, archive)
+		}
+		if err != nil {
+			return err
 		}
 		if hdr.Name == path {
-			return true, nil
+			return f(tarReader)
 		}
 	}
-	return false, nil
 }
 
 // CreatePersistentBuiltinContext copies the contents of the builtin build context
@@ -15,13 +15,21 @@
 package fs
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func diffDirs(got, want string) (string, error) {
@@ -154,6 +162,138 @@ func TestCreateBuildContextArchive(t *testing.T) {
 	}
 }
 
+// createReproducibleTestTree creates a directory tree with regular files, an executable, a nested
+// directory and a symlink.
+func createReproducibleTestTree(root string) error {
+	if err := os.MkdirAll(filepath.Join(root, "dir", "nested"), 0755); err != nil {
+		return err
+	}
+	// Chmod explicitly so that the modes do not depend on the umask.
+	for _, dir := range []string{"dir", "dir/nested"} {
+		if err := os.Chmod(filepath.Join(root, filepath.FromSlash(dir)), 0755); err != nil {
+			return err
+		}
+	}
+	files := map[string]os.FileMode{
+		"b":                  0644,
+		"a.sh":               0755,
+		"dir/c":              0600,
+		"dir/nested/d":       0644,
+		"dir/z_last_in_list": 0644,
+	}
+	for name, mode := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := ioutil.WriteFile(path, []byte(name), mode); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	return os.Symlink("../b", filepath.Join(root, "dir", "link"))
+}
+
+func archiveDigest(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+func TestCreateBuildContextArchiveReproducible(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	var digests []string
+	for i, modTime := range []time.Time{time.Unix(1000, 0), time.Unix(2000000000, 0)} {
+		// Archive identical trees that differ in location and modification times.
+		root := filepath.Join(tmpDir, fmt.Sprintf("tree_%d", i))
+		if err := createReproducibleTestTree(root); err != nil {
+			t.Fatal(err)
+		}
+		if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.Mode()&os.ModeSymlink != 0 {
+				return err
+			}
+			return os.Chtimes(path, modTime, modTime)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		archive := filepath.Join(tmpDir, fmt.Sprintf("archive_%d", i))
+		if err := CreateBuildContextArchive(root, archive); err != nil {
+			t.Fatal(err)
+		}
+		digest, err := archiveDigest(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, digest)
+	}
+	if digests[0] != digests[1] {
+		t.Errorf("CreateBuildContextArchive: archives of identical trees have SHA-256 digests %s and %s; want equal",
+			digests[0], digests[1])
+	}
+}
+
+func TestCreateBuildContextArchiveEntries(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	root := filepath.Join(tmpDir, "tree")
+	if err := createReproducibleTestTree(root); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(tmpDir, "archive")
+	if err := CreateBuildContextArchive(root, archive); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	type entry struct {
+		name     string
+		typeflag byte
+		mode     int64
+		linkname string
+	}
+	var got []entry
+	tarReader := tar.NewReader(f)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Gname != "" || !hdr.ModTime.Equal(archiveModTime) {
+			t.Errorf("CreateBuildContextArchive: entry %s has uid %d, gid %d, uname %q, gname %q, mtime %v; "+
+				"want normalized", hdr.Name, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname, hdr.ModTime)
+		}
+		got = append(got, entry{hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Linkname})
+	}
+	want := []entry{
+		{"a.sh", tar.TypeReg, 0755, ""},
+		{"b", tar.TypeReg, 0644, ""},
+		{"dir/", tar.TypeDir, 0755, ""},
+		{"dir/c", tar.TypeReg, 0600, ""},
+		{"dir/link", tar.TypeSymlink, 0777, "../b"},
+		{"dir/nested/", tar.TypeDir, 0755, ""},
+		{"dir/nested/d", tar.TypeReg, 0644, ""},
+		{"dir/z_last_in_list", tar.TypeReg, 0644, ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CreateBuildContextArchive: got entries %v, want %v", got, want)
+	}
+}
+
 func TestArchiveHasObjectEmptyDir(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -208,3 +348,516 @@ func TestArchiveHasObject(t *testing.T) {
 		})
 	}
 }
+
+func TestReadArchiveObject(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	contextDir := filepath.Join(tmpDir, "context")
+	if err := os.MkdirAll(filepath.Join(contextDir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(contextDir, "a", "b"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(tmpDir, "archive")
+	if err := CreateBuildContextArchive(contextDir, archive); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	if err := ReadArchiveObject(archive, "a/b", func(r io.Reader) error {
+		got, err = ioutil.ReadAll(r)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("ReadArchiveObject(%s, a/b): got %q, want %q", archive, string(got), "hello")
+	}
+	if err := ReadArchiveObject(archive, "a/c", func(io.Reader) error { return nil }); err == nil {
+		t.Errorf("ReadArchiveObject(%s, a/c) = nil; want error", archive)
+	}
+}
+
+func TestArchiveObjectMode(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	contextDir := filepath.Join(tmpDir, "context")
+	if err := os.Mkdir(contextDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range map[string]os.FileMode{"exec": 0755, "noexec": 0644} {
+		if err := ioutil.WriteFile(filepath.Join(contextDir, name), nil, mode); err != nil {
+			t.Fatal(err)
+		}
+		// Chmod explicitly so that the result does not depend on the umask.
+		if err := os.Chmod(filepath.Join(contextDir, name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := filepath.Join(tmpDir, "archive")
+	if err := CreateBuildContextArchive(contextDir, archive); err != nil {
+		t.Fatal(err)
+	}
+	testData := []struct {
+		object    string
+		wantMode  os.FileMode
+		wantFound bool
+	}{
+		{"exec", 0755, true},
+		{"noexec", 0644, true},
+		{"missing", 0, false},
+	}
+	for _, input := range testData {
+		mode, found, err := ArchiveObjectMode(archive, input.object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode != input.wantMode || found != input.wantFound {
+			t.Errorf("ArchiveObjectMode(%s, %s) = %v, %t; want %v, %t", archive, input.object, mode, found,
+				input.wantMode, input.wantFound)
+		}
+	}
+}
+
+func archiveEntryNames(archive string) ([]string, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	tarReader := tar.NewReader(f)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestCreateBuildContextArchiveIgnoreFile(t *testing.T) {
+	testData := []struct {
+		testName    string
+		defaultFile string
+		ignoreFile  string
+		want        []string
+	}{
+		{
+			"NoIgnoreFile", "", "",
+			[]string{"a.sh", "b", "dir/", "dir/c", "dir/link", "dir/nested/", "dir/nested/d", "dir/z_last_in_list"},
+		},
+		{
+			"DefaultIgnoreFile", "nested/\n*.sh\n!dir/z_*\ndir/*\n", "",
+			[]string{"b", "dir/"},
+		},
+		{
+			"DefaultIgnoreFileNotArchived", "dir/\n", "",
+			[]string{"a.sh", "b"},
+		},
+		{
+			"IgnoreFileFlag", "dir/\n", "/b\ndir/nested/\n",
+			[]string{"a.sh", "dir/", "dir/c", "dir/link", "dir/z_last_in_list"},
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			root := filepath.Join(tmpDir, "tree")
+			if err := createReproducibleTestTree(root); err != nil {
+				t.Fatal(err)
+			}
+			if input.defaultFile != "" {
+				if err := ioutil.WriteFile(filepath.Join(root, IgnoreFileName), []byte(input.defaultFile), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ignoreFile := ""
+			if input.ignoreFile != "" {
+				ignoreFile = filepath.Join(tmpDir, "ignore")
+				if err := ioutil.WriteFile(ignoreFile, []byte(input.ignoreFile), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			archive := filepath.Join(tmpDir, "archive")
+			if err := CreateBuildContextArchiveWithIgnoreFile(root, archive, ignoreFile); err != nil {
+				t.Fatal(err)
+			}
+			got, err := archiveEntryNames(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, input.want) {
+				t.Errorf("CreateBuildContextArchiveWithIgnoreFile(_, _, %q): got entries %v, want %v", ignoreFile, got,
+					input.want)
+			}
+		})
+	}
+}
+
+func TestCreateBuildContextArchiveDotfiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	root := filepath.Join(tmpDir, "tree")
+	if err := createReproducibleTestTree(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".env", ".git/config", "dir/.keep"} {
+		if err := ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(name)), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := filepath.Join(tmpDir, "archive")
+	if err := CreateBuildContextArchive(root, archive); err != nil {
+		t.Fatal(err)
+	}
+	got, err := archiveEntryNames(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.sh", "b", "dir/", "dir/.keep", "dir/c", "dir/link", "dir/nested/", "dir/nested/d",
+		"dir/z_last_in_list"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CreateBuildContextArchive: got entries %v, want %v", got, want)
+	}
+}
+
+func TestRemoveBuildContextArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	root := filepath.Join(tmpDir, "tree")
+	if err := createReproducibleTestTree(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, IgnoreFileName), []byte("b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(tmpDir, "archive")
+	if err := CreateBuildContextArchive(root, archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveBuildContextArchive(archive); err != nil {
+		t.Fatalf("RemoveBuildContextArchive(%s): %v", archive, err)
+	}
+	for _, path := range []string{archive, ignoreRulesPath(archive)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("RemoveBuildContextArchive(%s): %s still exists", archive, path)
+		}
+	}
+	if err := RemoveBuildContextArchive(archive); err != nil {
+		t.Errorf("RemoveBuildContextArchive(%s) of a removed archive: %v", archive, err)
+	}
+}
+
+func TestCreateBuildContextArchiveIgnoreFileInvalid(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ignoreFile := filepath.Join(tmpDir, "ignore")
+	if err := ioutil.WriteFile(ignoreFile, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	badIgnoreFile := filepath.Join(tmpDir, "bad_ignore")
+	if err := ioutil.WriteFile(badIgnoreFile, []byte("[a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testData := []struct {
+		testName   string
+		src        string
+		ignoreFile string
+	}{
+		{"RegularFileContext", "testdata/test_3", ignoreFile},
+		{"MissingIgnoreFile", "testdata/test_1", filepath.Join(tmpDir, "missing")},
+		{"InvalidPattern", "testdata/test_1", badIgnoreFile},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			archive := filepath.Join(tmpDir, input.testName)
+			if err := CreateBuildContextArchiveWithIgnoreFile(input.src, archive, input.ignoreFile); err == nil {
+				t.Errorf("CreateBuildContextArchiveWithIgnoreFile(%s, _, %s) = nil; want error", input.src, input.ignoreFile)
+			}
+			if _, err := os.Stat(archive); !os.IsNotExist(err) {
+				t.Errorf("CreateBuildContextArchiveWithIgnoreFile(%s, _, %s): archive exists; want it removed",
+					input.src, input.ignoreFile)
+			}
+		})
+	}
+}
+
+func TestArchiveHasObjectIgnored(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	root := filepath.Join(tmpDir, "tree")
+	if err := createReproducibleTestTree(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, IgnoreFileName), []byte("nested/\n*.sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(tmpDir, "archive")
+	if err := CreateBuildContextArchive(root, archive); err != nil {
+		t.Fatal(err)
+	}
+	testData := []struct {
+		object   string
+		wantRule string
+	}{
+		{"a.sh", "*.sh"},
+		{"dir/nested/d", "nested/"},
+		{"dir/nested/", "nested/"},
+	}
+	for _, input := range testData {
+		found, err := ArchiveHasObject(archive, input.object)
+		if found || err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%q", input.wantRule)) {
+			t.Errorf("ArchiveHasObject(%s, %s) = %t, %v; want an error naming the rule %q", archive, input.object,
+				found, err, input.wantRule)
+		}
+		if err := ReadArchiveObject(archive, input.object, func(io.Reader) error { return nil }); err == nil ||
+			!strings.Contains(err.Error(), fmt.Sprintf("%q", input.wantRule)) {
+			t.Errorf("ReadArchiveObject(%s, %s) = %v; want an error naming the rule %q", archive, input.object, err,
+				input.wantRule)
+		}
+	}
+	if found, err := ArchiveHasObject(archive, "missing"); found || err != nil {
+		t.Errorf("ArchiveHasObject(%s, missing) = %t, %v; want false, nil", archive, found, err)
+	}
+}
+
+// prepackagedTestEntry is an entry of a prepackaged build context created by tests.
+type prepackagedTestEntry struct {
+	name     string
+	mode     os.FileMode
+	contents string
+}
+
+var prepackagedTestEntries = []prepackagedTestEntry{
+	{"./", os.ModeDir | 0755, ""},
+	{"./a.sh", 0755, "a"},
+	{"dir/", os.ModeDir | 0700, ""},
+	{"dir/b", 0644, "b"},
+	{"dir/link", os.ModeSymlink | 0777, "../a.sh"},
+}
+
+func writePrepackagedTar(path string, compress bool, entries []prepackagedTestEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if compress {
+		gzipWriter := gzip.NewWriter(f)
+		defer gzipWriter.Close()
+		w = gzipWriter
+	}
+	tarWriter := tar.NewWriter(w)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.name, Mode: int64(entry.mode.Perm()), Uid: 1000, Uname: "user",
+			ModTime: time.Unix(1000, 0)}
+		switch {
+		case entry.mode.IsDir():
+			hdr.Typeflag = tar.TypeDir
+		case entry.mode&os.ModeSymlink != 0:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = entry.contents
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(entry.contents))
+		}
+		if err := tarWriter.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tarWriter.Write([]byte(entry.contents)); err != nil {
+				return err
+			}
+		}
+	}
+	return tarWriter.Close()
+}
+
+func writePrepackagedZip(path string, entries []prepackagedTestEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zipWriter := zip.NewWriter(f)
+	for _, entry := range entries {
+		hdr := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		hdr.SetMode(entry.mode)
+		w, err := zipWriter.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(entry.contents)); err != nil {
+			return err
+		}
+	}
+	return zipWriter.Close()
+}
+
+func TestCreateBuildContextArchivePrepackaged(t *testing.T) {
+	type entry struct {
+		name     string
+		typeflag byte
+		mode     int64
+		linkname string
+		contents string
+	}
+	want := []entry{
+		{"a.sh", tar.TypeReg, 0755, "", "a"},
+		{"dir/", tar.TypeDir, 0700, "", ""},
+		{"dir/b", tar.TypeReg, 0644, "", "b"},
+		{"dir/link", tar.TypeSymlink, 0777, "../a.sh", ""},
+	}
+	testData := []struct {
+		testName string
+		name     string
+		write    func(string) error
+	}{
+		{"Tar", "context.tar", func(p string) error { return writePrepackagedTar(p, false, prepackagedTestEntries) }},
+		{"TarGz", "context.tar.gz", func(p string) error { return writePrepackagedTar(p, true, prepackagedTestEntries) }},
+		{"Tgz", "context.tgz", func(p string) error { return writePrepackagedTar(p, true, prepackagedTestEntries) }},
+		{"Zip", "context.zip", func(p string) error { return writePrepackagedZip(p, prepackagedTestEntries) }},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			src := filepath.Join(tmpDir, input.name)
+			if err := input.write(src); err != nil {
+				t.Fatal(err)
+			}
+			archive := filepath.Join(tmpDir, "archive")
+			if err := CreateBuildContextArchive(src, archive); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var got []entry
+			tarReader := tar.NewReader(f)
+			for {
+				hdr, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Uid != 0 || hdr.Uname != "" || !hdr.ModTime.Equal(archiveModTime) {
+					t.Errorf("CreateBuildContextArchive(%s, _): entry %s has uid %d, uname %q, mtime %v; want normalized",
+						input.name, hdr.Name, hdr.Uid, hdr.Uname, hdr.ModTime)
+				}
+				contents, err := ioutil.ReadAll(tarReader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, entry{hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Linkname, string(contents)})
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("CreateBuildContextArchive(%s, _): got entries %v, want %v", input.name, got, want)
+			}
+		})
+	}
+}
+
+func TestCreateBuildContextArchivePrepackagedIgnoreFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	src := filepath.Join(tmpDir, "context.tgz")
+	if err := writePrepackagedTar(src, true, prepackagedTestEntries); err != nil {
+		t.Fatal(err)
+	}
+	ignoreFile := filepath.Join(tmpDir, "ignore")
+	if err := ioutil.WriteFile(ignoreFile, []byte("dir/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(tmpDir, "archive")
+	if err := CreateBuildContextArchiveWithIgnoreFile(src, archive, ignoreFile); err != nil {
+		t.Fatal(err)
+	}
+	got, err := archiveEntryNames(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.sh"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CreateBuildContextArchiveWithIgnoreFile(%s, _, %s): got entries %v, want %v", src, ignoreFile, got, want)
+	}
+	if _, err := ArchiveHasObject(archive, "dir/b"); err == nil || !strings.Contains(err.Error(), `"dir/"`) {
+		t.Errorf("ArchiveHasObject(%s, dir/b) = %v; want an error naming the rule %q", archive, err, "dir/")
+	}
+}
+
+func TestCreateBuildContextArchivePrepackagedInvalid(t *testing.T) {
+	testData := []struct {
+		testName string
+		name     string
+		write    func(string) error
+	}{
+		{"ParentDir", "context.tar", func(p string) error {
+			return writePrepackagedTar(p, false, []prepackagedTestEntry{{"../a", 0644, "a"}})
+		}},
+		{"AbsolutePath", "context.zip", func(p string) error {
+			return writePrepackagedZip(p, []prepackagedTestEntry{{"/etc/a", 0644, "a"}})
+		}},
+		{"NotGzip", "context.tgz", func(p string) error { return writePrepackagedTar(p, false, prepackagedTestEntries) }},
+		{"NotZip", "context.zip", func(p string) error { return ioutil.WriteFile(p, []byte("not a zip"), 0644) }},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			src := filepath.Join(tmpDir, input.name)
+			if err := input.write(src); err != nil {
+				t.Fatal(err)
+			}
+			archive := filepath.Join(tmpDir, "archive")
+			if err := CreateBuildContextArchive(src, archive); err == nil {
+				t.Errorf("CreateBuildContextArchive(%s, _) = nil; want error", input.testName)
+			}
+			if _, err := os.Stat(archive); !os.IsNotExist(err) {
+				t.Errorf("CreateBuildContextArchive(%s, _): archive exists; want it removed", input.testName)
+			}
+		})
+	}
+}
@@ -17,11 +17,18 @@
 package fs
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 )
 
 const (
+	// DefaultBuildID is the ID of the image build that is used if no build ID is given.
+	DefaultBuildID = "default"
+
 	// ScratchDir is used for temp files and the like.
 	ScratchDir = "/tmp"
 
@@ -32,6 +39,9 @@ const (
 	// This directory is used for building files into the container image.
 	volatileDir = "/data"
 
+	// Directory in the workdir that contains the persistent directory of each image build.
+	buildsDir = "builds"
+
 	// Persistent files. These paths need to be created before they are used.
 	// Changes to these files persist across build steps.
 	userBuildContextArchive    = "user_build_context.tar"
@@ -42,7 +52,6 @@ const (
 
 	// Volatile files. These paths exist in the volatileDir at container start time.
 	// Changes to these files do not persist across build steps.
-	daisyWorkflow  = "build_image.wf.json"
 	startupScript  = "startup.sh"
 	systemdService = "customizer.service"
 
@@ -51,9 +60,16 @@ const (
 	builtinBuildContext = "builtin_build_context"
 )
 
+// buildIDRegex matches valid build IDs. Build IDs are used as directory names.
+var buildIDRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
 // Files stores important file paths.
 type Files struct {
+	// workdir is the directory that contains the persistent directories of all image builds.
+	workdir       string
 	persistentDir string
+	// BuildID is the ID of the image build that the persistent files belong to.
+	BuildID string
 	// UserBuildContextArchive points to the tar archive of the user build context.
 	// The user build context contains user provided scripts and files that users can use during preloading.
 	UserBuildContextArchive string
@@ -70,8 +86,6 @@ type Files struct {
 	SourceImageConfig string
 	// BuildConfig points to the image build process configuration.
 	BuildConfig string
-	// DaisyWorkflow points to the Daisy workflow to template and use for preloading.
-	DaisyWorkflow string
 	// StartupScript points to the startup script that needs to run on the preload VM.
 	StartupScript string
 	// SystemdService points to the systemd service that needs to invoke the startup script on the preload VM.
@@ -84,18 +98,25 @@ type Files struct {
 	DaisyBin string
 }
 
-// DefaultFiles builds a Files struct with a default file layout.
-func DefaultFiles(persistentDir string) *Files {
-	persistentDir = filepath.Join(os.Getenv("HOME"), persistentDir)
+// DefaultFiles builds a Files struct with a default file layout for the image build with the given
+// ID. The persistent files of each image build are kept in their own directory in the given
+// workdir, which is relative to $HOME.
+func DefaultFiles(workdir, buildID string) *Files {
+	return newFiles(filepath.Join(os.Getenv("HOME"), workdir), buildID)
+}
+
+func newFiles(workdir, buildID string) *Files {
+	persistentDir := filepath.Join(workdir, buildsDir, buildID)
 	return &Files{
+		workdir,
 		persistentDir,
+		buildID,
 		filepath.Join(persistentDir, userBuildContextArchive),
 		filepath.Join(persistentDir, builtinBuildContextArchive),
 		filepath.Join(persistentDir, builtinBuildContext),
 		filepath.Join(persistentDir, stateFile),
 		filepath.Join(persistentDir, sourceImageConfig),
 		filepath.Join(persistentDir, buildConfig),
-		filepath.Join(volatileDir, daisyWorkflow),
 		filepath.Join(volatileDir, startupScript),
 		filepath.Join(volatileDir, systemdService),
 		filepath.Join(volatileDir, builtinBuildContext),
@@ -103,7 +124,83 @@ func DefaultFiles(persistentDir string) *Files {
 	}
 }
 
-// CleanupAllPersistent deletes everything in the persistent directory.
+// ValidateBuildID checks that the given build ID can be used to name an image build.
+func ValidateBuildID(buildID string) error {
+	if !buildIDRegex.MatchString(buildID) {
+		return fmt.Errorf("invalid build ID %q; it must be 1-63 letters, digits, '.', '_' or '-', and must start "+
+			"with a letter or digit", buildID)
+	}
+	return nil
+}
+
+// ForBuild builds a Files struct with the same layout as this one for the image build with the
+// given ID.
+func (f *Files) ForBuild(buildID string) *Files {
+	return newFiles(f.workdir, buildID)
+}
+
+// BuildExists determines if the image build has persistent files.
+func (f *Files) BuildExists() (bool, error) {
+	_, err := os.Stat(f.persistentDir)
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsNotExist(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// ListBuilds lists the IDs of the image builds in the workdir, in lexical order.
+func (f *Files) ListBuilds() ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(f.workdir, buildsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var buildIDs []string
+	for _, info := range infos {
+		if info.IsDir() {
+			buildIDs = append(buildIDs, info.Name())
+		}
+	}
+	return buildIDs, nil
+}
+
+// CleanupAllPersistent deletes everything in the persistent directory. The persistent files of
+// other image builds are not affected.
 func (f *Files) CleanupAllPersistent() error {
 	return os.RemoveAll(f.persistentDir)
 }
+
+// WriteFileAtomic replaces the contents of the given file with the data written by the given
+// function. The data is written to a temporary file in the same directory, which is then renamed
+// over the given file, so that readers never see partially written contents.
+func WriteFileAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := write(tmpFile); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateBuildID(t *testing.T) {
+	for _, buildID := range []string{"default", "gpu", "v1.2_variant-A", "0", strings.Repeat("a", 63)} {
+		if err := ValidateBuildID(buildID); err != nil {
+			t.Errorf("ValidateBuildID(%q) = %v; want nil", buildID, err)
+		}
+	}
+	for _, buildID := range []string{"", ".", "..", "-a", "a/b", "a b", strings.Repeat("a", 64)} {
+		if err := ValidateBuildID(buildID); err == nil {
+			t.Errorf("ValidateBuildID(%q) = nil; want error", buildID)
+		}
+	}
+}
+
+func TestBuildsAreSeparate(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	files := newFiles(tmpDir, DefaultBuildID)
+	other := files.ForBuild("other")
+	if other.BuildID != "other" {
+		t.Errorf("ForBuild(other).BuildID = %q; want %q", other.BuildID, "other")
+	}
+	for _, pair := range [][2]string{
+		{files.StateFile, other.StateFile},
+		{files.UserBuildContextArchive, other.UserBuildContextArchive},
+		{files.BuiltinBuildContextArchive, other.BuiltinBuildContextArchive},
+		{files.PersistBuiltinBuildContext, other.PersistBuiltinBuildContext},
+		{files.SourceImageConfig, other.SourceImageConfig},
+		{files.BuildConfig, other.BuildConfig},
+	} {
+		if pair[0] == pair[1] {
+			t.Errorf("builds %q and %q share the persistent file %s", files.BuildID, other.BuildID, pair[0])
+		}
+	}
+	got, err := files.ListBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("ListBuilds() in an empty workdir = %v; want none", got)
+	}
+	for _, f := range []*Files{files, other} {
+		if err := CreateStateFile(f); err != nil {
+			t.Fatal(err)
+		}
+		lock, err := f.Lock(0)
+		if err != nil {
+			t.Fatalf("Lock(0) for build %q: %v", f.BuildID, err)
+		}
+		defer lock.Unlock()
+	}
+	got, err = files.ListBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{DefaultBuildID, "other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListBuilds() = %v; want %v", got, want)
+	}
+	if err := other.CleanupAllPersistent(); err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range []struct {
+		files *Files
+		want  bool
+	}{{files, true}, {other, false}} {
+		exists, err := input.files.BuildExists()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != input.want {
+			t.Errorf("BuildExists() for build %q after cleaning up build %q = %t; want %t", input.files.BuildID,
+				other.BuildID, exists, input.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "builds", DefaultBuildID, "state_file")); err != nil {
+		t.Errorf("CleanupAllPersistent() for build %q: %v", other.BuildID, err)
+	}
+}
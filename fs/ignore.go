@@ -0,0 +1,191 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// IgnoreFileName is the name of the file at the root of a build context that lists the entries
+// to leave out of the build context archive.
+const IgnoreFileName = ".cos-customizer-ignore"
+
+// ignoreRule is a single pattern of an ignore file.
+type ignoreRule struct {
+	// pattern is the pattern as written in the ignore file.
+	pattern string
+	// segments are the slash separated parts of the pattern, relative to the build context root.
+	// A "**" segment matches zero or more path segments.
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// ignoreRules decides which entries of a build context are left out of its archive. Rules
+// follow .gitignore syntax, and the last rule that matches a path decides if it is excluded.
+type ignoreRules []ignoreRule
+
+// parseIgnoreRules parses the contents of an ignore file. The name is only used in errors.
+func parseIgnoreRules(r io.Reader, name string) (ignoreRules, error) {
+	var rules ignoreRules
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{pattern: line}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimLeft(line, "/")
+		if line == "" {
+			return nil, fmt.Errorf("%s:%d: empty pattern %q", name, lineNum, rule.pattern)
+		}
+		rule.segments = strings.Split(line, "/")
+		if !anchored {
+			rule.segments = append([]string{"**"}, rule.segments...)
+		}
+		for _, segment := range rule.segments {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid pattern %q: %v", name, lineNum, rule.pattern, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// readIgnoreRules reads the ignore file at the given path.
+func readIgnoreRules(ignoreFile string) (ignoreRules, error) {
+	f, err := os.Open(ignoreFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseIgnoreRules(f, ignoreFile)
+}
+
+// matchSegments determines if the given path segments match the given pattern segments.
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		// A trailing "**" matches everything inside a directory, but not the directory itself.
+		if len(pattern) == 1 {
+			return len(name) > 0
+		}
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], name[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
+
+// match finds the rule that excludes the given slash separated path, relative to the build context
+// root. Parent directories of the path are not considered. The returned bool is false if the path
+// is not excluded.
+func (rules ignoreRules) match(relPath string, isDir bool) (ignoreRule, bool) {
+	name := strings.Split(relPath, "/")
+	var last ignoreRule
+	excluded := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(rule.segments, name) {
+			last = rule
+			excluded = !rule.negate
+		}
+	}
+	return last, excluded
+}
+
+// excludedBy finds the rule that excludes the given object from the archive, either directly or
+// by excluding one of its parent directories. Like archive entry names, objects that end with "/"
+// are directories. The returned bool is false if the object is not excluded.
+func (rules ignoreRules) excludedBy(object string) (ignoreRule, bool) {
+	isDir := strings.HasSuffix(object, "/")
+	name := strings.Split(strings.Trim(path.Clean(object), "/"), "/")
+	for i := 1; i <= len(name); i++ {
+		if rule, excluded := rules.match(strings.Join(name[:i], "/"), isDir || i < len(name)); excluded {
+			return rule, true
+		}
+	}
+	return ignoreRule{}, false
+}
+
+// ignoreRulesPath gets the path of the file that records the ignore rules used to create the given
+// archive.
+func ignoreRulesPath(archive string) string {
+	return archive + ".ignore"
+}
+
+// saveIgnoreRules records the contents of the given ignore file next to the given archive, so that
+// lookups of excluded objects can name the rule that excluded them.
+func saveIgnoreRules(archive, ignoreFile string) error {
+	if ignoreFile == "" {
+		if err := os.Remove(ignoreRulesPath(archive)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := ioutil.ReadFile(ignoreFile)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ignoreRulesPath(archive), data, 0644)
+}
+
+// excludedObjectError returns an error describing why the given object is missing from the given
+// archive if it was excluded by an ignore rule. It returns nil otherwise.
+func excludedObjectError(archive, object string) error {
+	rules, err := readIgnoreRules(ignoreRulesPath(archive))
+	if err != nil {
+		return nil
+	}
+	rule, excluded := rules.excludedBy(object)
+	if !excluded {
+		return nil
+	}
+	return fmt.Errorf("%s was excluded from the build context by the ignore rule %q", object, rule.pattern)
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRulesMatch(t *testing.T) {
+	var testData = []struct {
+		testName string
+		rules    string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{"NoRules", "", "a", false, false},
+		{"Comment", "# a\n", "a", false, false},
+		{"Name", "a\n", "a", false, true},
+		{"NameAnyDepth", "a\n", "dir/a", false, true},
+		{"NameNoMatch", "a\n", "ab", false, false},
+		{"Glob", "*.key\n", "dir/id.key", false, true},
+		{"GlobNoSlash", "*.key\n", "dir/id.pem", false, false},
+		{"Anchored", "/a\n", "a", false, true},
+		{"AnchoredNested", "/a\n", "dir/a", false, false},
+		{"Relative", "dir/a\n", "dir/a", false, true},
+		{"RelativeAnchored", "dir/a\n", "other/dir/a", false, false},
+		{"DirOnly", "out/\n", "out", true, true},
+		{"DirOnlyFile", "out/\n", "out", false, false},
+		{"LeadingDoubleStar", "**/a\n", "x/y/a", false, true},
+		{"MiddleDoubleStar", "a/**/b\n", "a/b", false, true},
+		{"MiddleDoubleStarNested", "a/**/b\n", "a/x/y/b", false, true},
+		{"TrailingDoubleStar", "a/**\n", "a/b/c", false, true},
+		{"TrailingDoubleStarDir", "a/**\n", "a", true, false},
+		{"Negate", "*.key\n!test.key\n", "test.key", false, false},
+		{"NegateThenExclude", "!test.key\n*.key\n", "test.key", false, true},
+		{"EscapedHash", "\\#a\n", "#a", false, true},
+		{"EscapedBang", "\\!a\n", "!a", false, true},
+		{"TrailingSpace", "a \n", "a", false, true},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			rules, err := parseIgnoreRules(strings.NewReader(input.rules), "ignore")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, got := rules.match(input.path, input.isDir); got != input.want {
+				t.Errorf("match(%q, %v) with rules %q = %v; want %v", input.path, input.isDir, input.rules, got, input.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreRulesExcludedBy(t *testing.T) {
+	rules, err := parseIgnoreRules(strings.NewReader("out/\n*.key\n!keep.key\n"), "ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testData = []struct {
+		object string
+		want   string
+	}{
+		{"main.sh", ""},
+		{"out/main.sh", "out/"},
+		{"dir/out/main.sh", "out/"},
+		{"dir/id.key", "*.key"},
+		{"keep.key", ""},
+		{"out/keep.key", "out/"},
+	}
+	for _, input := range testData {
+		got := ""
+		if rule, excluded := rules.excludedBy(input.object); excluded {
+			got = rule.pattern
+		}
+		if got != input.want {
+			t.Errorf("excludedBy(%q): got rule %q, want %q", input.object, got, input.want)
+		}
+	}
+}
+
+func TestParseIgnoreRulesInvalid(t *testing.T) {
+	for _, rules := range []string{"/\n", "!/\n", "[a\n"} {
+		if _, err := parseIgnoreRules(strings.NewReader(rules), "ignore"); err == nil {
+			t.Errorf("parseIgnoreRules(%q) = nil; want error", rules)
+		}
+	}
+}
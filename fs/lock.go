@@ -0,0 +1,109 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockPollInterval is how often a held lock is retried while waiting for it.
+var lockPollInterval = 100 * time.Millisecond
+
+// Lock is an advisory lock on the persistent directory. It is held by a cos-customizer process
+// while it reads or modifies the persistent directory, so that concurrent processes do not
+// interleave their changes.
+type Lock struct {
+	file *os.File
+}
+
+// lockFile gets the path of the file used to lock the persistent directory. The file is next to
+// the persistent directory rather than in it, since the persistent directory is created and
+// deleted while the lock is held.
+func (f *Files) lockFile() string {
+	return filepath.Clean(f.persistentDir) + ".lock"
+}
+
+// Lock takes an exclusive lock on the persistent directory. If another process holds the lock,
+// Lock retries until the given timeout expires, and then returns an error. A zero timeout fails
+// immediately if the lock is held. The lock is released when the process exits.
+func (f *Files) Lock(timeout time.Duration) (*Lock, error) {
+	lockFile := f.lockFile()
+	if err := os.MkdirAll(filepath.Dir(lockFile), 0774); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("cannot lock %s: %v", lockFile, err)
+		}
+		if !time.Now().Before(deadline) {
+			holder := "another cos-customizer process"
+			if pid := lockHolder(file); pid != 0 {
+				holder = fmt.Sprintf("%s (pid %d)", holder, pid)
+			}
+			file.Close()
+			if timeout == 0 {
+				return nil, fmt.Errorf("%s is using %s; retry after it finishes, or set -lock-timeout to wait for it",
+					holder, f.persistentDir)
+			}
+			return nil, fmt.Errorf("%s is still using %s after waiting %v", holder, f.persistentDir, timeout)
+		}
+		time.Sleep(lockPollInterval)
+	}
+	// Record the process that holds the lock, for the errors of processes that wait for it.
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{file}, nil
+}
+
+// lockHolder gets the PID recorded in the given lock file. It returns 0 if no PID is recorded.
+func lockHolder(file *os.File) int {
+	data, err := ioutil.ReadAll(io.NewSectionReader(file, 0, 64))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
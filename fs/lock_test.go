@@ -0,0 +1,116 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	files := &Files{persistentDir: filepath.Join(tmpDir, "workdir")}
+	lock, err := files.Lock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := files.Lock(0); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+		t.Errorf("Lock(0) while locked = %v; want an error naming pid %d", err, os.Getpid())
+	}
+	if _, err := files.Lock(200 * time.Millisecond); err == nil {
+		t.Errorf("Lock(200ms) while locked = nil; want error")
+	}
+	go func(lock *Lock) {
+		time.Sleep(200 * time.Millisecond)
+		lock.Unlock()
+	}(lock)
+	lock, err = files.Lock(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Lock(10s) after unlock: %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	// Removing the persistent directory does not affect the lock.
+	if err := files.CleanupAllPersistent(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(files.lockFile()); err != nil {
+		t.Errorf("CleanupAllPersistent(): lock file: %v; want it to exist", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "file")
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, 0600, func(w io.Writer) error {
+		_, err := io.WriteString(w, "new")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new" {
+		t.Errorf("WriteFileAtomic(%s, _, _): got contents %q, want %q", path, string(got), "new")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("WriteFileAtomic(%s, 0600, _): got mode %v, want 0600", path, info.Mode().Perm())
+	}
+	if err := WriteFileAtomic(path, 0600, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("write failed")
+	}); err == nil {
+		t.Errorf("WriteFileAtomic(%s, _, _) with failed write = nil; want error", path)
+	}
+	got, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new" {
+		t.Errorf("WriteFileAtomic(%s, _, _) with failed write: got contents %q, want %q", path, string(got), "new")
+	}
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("WriteFileAtomic(%s, _, _): got %d files in %s, want 1", path, len(entries), tmpDir)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	formatTar   = "tar"
+	formatTarGz = "tar.gz"
+	formatZip   = "zip"
+)
+
+// prepackagedFormat gets the archive format of a prepackaged build context from its file name. It
+// returns the empty string if the file is not a prepackaged build context.
+func prepackagedFormat(src string) string {
+	name := strings.ToLower(src)
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return formatTar
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return formatTarGz
+	case strings.HasSuffix(name, ".zip"):
+		return formatZip
+	default:
+		return ""
+	}
+}
+
+// prepackagedEntryName converts the name of an entry in a prepackaged build context to the name of
+// the entry in the build context archive. The returned bool is false for entries that refer to
+// the root of the build context, which are not archived.
+func prepackagedEntryName(name string, isDir bool) (string, bool, error) {
+	cleaned := path.Clean(name)
+	switch {
+	case path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../"):
+		return "", false, fmt.Errorf("entry %q is outside of the build context", name)
+	case cleaned == ".":
+		return "", false, nil
+	case isDir:
+		return cleaned + "/", true, nil
+	default:
+		return cleaned, true, nil
+	}
+}
+
+// copyPrepackagedEntry writes the given header to the given tar writer and copies the entry contents
+// from the given reader, unless the entry is excluded by the given ignore rules.
+func copyPrepackagedEntry(tarWriter *tar.Writer, hdr *tar.Header, r io.Reader, rules ignoreRules) error {
+	name, ok, err := prepackagedEntryName(hdr.Name, hdr.Typeflag == tar.TypeDir)
+	if err != nil || !ok {
+		return err
+	}
+	if _, excluded := rules.excludedBy(name); excluded {
+		return nil
+	}
+	hdr.Name = name
+	hdr.Format = tar.FormatUnknown
+	hdr.PAXRecords = nil
+	hdr.Xattrs = nil
+	normalizeHeader(hdr)
+	if err := tarWriter.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	_, err = io.Copy(tarWriter, r)
+	return err
+}
+
+// tarPrepackaged writes an archive that contains the contents of the given prepackaged build
+// context. Entries are written in the order of the prepackaged build context.
+func tarPrepackaged(tarWriter *tar.Writer, src string, rules ignoreRules) error {
+	var err error
+	switch prepackagedFormat(src) {
+	case formatZip:
+		err = copyZip(tarWriter, src, rules)
+	default:
+		err = copyTar(tarWriter, src, rules)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read prepackaged build context %s: %v", src, err)
+	}
+	return nil
+}
+
+// copyTar copies the entries of the given .tar, .tar.gz or .tgz file to the given tar writer.
+func copyTar(tarWriter *tar.Writer, src string, rules ignoreRules) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if prepackagedFormat(src) == formatTarGz {
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	}
+	tarReader := tar.NewReader(r)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			hdr.Typeflag = tar.TypeReg
+		case tar.TypeDir, tar.TypeSymlink:
+		default:
+			return fmt.Errorf("entry %q has unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err := copyPrepackagedEntry(tarWriter, hdr, tarReader, rules); err != nil {
+			return err
+		}
+	}
+}
+
+// copyZip copies the entries of the given .zip file to the given tar writer.
+func copyZip(tarWriter *tar.Writer, src string, rules ignoreRules) error {
+	zipReader, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+	for _, f := range zipReader.File {
+		if err := copyZipEntry(tarWriter, f, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyZipEntry copies the given .zip file entry to the given tar writer.
+func copyZipEntry(tarWriter *tar.Writer, f *zip.File, rules ignoreRules) error {
+	info := f.FileInfo()
+	if !info.Mode().IsRegular() && !info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("entry %q has unsupported type %v", f.Name, info.Mode().Type())
+	}
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		// Zip files store the targets of symlinks as their contents.
+		target, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		link = string(target)
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = f.Name
+	return copyPrepackagedEntry(tarWriter, hdr, r, rules)
+}
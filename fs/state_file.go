@@ -16,11 +16,13 @@ package fs
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // BuildContext represents the different types of build contexts that are understood
@@ -32,15 +34,124 @@ const (
 	User BuildContext = "user"
 	// Builtin represents the builtin build context.
 	Builtin BuildContext = "builtin"
+
+	// UserEnvFilePrefix is the name prefix of environment files created for user steps.
+	// These files are stored in the persistent builtin build context.
+	UserEnvFilePrefix = "user_env_"
+	// CopyFileEnvFilePrefix is the name prefix of environment files created for copy-file steps.
+	CopyFileEnvFilePrefix = "copy_file_env_"
+	// PreloadImagesEnvFilePrefix is the name prefix of environment files created for
+	// preload-container-images steps.
+	PreloadImagesEnvFilePrefix = "preload_container_images_env_"
+
+	// BuildEnvFile is the name of the environment file that is sourced before every user step. It is
+	// stored in the persistent builtin build context.
+	BuildEnvFile = "build_env"
+
+	// ExecInterpreter is the interpreter of state file entries whose scripts are executed directly,
+	// which requires the script to be executable. The kernel then honors the script's shebang line.
+	ExecInterpreter = "exec"
 )
 
-type stateFileEntry struct {
-	buildContext BuildContext
-	script       string
-	env          string
+// StepType represents the different types of steps that are understood by the system.
+type StepType string
+
+const (
+	// ScriptStep represents a step that runs a script from a build context.
+	ScriptStep StepType = "script"
+
+	// StateFileVersion is the version of the state file format written by this package. Each
+	// entry is a JSON object on its own line. Entries without a version are in the legacy format,
+	// in which each entry is a line of tab-separated fields.
+	StateFileVersion = 2
+)
+
+// StateFileEntry is a single instruction in the state file.
+type StateFileEntry struct {
+	// ID identifies the entry in the state file. IDs are assigned when entries are added to the
+	// state file and do not change when entries are moved.
+	ID int
+	// Type is the type of the step. Empty means ScriptStep.
+	Type StepType
+	// BuildContext is the build context that contains the script.
+	BuildContext BuildContext
+	// Script is the path of the script to run, relative to the build context.
+	Script string
+	// Args are the arguments passed to the script.
+	Args []string
+	// Env is the name of the environment file to source before running the script.
+	// The environment file is stored in the builtin build context. Empty if there is no
+	// environment file.
+	Env string
+	// Timeout bounds the run time of each attempt to run the script. Zero means no timeout.
+	Timeout time.Duration
+	// Retries is the number of times the script is run again after a failed attempt.
+	Retries int
+	// AllowFailure indicates that the build continues if all attempts to run the script fail.
+	AllowFailure bool
+	// Interpreter is the absolute path of the program that runs the script, or ExecInterpreter if the
+	// script is executed directly. Empty means that the script is run with /bin/bash.
+	Interpreter string
+}
+
+// stateFileRecord is the JSON encoding of a state file entry.
+type stateFileRecord struct {
+	Version      int          `json:"version"`
+	ID           int          `json:"id"`
+	Type         StepType     `json:"type"`
+	BuildContext BuildContext `json:"buildContext"`
+	Script       string       `json:"script"`
+	Args         []string     `json:"args,omitempty"`
+	Env          string       `json:"env,omitempty"`
+	TimeoutSec   float64      `json:"timeoutSec,omitempty"`
+	Retries      int          `json:"retries,omitempty"`
+	AllowFailure bool         `json:"allowFailure,omitempty"`
+	Interpreter  string       `json:"interpreter,omitempty"`
 }
 
-func parseStateFileEntry(data string) (*stateFileEntry, error) {
+// parseStateFileEntry parses a state file entry in either the current or the legacy format.
+func parseStateFileEntry(data string) (*StateFileEntry, error) {
+	if !strings.HasPrefix(data, "{") {
+		return parseLegacyStateFileEntry(data)
+	}
+	record := &stateFileRecord{}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(record); err != nil {
+		return nil, fmt.Errorf("cannot parse state file entry: %v", err)
+	}
+	if record.Version != StateFileVersion {
+		return nil, fmt.Errorf("unsupported state file entry version %d; want %d", record.Version, StateFileVersion)
+	}
+	if record.ID <= 0 {
+		return nil, fmt.Errorf("state file entry ID must be positive; got %d", record.ID)
+	}
+	if record.Type != ScriptStep {
+		return nil, fmt.Errorf("unsupported step type %q", record.Type)
+	}
+	if record.BuildContext != User && record.BuildContext != Builtin {
+		return nil, fmt.Errorf("invalid build context %q", record.BuildContext)
+	}
+	if record.TimeoutSec < 0 || record.Retries < 0 {
+		return nil, fmt.Errorf("timeout and retries must not be negative; got %v and %d", record.TimeoutSec, record.Retries)
+	}
+	return &StateFileEntry{
+		ID:           record.ID,
+		Type:         record.Type,
+		BuildContext: record.BuildContext,
+		Script:       record.Script,
+		Args:         record.Args,
+		Env:          record.Env,
+		Timeout:      time.Duration(record.TimeoutSec * float64(time.Second)),
+		Retries:      record.Retries,
+		AllowFailure: record.AllowFailure,
+		Interpreter:  record.Interpreter,
+	}, nil
+}
+
+// parseLegacyStateFileEntry parses a state file entry in the legacy format, which has 3 fields: the
+// build context, the script and the environment file. Legacy entries do not have an ID.
+func parseLegacyStateFileEntry(data string) (*StateFileEntry, error) {
 	split := strings.Split(data, "\t")
 	if len(split) != 3 {
 		return nil, fmt.Errorf("did not find 3 elements in state file entry")
@@ -48,11 +159,43 @@ func parseStateFileEntry(data string) (*stateFileEntry, error) {
 	if split[0] != string(User) && split[0] != string(Builtin) {
 		return nil, fmt.Errorf("first field must be a valid build context")
 	}
-	return &stateFileEntry{BuildContext(split[0]), split[1], split[2]}, nil
+	return &StateFileEntry{Type: ScriptStep, BuildContext: BuildContext(split[0]), Script: split[1], Env: split[2]}, nil
+}
+
+// format encodes the entry as a line of the state file.
+func (s *StateFileEntry) format() (string, error) {
+	record := &stateFileRecord{
+		Version:      StateFileVersion,
+		ID:           s.ID,
+		Type:         s.Type,
+		BuildContext: s.BuildContext,
+		Script:       s.Script,
+		Args:         s.Args,
+		Env:          s.Env,
+		TimeoutSec:   s.Timeout.Seconds(),
+		Retries:      s.Retries,
+		AllowFailure: s.AllowFailure,
+		Interpreter:  s.Interpreter,
+	}
+	if record.Type == "" {
+		record.Type = ScriptStep
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
 }
 
-func (s *stateFileEntry) format() string {
-	return fmt.Sprintf("%s\t%s\t%s\n", s.buildContext, s.script, s.env)
+// nextStateFileID gets an ID that is not used by any of the given entries.
+func nextStateFileID(entries []*StateFileEntry) int {
+	maxID := 0
+	for _, entry := range entries {
+		if entry.ID > maxID {
+			maxID = entry.ID
+		}
+	}
+	return maxID + 1
 }
 
 // CreateStateFile creates the state file.
@@ -71,36 +214,186 @@ func CreateStateFile(files *Files) error {
 // AppendStateFile appends an entry to the state file.
 // The state file encodes a sequence of scripts to run on the preload instance.
 func AppendStateFile(stateFile string, buildContext BuildContext, script string, env string) error {
-	record := fmt.Sprint((&stateFileEntry{buildContext, script, env}).format())
+	return AppendStateFileEntry(stateFile, &StateFileEntry{BuildContext: buildContext, Script: script, Env: env})
+}
+
+// AppendStateFileEntry appends the given entry to the state file. If the entry does not have an ID,
+// it is assigned one.
+func AppendStateFileEntry(stateFile string, entry *StateFileEntry) error {
+	entries, err := ReadStateFile(stateFile)
+	if err != nil {
+		return err
+	}
+	if entry.ID == 0 {
+		entry.ID = nextStateFileID(entries)
+	}
+	line, err := entry.format()
+	if err != nil {
+		return err
+	}
 	writer, err := os.OpenFile(stateFile, os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		return err
 	}
 	defer writer.Close()
-	_, err = io.WriteString(writer, record)
+	_, err = io.WriteString(writer, line)
 	return err
 }
 
-// StateFileContains checks if an entry exists in the state file with the given build context
-// and the given script name.
-func StateFileContains(stateFile string, buildContext BuildContext, script string) (bool, error) {
+// ReadStateFile reads all of the entries in the state file, in the order in which
+// they will be executed. Entries in the legacy format are assigned IDs that are not used by
+// any other entry.
+func ReadStateFile(stateFile string) ([]*StateFileEntry, error) {
 	f, err := os.Open(stateFile)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer f.Close()
+	var entries []*StateFileEntry
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		entry, err := parseStateFileEntry(scanner.Text())
 		if err != nil {
-			return false, err
-		}
-		if entry.buildContext == buildContext && entry.script == script {
-			return true, nil
+			return nil, err
 		}
+		entries = append(entries, entry)
 	}
 	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.ID == 0 {
+			entry.ID = nextStateFileID(entries)
+		}
+	}
+	return entries, nil
+}
+
+// StateFileContains checks if an entry exists in the state file with the given build context
+// and the given script name.
+func StateFileContains(stateFile string, buildContext BuildContext, script string) (bool, error) {
+	entries, err := ReadStateFile(stateFile)
+	if err != nil {
 		return false, err
 	}
+	for _, entry := range entries {
+		if entry.BuildContext == buildContext && entry.Script == script {
+			return true, nil
+		}
+	}
 	return false, nil
 }
+
+// writeStateFile atomically replaces the contents of the state file with the given entries.
+func writeStateFile(stateFile string, entries []*StateFileEntry) error {
+	info, err := os.Stat(stateFile)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(stateFile, info.Mode(), func(w io.Writer) error {
+		for _, entry := range entries {
+			line, err := entry.format()
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkStateFileIndex checks that the given zero-based index refers to an entry in the state file.
+func checkStateFileIndex(entries []*StateFileEntry, index int) error {
+	if index < 0 || index >= len(entries) {
+		return fmt.Errorf("step %d does not exist; the state file has %d steps", index+1, len(entries))
+	}
+	return nil
+}
+
+// RemoveStateFileEntry removes the entry at the given zero-based index from the state file.
+// Environment files that are no longer referenced by the state file are deleted.
+func RemoveStateFileEntry(files *Files, index int) error {
+	entries, err := ReadStateFile(files.StateFile)
+	if err != nil {
+		return err
+	}
+	if err := checkStateFileIndex(entries, index); err != nil {
+		return err
+	}
+	entries = append(entries[:index], entries[index+1:]...)
+	if err := writeStateFile(files.StateFile, entries); err != nil {
+		return err
+	}
+	return CleanupOrphanedEnvFiles(files)
+}
+
+// MoveStateFileEntry moves the entry at the zero-based index 'from' so that it ends up at the
+// zero-based index 'to'.
+func MoveStateFileEntry(stateFile string, from, to int) error {
+	entries, err := ReadStateFile(stateFile)
+	if err != nil {
+		return err
+	}
+	if err := checkStateFileIndex(entries, from); err != nil {
+		return err
+	}
+	if err := checkStateFileIndex(entries, to); err != nil {
+		return err
+	}
+	entry := entries[from]
+	entries = append(entries[:from], entries[from+1:]...)
+	entries = append(entries[:to], append([]*StateFileEntry{entry}, entries[to:]...)...)
+	return writeStateFile(stateFile, entries)
+}
+
+// InsertStateFileEntry inserts the given entry into the state file so that it ends up at the given
+// zero-based index. An index equal to the number of entries appends the entry. If the entry does not
+// have an ID, it is assigned one.
+func InsertStateFileEntry(stateFile string, index int, entry *StateFileEntry) error {
+	entries, err := ReadStateFile(stateFile)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index > len(entries) {
+		return fmt.Errorf("cannot insert at step %d; the state file has %d steps", index+1, len(entries))
+	}
+	if entry.ID == 0 {
+		entry.ID = nextStateFileID(entries)
+	}
+	entries = append(entries[:index], append([]*StateFileEntry{entry}, entries[index:]...)...)
+	return writeStateFile(stateFile, entries)
+}
+
+// envFilePrefixes are the name prefixes of the environment files of steps.
+var envFilePrefixes = []string{UserEnvFilePrefix, CopyFileEnvFilePrefix, PreloadImagesEnvFilePrefix}
+
+// CleanupOrphanedEnvFiles deletes the environment files of steps in the persistent builtin build
+// context that are not referenced by any entry in the state file.
+func CleanupOrphanedEnvFiles(files *Files) error {
+	entries, err := ReadStateFile(files.StateFile)
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Env != "" {
+			referenced[entry.Env] = true
+		}
+	}
+	for _, prefix := range envFilePrefixes {
+		envFiles, err := filepath.Glob(filepath.Join(files.PersistBuiltinBuildContext, prefix+"*"))
+		if err != nil {
+			return err
+		}
+		for _, envFile := range envFiles {
+			if !referenced[filepath.Base(envFile)] {
+				if err := os.Remove(envFile); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -15,11 +15,24 @@
 package fs
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
+// jsonEntry formats a state file entry for a script step without run options in the current format.
+func jsonEntry(id int, buildContext BuildContext, script, env string) string {
+	line := fmt.Sprintf(`{"version":2,"id":%d,"type":"script","buildContext":"%s","script":"%s"`, id, buildContext, script)
+	if env != "" {
+		line += fmt.Sprintf(`,"env":"%s"`, env)
+	}
+	return line + "}\n"
+}
+
 func TestCreateStateFileDoesntExist(t *testing.T) {
 	tmpFile, err := ioutil.TempFile("", "")
 	if err != nil {
@@ -64,9 +77,12 @@ func TestAppendStateFile(t *testing.T) {
 		stateFile string
 		expected  string
 	}{
-		{"WithEnv", User, "script", "env", "", "user\tscript\tenv\n"},
-		{"NoEnv", Builtin, "script", "", "", "builtin\tscript\t\n"},
-		{"NotEmpty", User, "script", "", "builtin\tscript\tenv\n", "builtin\tscript\tenv\nuser\tscript\t\n"},
+		{"WithEnv", User, "script", "env", "", jsonEntry(1, User, "script", "env")},
+		{"NoEnv", Builtin, "script", "", "", jsonEntry(1, Builtin, "script", "")},
+		{"NotEmpty", User, "script", "", jsonEntry(1, Builtin, "script", "env"),
+			jsonEntry(1, Builtin, "script", "env") + jsonEntry(2, User, "script", "")},
+		{"NotEmptyLegacy", User, "script", "", "builtin\tscript\tenv\n",
+			"builtin\tscript\tenv\n" + jsonEntry(2, User, "script", "")},
 	}
 	for _, input := range testAppendStateFileData {
 		t.Run(input.testName, func(t *testing.T) {
@@ -140,3 +156,315 @@ func TestStateFileContains(t *testing.T) {
 		})
 	}
 }
+
+func TestAppendStateFileEntry(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entry := &StateFileEntry{
+		Type:         ScriptStep,
+		BuildContext: User,
+		Script:       "script",
+		Args:         []string{"a b", "c"},
+		Env:          "env",
+		Timeout:      1500 * time.Millisecond,
+		Retries:      3,
+	}
+	if err := AppendStateFileEntry(tmpFile.Name(), entry); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadFile(tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"version":2,"id":1,"type":"script","buildContext":"user","script":"script","args":["a b","c"],` +
+		`"env":"env","timeoutSec":1.5,"retries":3}` + "\n"
+	if string(actual) != want {
+		t.Errorf("AppendStateFileEntry(%v): got %q, want %q", entry, string(actual), want)
+	}
+	entries, err := ReadStateFile(tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !reflect.DeepEqual(entries[0], entry) {
+		t.Errorf("ReadStateFile after AppendStateFileEntry(%v): got %v", entry, entries)
+	}
+}
+
+func TestReadStateFile(t *testing.T) {
+	testReadStateFileData := []struct {
+		testName  string
+		stateFile string
+		expected  []*StateFileEntry
+	}{
+		{"EmptyFile", "", nil},
+		{
+			"OneEntry",
+			jsonEntry(1, User, "script", ""),
+			[]*StateFileEntry{{ID: 1, Type: ScriptStep, BuildContext: User, Script: "script"}},
+		},
+		{
+			"AllFields",
+			`{"version":2,"id":3,"type":"script","buildContext":"user","script":"script","args":["a"],"env":"user_env_1",` +
+				`"timeoutSec":90,"retries":2,"allowFailure":true,"interpreter":"exec"}` + "\n",
+			[]*StateFileEntry{{
+				ID:           3,
+				Type:         ScriptStep,
+				BuildContext: User,
+				Script:       "script",
+				Args:         []string{"a"},
+				Env:          "user_env_1",
+				Timeout:      90 * time.Second,
+				Retries:      2,
+				AllowFailure: true,
+				Interpreter:  ExecInterpreter,
+			}},
+		},
+		{
+			"LegacyOneEntry",
+			"user\tscript\t\n",
+			[]*StateFileEntry{{ID: 1, Type: ScriptStep, BuildContext: User, Script: "script"}},
+		},
+		{
+			"LegacyTwoEntries",
+			"user\tscript\tuser_env_1\nbuiltin\tinstall_gpu.sh\t\n",
+			[]*StateFileEntry{
+				{ID: 1, Type: ScriptStep, BuildContext: User, Script: "script", Env: "user_env_1"},
+				{ID: 2, Type: ScriptStep, BuildContext: Builtin, Script: "install_gpu.sh"},
+			},
+		},
+		{
+			"Mixed",
+			"user\ta\t\n" + jsonEntry(1, User, "b", ""),
+			[]*StateFileEntry{
+				{ID: 2, Type: ScriptStep, BuildContext: User, Script: "a"},
+				{ID: 1, Type: ScriptStep, BuildContext: User, Script: "b"},
+			},
+		},
+	}
+	for _, input := range testReadStateFileData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpFile, err := ioutil.TempFile("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpFile.Name())
+			if _, err := tmpFile.WriteString(input.stateFile); err != nil {
+				tmpFile.Close()
+				t.Fatal(err)
+			}
+			if err := tmpFile.Close(); err != nil {
+				t.Fatal(err)
+			}
+			actual, err := ReadStateFile(tmpFile.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, input.expected) {
+				t.Errorf("actual: %v expected: %v", actual, input.expected)
+			}
+		})
+	}
+}
+
+func TestReadStateFileInvalid(t *testing.T) {
+	testData := []struct {
+		testName  string
+		stateFile string
+	}{
+		{"InvalidContext", "other\tscript\t\n"},
+		{"TooFewFields", "user\tscript\n"},
+		{"TooManyFields", "user\tscript\t\t90\t2\ttrue\n"},
+		{"UnsupportedVersion", `{"version":3,"id":1,"type":"script","buildContext":"user","script":"script"}` + "\n"},
+		{"UnknownField", `{"version":2,"id":1,"type":"script","buildContext":"user","script":"script","x":1}` + "\n"},
+		{"UnknownType", `{"version":2,"id":1,"type":"other","buildContext":"user","script":"script"}` + "\n"},
+		{"MissingID", `{"version":2,"type":"script","buildContext":"user","script":"script"}` + "\n"},
+		{"InvalidJSONContext", `{"version":2,"id":1,"type":"script","buildContext":"other","script":"script"}` + "\n"},
+		{"MalformedJSON", `{"version":2` + "\n"},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpFile, err := ioutil.TempFile("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(tmpFile.Name())
+			if _, err := tmpFile.WriteString(input.stateFile); err != nil {
+				tmpFile.Close()
+				t.Fatal(err)
+			}
+			if err := tmpFile.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ReadStateFile(tmpFile.Name()); err == nil {
+				t.Errorf("ReadStateFile(%q); got nil, want error", input.stateFile)
+			}
+		})
+	}
+}
+
+func writeTestStateFile(dir, contents string) (string, error) {
+	stateFile := filepath.Join(dir, "state_file")
+	if err := ioutil.WriteFile(stateFile, []byte(contents), 0666); err != nil {
+		return "", err
+	}
+	return stateFile, nil
+}
+
+func TestMoveStateFileEntry(t *testing.T) {
+	testMoveStateFileEntryData := []struct {
+		testName string
+		from     int
+		to       int
+		expected string
+	}{
+		{"Forward", 0, 2, jsonEntry(2, User, "b", "") + jsonEntry(3, User, "c", "") + jsonEntry(1, User, "a", "")},
+		{"Backward", 2, 0, jsonEntry(3, User, "c", "") + jsonEntry(1, User, "a", "") + jsonEntry(2, User, "b", "")},
+		{"Same", 1, 1, jsonEntry(1, User, "a", "") + jsonEntry(2, User, "b", "") + jsonEntry(3, User, "c", "")},
+	}
+	for _, input := range testMoveStateFileEntryData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			stateFile, err := writeTestStateFile(tmpDir, "user\ta\t\nuser\tb\t\nuser\tc\t\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := MoveStateFileEntry(stateFile, input.from, input.to); err != nil {
+				t.Fatal(err)
+			}
+			actual, err := ioutil.ReadFile(stateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(actual) != input.expected {
+				t.Errorf("actual: %q expected: %q", string(actual), input.expected)
+			}
+			leftover, err := filepath.Glob(filepath.Join(tmpDir, ".state_file-*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(leftover) != 0 {
+				t.Errorf("temporary files left behind: %v", leftover)
+			}
+		})
+	}
+}
+
+func TestMoveStateFileEntryOutOfRange(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	stateFile, err := writeTestStateFile(tmpDir, "user\ta\t\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MoveStateFileEntry(stateFile, 0, 1); err == nil {
+		t.Errorf("MoveStateFileEntry(_, 0, 1) on 1 entry; got nil, want error")
+	}
+}
+
+func TestInsertStateFileEntry(t *testing.T) {
+	testInsertStateFileEntryData := []struct {
+		testName  string
+		index     int
+		stateFile string
+		expected  string
+		expectErr bool
+	}{
+		{"Empty", 0, "", jsonEntry(1, User, "new", "env"), false},
+		{"Front", 0, "user\ta\t\n", jsonEntry(2, User, "new", "env") + jsonEntry(1, User, "a", ""), false},
+		{
+			"Middle",
+			1,
+			"user\ta\t\nuser\tb\t\n",
+			jsonEntry(1, User, "a", "") + jsonEntry(3, User, "new", "env") + jsonEntry(2, User, "b", ""),
+			false,
+		},
+		{"End", 1, "user\ta\t\n", jsonEntry(1, User, "a", "") + jsonEntry(2, User, "new", "env"), false},
+		{"OutOfRange", 2, "user\ta\t\n", "user\ta\t\n", true},
+	}
+	for _, input := range testInsertStateFileEntryData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			stateFile, err := writeTestStateFile(tmpDir, input.stateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = InsertStateFileEntry(stateFile, input.index, &StateFileEntry{BuildContext: User, Script: "new", Env: "env"})
+			if gotErr := err != nil; gotErr != input.expectErr {
+				t.Fatalf("InsertStateFileEntry(_, %d, ...) = %v; want error: %t", input.index, err, input.expectErr)
+			}
+			actual, err := ioutil.ReadFile(stateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(actual) != input.expected {
+				t.Errorf("actual: %q expected: %q", string(actual), input.expected)
+			}
+		})
+	}
+}
+
+func TestRemoveStateFileEntry(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	stateFile, err := writeTestStateFile(tmpDir, "user\ta\tuser_env_a\nuser\tb\tuser_env_b\nbuiltin\tc\tcopy_file_env_c\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := &Files{StateFile: stateFile, PersistBuiltinBuildContext: filepath.Join(tmpDir, "builtin")}
+	if err := os.Mkdir(files.PersistBuiltinBuildContext, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"user_env_a", "user_env_b", "user_env_orphan", "copy_file_env_c", "copy_file_env_orphan",
+		"preload_container_images_env_orphan", "other"} {
+		if err := ioutil.WriteFile(filepath.Join(files.PersistBuiltinBuildContext, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RemoveStateFileEntry(files, 0); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := jsonEntry(2, User, "b", "user_env_b") + jsonEntry(3, Builtin, "c", "copy_file_env_c"); string(actual) != expected {
+		t.Errorf("actual: %q expected: %q", string(actual), expected)
+	}
+	for name, wantExists := range map[string]bool{
+		"user_env_a":                          false,
+		"user_env_b":                          true,
+		"user_env_orphan":                     false,
+		"copy_file_env_c":                     true,
+		"copy_file_env_orphan":                false,
+		"preload_container_images_env_orphan": false,
+		"other":                               true,
+	} {
+		_, err := os.Stat(filepath.Join(files.PersistBuiltinBuildContext, name))
+		if gotExists := !os.IsNotExist(err); gotExists != wantExists {
+			t.Errorf("RemoveStateFileEntry(_, 0): %s exists: got %t, want %t", name, gotExists, wantExists)
+		}
+	}
+	if err := RemoveStateFileEntry(files, 2); err == nil {
+		t.Errorf("RemoveStateFileEntry(_, 2) on 2 entries; got nil, want error")
+	}
+}
@@ -68,6 +68,20 @@ func buildDeprecationStatus(replacement string, deleteTime time.Time) *compute.D
 }
 
 func waitForOp(svc *compute.Service, project string, op *compute.Operation, deadline time.Time, t *timePkg) error {
+	return pollOp(op, deadline, t, func(name string) (*compute.Operation, error) {
+		return svc.GlobalOperations.Get(project, name).Do()
+	})
+}
+
+func waitForZoneOp(svc *compute.Service, project, zone string, op *compute.Operation, t *timePkg) error {
+	return pollOp(op, t.Now().Add(defaultOperationTimeout), t, func(name string) (*compute.Operation, error) {
+		return svc.ZoneOperations.Get(project, zone, name).Do()
+	})
+}
+
+// pollOp waits for the given operation to finish. The given function gets the current state of an
+// operation by name.
+func pollOp(op *compute.Operation, deadline time.Time, t *timePkg, get func(string) (*compute.Operation, error)) error {
 	if op.Error != nil {
 		return fmt.Errorf("error with operation. name: %s error: %v", op.Name, op.Error)
 	}
@@ -76,7 +90,7 @@ func waitForOp(svc *compute.Service, project string, op *compute.Operation, dead
 	}
 	for {
 		t.Sleep(defaultRetryInterval)
-		op, err := svc.GlobalOperations.Get(project, op.Name).Do()
+		op, err := get(op.Name)
 		if err != nil {
 			return err
 		}
@@ -151,6 +165,82 @@ func ImageExists(svc *compute.Service, project, name string) (bool, error) {
 	return true, nil
 }
 
+// FindImageByLabel finds an image in the given project that has the given label value. Deprecated
+// images are not considered. If several images have the label value, the most recently created one
+// is returned. It returns nil if no image has the label value.
+func FindImageByLabel(ctx context.Context, svc *compute.Service, project, key, value string) (*compute.Image, error) {
+	filter := fmt.Sprintf("labels.%s = %s", key, value)
+	var found *compute.Image
+	err := svc.Images.List(project).Filter(filter).Pages(ctx, func(imageList *compute.ImageList) error {
+		for _, image := range imageList.Items {
+			if image.Labels[key] != value || image.Deprecated != nil {
+				continue
+			}
+			if found == nil || image.CreationTimestamp > found.CreationTimestamp {
+				found = image
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+func setImageFamily(svc *compute.Service, project, name, family string, t *timePkg) error {
+	op, err := svc.Images.Patch(project, name, &compute.Image{Family: family}).Do()
+	if err != nil {
+		return err
+	}
+	return waitForOps(svc, project, []*compute.Operation{op}, t)
+}
+
+// SetImageFamily adds an existing image to the given image family. The image is removed from the
+// family it was in before.
+func SetImageFamily(svc *compute.Service, project, name, family string) error {
+	return setImageFamily(svc, project, name, family, realTime)
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
+}
+
+func deleteInstance(svc *compute.Service, project, zone, name string, t *timePkg) error {
+	op, err := svc.Instances.Delete(project, zone, name).Do()
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return waitForZoneOp(svc, project, zone, op, t)
+}
+
+// DeleteInstance deletes the given instance and waits for the deletion to finish. Deleting an
+// instance that does not exist is not an error.
+func DeleteInstance(svc *compute.Service, project, zone, name string) error {
+	return deleteInstance(svc, project, zone, name, realTime)
+}
+
+func deleteDisk(svc *compute.Service, project, zone, name string, t *timePkg) error {
+	op, err := svc.Disks.Delete(project, zone, name).Do()
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return waitForZoneOp(svc, project, zone, op, t)
+}
+
+// DeleteDisk deletes the given disk and waits for the deletion to finish. Deleting a disk that does
+// not exist is not an error. A disk cannot be deleted while it is attached to an instance.
+func DeleteDisk(svc *compute.Service, project, zone, name string) error {
+	return deleteDisk(svc, project, zone, name, realTime)
+}
+
 type decodedImageName struct {
 	name        string
 	milestone   int
@@ -307,3 +307,139 @@ func TestResolveMilestone(t *testing.T) {
 		})
 	}
 }
+
+func TestFindImageByLabel(t *testing.T) {
+	testFindImageByLabelData := []struct {
+		testName string
+		images   []*compute.Image
+		expected string
+	}{
+		{
+			"NoImages",
+			nil,
+			"",
+		},
+		{
+			"OtherValue",
+			[]*compute.Image{
+				{Name: "image-1", Labels: map[string]string{"hash": "other"}},
+			},
+			"",
+		},
+		{
+			"Match",
+			[]*compute.Image{
+				{Name: "image-1", Labels: map[string]string{"hash": "other"}},
+				{Name: "image-2", Labels: map[string]string{"hash": "abc"}},
+			},
+			"image-2",
+		},
+		{
+			"IgnoreDeprecated",
+			[]*compute.Image{
+				{Name: "image-1", Labels: map[string]string{"hash": "abc"}, Deprecated: &compute.DeprecationStatus{}},
+			},
+			"",
+		},
+		{
+			"Newest",
+			[]*compute.Image{
+				{Name: "image-1", Labels: map[string]string{"hash": "abc"}, CreationTimestamp: "2020-01-01T00:00:00.000-07:00"},
+				{Name: "image-2", Labels: map[string]string{"hash": "abc"}, CreationTimestamp: "2020-02-01T00:00:00.000-07:00"},
+				{Name: "image-3", Labels: map[string]string{"hash": "abc"}, CreationTimestamp: "2019-12-01T00:00:00.000-07:00"},
+			},
+			"image-2",
+		},
+	}
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	for _, input := range testFindImageByLabelData {
+		t.Run(input.testName, func(t *testing.T) {
+			fakeGCE.Images.Items = input.images
+			image, err := FindImageByLabel(context.Background(), client, "test-project", "hash", "abc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual := ""
+			if image != nil {
+				actual = image.Name
+			}
+			if actual != input.expected {
+				t.Errorf("FindImageByLabel(_, _, test-project, hash, abc) = %q, want: %q", actual, input.expected)
+			}
+		})
+	}
+}
+
+func TestSetImageFamily(t *testing.T) {
+	date := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	fakeGCE.Images.Items = []*compute.Image{{Name: "test-name", Family: "old-family"}}
+	fakeGCE.Operations = []*compute.Operation{{Name: "op-1", Status: "RUNNING"}, {Name: "op-1", Status: "DONE"}}
+	if err := setImageFamily(client, "test-project", "test-name", "new-family", fakeTime(date)); err != nil {
+		t.Fatal(err)
+	}
+	if got := fakeGCE.Images.Items[0].Family; got != "new-family" {
+		t.Errorf("setImageFamily(_, test-project, test-name, new-family, _): family = %q, want: new-family", got)
+	}
+}
+
+func TestDeleteDebugResources(t *testing.T) {
+	testData := []struct {
+		testName      string
+		instances     []*compute.Instance
+		disks         []*compute.Disk
+		operations    []*compute.Operation
+		wantInstances int
+		wantDisks     int
+	}{
+		{
+			"DeleteBoth",
+			[]*compute.Instance{{Name: "vm", Zone: "z"}, {Name: "other", Zone: "z"}},
+			[]*compute.Disk{{Name: "vm", Zone: "z"}},
+			[]*compute.Operation{{Name: "op-1", Status: "RUNNING"}, {Name: "op-1", Status: "DONE"},
+				{Name: "op-2", Status: "DONE"}},
+			1,
+			0,
+		},
+		{
+			"OtherZone",
+			[]*compute.Instance{{Name: "vm", Zone: "other-zone"}},
+			[]*compute.Disk{{Name: "vm", Zone: "other-zone"}},
+			nil,
+			1,
+			1,
+		},
+		{
+			"NotFound",
+			nil,
+			nil,
+			nil,
+			0,
+			0,
+		},
+	}
+	date := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	fakeGCE, client := fakes.GCEForTest(t, "test-project")
+	defer fakeGCE.Close()
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			fakeGCE.Instances = input.instances
+			fakeGCE.Disks = input.disks
+			fakeGCE.Operations = input.operations
+			if err := deleteInstance(client, "test-project", "z", "vm", fakeTime(date)); err != nil {
+				t.Fatalf("deleteInstance(_, test-project, z, vm, _) = %v; want nil", err)
+			}
+			if err := deleteDisk(client, "test-project", "z", "vm", fakeTime(date)); err != nil {
+				t.Fatalf("deleteDisk(_, test-project, z, vm, _) = %v; want nil", err)
+			}
+			if got := len(fakeGCE.Instances); got != input.wantInstances {
+				t.Errorf("deleteInstance(_, test-project, z, vm, _): %d instances left, want %d", got, input.wantInstances)
+			}
+			if got := len(fakeGCE.Disks); got != input.wantDisks {
+				t.Errorf("deleteDisk(_, test-project, z, vm, _): %d disks left, want %d", got, input.wantDisks)
+			}
+		})
+	}
+}
@@ -21,6 +21,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"cos-customizer/cmd"
 	"cos-customizer/fs"
@@ -33,8 +35,18 @@ import (
 	"google.golang.org/api/option"
 )
 
-var persistentDir = flag.String("local-state-workdir", ".cos-customizer-workdir",
-	"Name of the directory in $HOME to use for storing local state.")
+var (
+	persistentDir = flag.String("local-state-workdir", ".cos-customizer-workdir",
+		"Name of the directory in $HOME to use for storing local state.")
+	buildID = flag.String("build-id", fs.DefaultBuildID, "ID of the image build to work on. Image builds "+
+		"with different IDs can be prepared in the same local state workdir.")
+	lockTimeout = flag.Duration("lock-timeout", 0, "How long to wait for other cos-customizer processes "+
+		"that use the local state workdir to finish. By default, fail immediately if the workdir is in use.")
+)
+
+// unlockedCommands do not modify the local state workdir, so they run without locking it.
+var unlockedCommands = map[string]bool{"help": true, "flags": true, "commands": true, "status": true,
+	"list-builds": true, "cleanup-debug-resources": true}
 
 func clients(ctx context.Context, anonymousCreds bool) (*compute.Service, *storage.Client, error) {
 	var httpClient *http.Client
@@ -58,18 +70,62 @@ func clients(ctx context.Context, anonymousCreds bool) (*compute.Service, *stora
 	return svc, gcsClient, nil
 }
 
+// cancelOnSignal returns a context that is cancelled when the process receives SIGINT or SIGTERM, so
+// that running image builds can clean up. A second signal terminates the process immediately.
+func cancelOnSignal(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Printf("Received %v, cancelling. Send it again to exit immediately.\n", sig)
+		cancel()
+	}()
+	return ctx
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	subcommands.Register(subcommands.HelpCommand(), "")
 	subcommands.Register(subcommands.FlagsCommand(), "")
 	subcommands.Register(new(cmd.StartImageBuild), "")
 	subcommands.Register(new(cmd.RunScript), "")
+	subcommands.Register(new(cmd.SetBuildEnv), "")
+	subcommands.Register(new(cmd.CopyFile), "")
+	subcommands.Register(new(cmd.PreloadContainerImages), "")
 	subcommands.Register(new(cmd.InstallGPU), "")
 	subcommands.Register(new(cmd.SealOEM), "")
 	subcommands.Register(new(cmd.FinishImageBuild), "")
+	subcommands.Register(new(cmd.Build), "")
+	subcommands.Register(new(cmd.Status), "")
+	subcommands.Register(new(cmd.RemoveStep), "")
+	subcommands.Register(new(cmd.MoveStep), "")
+	subcommands.Register(new(cmd.InsertStep), "")
+	subcommands.Register(new(cmd.ListBuilds), "")
+	subcommands.Register(new(cmd.AbortBuild), "")
+	subcommands.Register(new(cmd.CleanupDebugResources), "")
 	flag.Parse()
-	ctx := context.Background()
-	files := fs.DefaultFiles(*persistentDir)
+	ctx := cancelOnSignal(context.Background())
+	if err := fs.ValidateBuildID(*buildID); err != nil {
+		log.Println(err)
+		os.Exit(int(subcommands.ExitUsageError))
+	}
+	files := fs.DefaultFiles(*persistentDir, *buildID)
+	var lock *fs.Lock
+	if flag.NArg() > 0 && !unlockedCommands[flag.Arg(0)] {
+		var err error
+		lock, err = files.Lock(*lockTimeout)
+		if err != nil {
+			log.Println(err)
+			os.Exit(int(subcommands.ExitFailure))
+		}
+	}
 	ret := int(subcommands.Execute(ctx, files, cmd.ServiceClients(clients)))
+	if lock != nil {
+		if err := lock.Unlock(); err != nil {
+			log.Println(err)
+		}
+	}
 	os.Exit(ret)
 }
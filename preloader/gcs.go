@@ -16,11 +16,17 @@ package preloader
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"net"
+	"net/http"
 	"path/filepath"
+	"strings"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -28,47 +34,57 @@ const (
 	managedDir = "cos-customizer"
 )
 
-// gcsManager provides a simple key/value interface to a GCS directory, where keys are object paths
-// and values are object data.
-type gcsManager struct {
-	gcsClient         *storage.Client
-	gcsBucket, gcsDir string
+// GCSStore is an ObjectStore in a GCS directory. Objects are stored in a directory managed by
+// cos-customizer inside of the given GCS directory, with a subdirectory for each image build, so
+// that image builds with different build IDs can share a GCS directory.
+type GCSStore struct {
+	gcsClient                  *storage.Client
+	gcsBucket, gcsDir, buildID string
 }
 
-func (m *gcsManager) managedDir() string {
-	return filepath.Join(m.gcsDir, managedDir)
+// NewGCSStore creates a GCSStore for the image build with the given ID in the given GCS bucket and
+// directory. The GCS client may be nil if the store is only used to compute URLs.
+func NewGCSStore(gcsClient *storage.Client, gcsBucket, gcsDir, buildID string) *GCSStore {
+	return &GCSStore{gcsClient, gcsBucket, gcsDir, buildID}
 }
 
-// managedDirURL gets the GCS URL of the directory being managed by the GCSManager.
-func (m *gcsManager) managedDirURL() string {
-	return fmt.Sprintf("gs://%s/%s", m.gcsBucket, m.managedDir())
+func (m *GCSStore) managedDir() string {
+	return filepath.Join(m.gcsDir, managedDir, m.buildID)
 }
 
-func (m *gcsManager) objectPath(name string) string {
+func (m *GCSStore) objectPath(name string) string {
 	return filepath.Join(m.managedDir(), name)
 }
 
-// store stores the given data in the given file. The file should be given as a path
-// relative to the managed directory.
-func (m *gcsManager) store(ctx context.Context, r io.Reader, name string) error {
+// Store implements ObjectStore.Store. It verifies that the checksum of the created object matches
+// the checksum of the uploaded data.
+func (m *GCSStore) Store(ctx context.Context, r io.Reader, name string) error {
 	object := m.objectPath(name)
 	w := m.gcsClient.Bucket(m.gcsBucket).Object(object).NewWriter(ctx)
-	if _, err := io.Copy(w, r); err != nil {
+	h := crc32.New(crc32cTable)
+	if _, err := io.Copy(w, io.TeeReader(r, h)); err != nil {
 		return err
 	}
-	return w.Close()
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if got, want := w.Attrs().CRC32C, h.Sum32(); got != want {
+		return fmt.Errorf("upload of %s is corrupt: the object has CRC32C checksum %08x, but the uploaded data has %08x",
+			m.URL(name), got, want)
+	}
+	return nil
 }
 
-// url gets the GCS URL of the given file. The file should be given as a path
-// relative to the managed directory.
-func (m *gcsManager) url(name string) string {
+// URL implements ObjectStore.URL. It gets the GCS URL of the given object.
+func (m *GCSStore) URL(name string) string {
 	object := m.objectPath(name)
 	return fmt.Sprintf("gs://%s/%s", m.gcsBucket, object)
 }
 
-// cleanup cleans up the managed directory.
-func (m *gcsManager) cleanup(ctx context.Context) error {
-	q := &storage.Query{Prefix: m.managedDir()}
+// List implements ObjectStore.List.
+func (m *GCSStore) List(ctx context.Context) ([]string, error) {
+	prefix := m.managedDir() + "/"
+	q := &storage.Query{Prefix: prefix}
 	it := m.gcsClient.Bucket(m.gcsBucket).Objects(ctx, q)
 	var objects []string
 	for {
@@ -77,14 +93,41 @@ func (m *gcsManager) cleanup(ctx context.Context) error {
 			break
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
-		objects = append(objects, objAttrs.Name)
+		objects = append(objects, strings.TrimPrefix(objAttrs.Name, prefix))
 	}
-	for _, object := range objects {
-		if err := m.gcsClient.Bucket(m.gcsBucket).Object(object).Delete(ctx); err != nil {
-			return err
-		}
+	return objects, nil
+}
+
+// Delete implements ObjectStore.Delete.
+func (m *GCSStore) Delete(ctx context.Context, name string) error {
+	err := m.gcsClient.Bucket(m.gcsBucket).Object(m.objectPath(name)).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+// isTransient determines if a failed GCS request may succeed when it is retried.
+func isTransient(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Checksum implements ObjectStore.Checksum.
+func (m *GCSStore) Checksum(ctx context.Context, name string) (uint32, bool, error) {
+	attrs, err := m.gcsClient.Bucket(m.gcsBucket).Object(m.objectPath(name)).Attrs(ctx)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		return 0, false, nil
+	case err != nil:
+		return 0, false, err
+	default:
+		return attrs.CRC32C, true, nil
 	}
-	return nil
 }
@@ -16,9 +16,11 @@ package preloader
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"cos-customizer/fakes"
 	"fmt"
+	"io/ioutil"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -36,34 +38,60 @@ func TestStore(t *testing.T) {
 	}
 	gcs := fakes.GCSForTest(t)
 	defer gcs.Close()
-	storageManager := gcsManager{gcs.Client, "bucket", "dir"}
+	storageManager := NewGCSStore(gcs.Client, "bucket", "dir", "default")
 	for _, input := range testData {
 		t.Run(input.testName, func(t *testing.T) {
 			gcs.Objects = make(map[string][]byte)
-			storageManager.store(context.Background(), bytes.NewReader(input.data), input.object)
-			got, ok := gcs.Objects[fmt.Sprintf("/bucket/dir/cos-customizer/%s", input.object)]
+			storageManager.Store(context.Background(), bytes.NewReader(input.data), input.object)
+			got, ok := gcs.Objects[fmt.Sprintf("/bucket/dir/cos-customizer/default/%s", input.object)]
 			if !ok {
-				t.Fatalf("gcsManager{}.store(_, %s, %s): could not find object", string(input.data), input.object)
+				t.Fatalf("GCSStore{}.Store(_, %s, %s): could not find object", string(input.data), input.object)
 			}
 			if !cmp.Equal(got, input.data, cmpopts.EquateEmpty()) {
-				t.Errorf("gcsManager{}.store(_, %s, %s) = %s, want %s", string(input.data), input.object, got, string(input.data))
+				t.Errorf("GCSStore{}.Store(_, %s, %s) = %s, want %s", string(input.data), input.object, got, string(input.data))
 			}
 
 		})
 	}
 }
 
+func TestStoreCompressed(t *testing.T) {
+	gcs := fakes.GCSForTest(t)
+	defer gcs.Close()
+	storageManager := NewGCSStore(gcs.Client, "bucket", "dir", "default")
+	data := []byte("test-data")
+	if err := storeCompressed(context.Background(), storageManager, bytes.NewReader(data), "test-object.gz"); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := gcs.Objects["/bucket/dir/cos-customizer/default/test-object.gz"]
+	if !ok {
+		t.Fatalf("storeCompressed(_, _, %s, test-object.gz): could not find object", string(data))
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(uncompressed, data) {
+		t.Errorf("storeCompressed(_, _, %s, test-object.gz): uncompressed = %s, want %s", string(data),
+			string(uncompressed), string(data))
+	}
+}
+
 func TestManagedDirURL(t *testing.T) {
-	storageManager := gcsManager{nil, "bucket", "dir"}
-	if got := storageManager.managedDirURL(); got != "gs://bucket/dir/cos-customizer" {
-		t.Errorf("gcsManager{}.managedDirURL() = %s, want gs://bucket/dir/cos-customizer", got)
+	storageManager := NewGCSStore(nil, "bucket", "dir", "default")
+	if got := storageManager.URL(""); got != "gs://bucket/dir/cos-customizer/default" {
+		t.Errorf("GCSStore{}.URL() = %s, want gs://bucket/dir/cos-customizer/default", got)
 	}
 }
 
 func TestURL(t *testing.T) {
-	storageManager := gcsManager{nil, "bucket", "dir"}
-	if got := storageManager.url("object"); got != "gs://bucket/dir/cos-customizer/object" {
-		t.Errorf("gcsManager{}.url(object) = %s, want gs://bucket/dir/cos-customizer/object", got)
+	storageManager := NewGCSStore(nil, "bucket", "dir", "default")
+	if got := storageManager.URL("object"); got != "gs://bucket/dir/cos-customizer/default/object" {
+		t.Errorf("GCSStore{}.URL(object) = %s, want gs://bucket/dir/cos-customizer/default/object", got)
 	}
 }
 
@@ -71,18 +99,18 @@ func TestCleanup(t *testing.T) {
 	ctx := context.Background()
 	gcs := fakes.GCSForTest(t)
 	defer gcs.Close()
-	storageManager := gcsManager{gcs.Client, "bucket", "dir"}
-	storageManager.store(ctx, bytes.NewReader(nil), "obj1")
-	storageManager.store(ctx, bytes.NewReader(nil), "obj2")
+	storageManager := NewGCSStore(gcs.Client, "bucket", "dir", "default")
+	storageManager.Store(ctx, bytes.NewReader(nil), "obj1")
+	storageManager.Store(ctx, bytes.NewReader(nil), "obj2")
 	gcs.Objects["/bucket/obj3"] = nil
-	storageManager.cleanup(ctx)
-	if _, ok := gcs.Objects["/bucket/dir/cos-customizer/obj1"]; ok {
-		t.Errorf("storageManager.cleanup(_): object /bucket/dir/cos-customizer/obj1 not deleted")
+	cleanup(ctx, storageManager)
+	if _, ok := gcs.Objects["/bucket/dir/cos-customizer/default/obj1"]; ok {
+		t.Errorf("cleanup(_, _): object /bucket/dir/cos-customizer/default/obj1 not deleted")
 	}
-	if _, ok := gcs.Objects["/bucket/dir/cos-customizer/obj2"]; ok {
-		t.Errorf("storageManager.cleanup(_): object /bucket/dir/cos-customizer/obj2 not deleted")
+	if _, ok := gcs.Objects["/bucket/dir/cos-customizer/default/obj2"]; ok {
+		t.Errorf("cleanup(_, _): object /bucket/dir/cos-customizer/default/obj2 not deleted")
 	}
 	if _, ok := gcs.Objects["/bucket/obj3"]; !ok {
-		t.Errorf("storageManager.cleanup(_): object /bucket/obj3 was deleted")
+		t.Errorf("cleanup(_, _): object /bucket/obj3 was deleted")
 	}
 }
@@ -0,0 +1,198 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"cos-customizer/config"
+	"cos-customizer/fs"
+)
+
+const (
+	// InputHashLabel is the label of result images that records the hash of the inputs that the image
+	// was built from.
+	InputHashLabel = "cos-customizer-input-hash"
+
+	// inputHashLen is the number of hex digits of the input hash that are kept. Label values can be
+	// at most 63 characters long.
+	inputHashLen = 40
+)
+
+// inputHasher accumulates the inputs of an image build into a hash. Each input is written along with
+// its name and size, so that the boundaries between inputs are unambiguous.
+type inputHasher struct {
+	h hash.Hash
+}
+
+func (h *inputHasher) addBytes(name string, data []byte) {
+	fmt.Fprintf(h.h, "%s %d\n", name, len(data))
+	h.h.Write(data)
+}
+
+func (h *inputHasher) addJSON(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	h.addBytes(name, data)
+	return nil
+}
+
+func (h *inputHasher) addFile(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h.h, "%s %d\n", name, info.Size())
+	_, err = io.Copy(h.h, io.LimitReader(f, info.Size()))
+	return err
+}
+
+// addStateFile adds the steps of the state file. Environment files are created with random names, so
+// the contents of the environment file of each step are added instead of its name. The names of the
+// environment files are returned.
+func (h *inputHasher) addStateFile(files *fs.Files) (map[string]bool, error) {
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	envFiles := make(map[string]bool)
+	for _, entry := range entries {
+		step := *entry
+		step.Env = ""
+		if err := h.addJSON("step", step); err != nil {
+			return nil, err
+		}
+		if entry.Env == "" {
+			continue
+		}
+		if err := h.addFile("env", filepath.Join(files.PersistBuiltinBuildContext, entry.Env)); err != nil {
+			return nil, err
+		}
+		envFiles[entry.Env] = true
+	}
+	return envFiles, nil
+}
+
+// addBuiltinBuildContext adds the files of the persistent builtin build context, except for the given
+// environment files.
+func (h *inputHasher) addBuiltinBuildContext(files *fs.Files, envFiles map[string]bool) error {
+	root := files.PersistBuiltinBuildContext
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if envFiles[rel] {
+			return nil
+		}
+		name := fmt.Sprintf("builtin %s %v", filepath.ToSlash(rel), info.Mode())
+		if !info.Mode().IsRegular() {
+			h.addBytes(name, nil)
+			return nil
+		}
+		return h.addFile(name, path)
+	})
+}
+
+// InputHash computes a hash of the inputs of an image build that determine the contents of the result
+// image: the source image, the user and builtin build contexts, the state file, the Daisy workflow and
+// the files that configure the preload VM, the licenses of the result image and the build configuration.
+// The machine type, network, service account and scopes of the preload VM are part of the hash, since
+// build steps can depend on them, for example to download files. The project, zone and timeout of the
+// image build are not part of the hash, and neither are the name, family and labels of the result
+// image.
+func InputHash(files *fs.Files, input, output *config.Image, buildSpec *config.Build) (string, error) {
+	h := &inputHasher{sha256.New()}
+	h.addBytes("source", []byte(input.URL()))
+	if err := h.addFile("user", files.UserBuildContextArchive); err != nil {
+		return "", err
+	}
+	envFiles, err := h.addStateFile(files)
+	if err != nil {
+		return "", err
+	}
+	if err := h.addBuiltinBuildContext(files, envFiles); err != nil {
+		return "", err
+	}
+	// The workflow is built from fixed inputs that use all of its steps, so that changes to the workflow
+	// change the hash. The inputs that the workflow is built from are added separately.
+	if err := h.addJSON("workflow", newDaisyWorkflow(config.NewImage("", ""), &config.Build{GPUType: "gpu",
+		OEMSize: "1"})); err != nil {
+		return "", err
+	}
+	for _, f := range []struct{ name, path string }{
+		{"startup", files.StartupScript},
+		{"service", files.SystemdService},
+	} {
+		if err := h.addFile(f.name, f.path); err != nil {
+			return "", err
+		}
+	}
+	if err := h.addJSON("licenses", sanitizeLicenses(output.Licenses)); err != nil {
+		return "", err
+	}
+	if err := h.addJSON("build", struct {
+		DiskSize        int
+		OEMSize         string
+		OEMFSSize4K     uint64
+		SealOEM         bool
+		GPUType         string
+		ContainerImages []config.ContainerImage
+		MachineType     string
+		Network         string
+		Subnet          string
+		NoExternalIP    bool
+		ServiceAccount  string
+		Scopes          []string
+	}{
+		buildSpec.DiskSize,
+		buildSpec.OEMSize,
+		buildSpec.OEMFSSize4K,
+		buildSpec.SealOEM,
+		buildSpec.GPUType,
+		buildSpec.ContainerImages,
+		buildSpec.MachineType,
+		buildSpec.Network,
+		buildSpec.Subnet,
+		buildSpec.NoExternalIP,
+		buildSpec.ServiceAccount,
+		buildSpec.Scopes,
+	}); err != nil {
+		return "", err
+	}
+	for _, gcsFile := range buildSpec.GCSFiles {
+		if err := h.addFile("gcs_files/"+filepath.Base(gcsFile), gcsFile); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.h.Sum(nil))[:inputHashLen], nil
+}
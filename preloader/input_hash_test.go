@@ -0,0 +1,280 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"cos-customizer/config"
+	"cos-customizer/fs"
+)
+
+// inputHashFixture is an image build whose input hash can be computed.
+type inputHashFixture struct {
+	files       *fs.Files
+	input       *config.Image
+	output      *config.Image
+	buildConfig *config.Build
+}
+
+// setupInputHash creates an image build with a single user step that sources an environment file
+// with the given name.
+func setupInputHash(t *testing.T, envFile string) (string, *inputHashFixture) {
+	t.Helper()
+	tmpDir, files, err := setupFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files.PersistBuiltinBuildContext = filepath.Join(tmpDir, "builtin_build_context")
+	if err := os.Mkdir(files.PersistBuiltinBuildContext, 0755); err != nil {
+		os.RemoveAll(tmpDir)
+		t.Fatal(err)
+	}
+	for path, contents := range map[string]string{
+		files.UserBuildContextArchive: "user",
+		files.StartupScript:           "startup",
+		filepath.Join(files.PersistBuiltinBuildContext, "install.sh"): "install",
+		filepath.Join(files.PersistBuiltinBuildContext, envFile):      "export A=b\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			os.RemoveAll(tmpDir)
+			t.Fatal(err)
+		}
+	}
+	if err := fs.AppendStateFile(files.StateFile, fs.User, "script.sh", envFile); err != nil {
+		os.RemoveAll(tmpDir)
+		t.Fatal(err)
+	}
+	input := config.NewImage("cos-stable", "cos-cloud")
+	output := config.NewImage("my-image", "my-project")
+	output.Labels["key"] = "value"
+	buildConfig := &config.Build{Project: "p", Zone: "z", Timeout: "1h", DiskSize: 20}
+	return tmpDir, &inputHashFixture{files, input, output, buildConfig}
+}
+
+func TestInputHash(t *testing.T) {
+	baseDir, base := setupInputHash(t, "user_env_1")
+	defer os.RemoveAll(baseDir)
+	want, err := InputHash(base.files, base.input, base.output, base.buildConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile("^[0-9a-f]{40}$").MatchString(want) {
+		t.Fatalf("InputHash() = %q; want 40 lowercase hex digits", want)
+	}
+	testData := []struct {
+		testName string
+		envFile  string
+		modify   func(*inputHashFixture) error
+		wantSame bool
+	}{
+		{
+			"Unchanged",
+			"user_env_1",
+			func(*inputHashFixture) error { return nil },
+			true,
+		},
+		{
+			"EnvFileName",
+			"user_env_2",
+			func(*inputHashFixture) error { return nil },
+			true,
+		},
+		{
+			"PreloadVMLocation",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.buildConfig.Project = "other"
+				f.buildConfig.Zone = "other"
+				f.buildConfig.Timeout = "2h"
+				return nil
+			},
+			true,
+		},
+		{
+			"OutputImageMetadata",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.output.Name = "other"
+				f.output.Family = "other"
+				f.output.Labels["key"] = "other"
+				return nil
+			},
+			true,
+		},
+		{
+			"SourceImage",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.input.Name = "cos-beta"
+				return nil
+			},
+			false,
+		},
+		{
+			"UserBuildContext",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				return ioutil.WriteFile(f.files.UserBuildContextArchive, []byte("other"), 0644)
+			},
+			false,
+		},
+		{
+			"EnvFileContents",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				return ioutil.WriteFile(filepath.Join(f.files.PersistBuiltinBuildContext, "user_env_1"),
+					[]byte("export A=c\n"), 0644)
+			},
+			false,
+		},
+		{
+			"BuiltinBuildContext",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				return ioutil.WriteFile(filepath.Join(f.files.PersistBuiltinBuildContext, "install.sh"),
+					[]byte("other"), 0644)
+			},
+			false,
+		},
+		{
+			"StateFile",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				return fs.AppendStateFile(f.files.StateFile, fs.User, "script.sh", "")
+			},
+			false,
+		},
+		{
+			"StartupScript",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				return ioutil.WriteFile(f.files.StartupScript, []byte("other"), 0644)
+			},
+			false,
+		},
+		{
+			"Licenses",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.output.Licenses = []string{"projects/p/global/licenses/l"}
+				return nil
+			},
+			false,
+		},
+		{
+			"BuildConfig",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.buildConfig.GPUType = "nvidia-tesla-k80"
+				return nil
+			},
+			false,
+		},
+		{
+			"MachineType",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.buildConfig.MachineType = "n1-standard-4"
+				return nil
+			},
+			false,
+		},
+		{
+			"Network",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.buildConfig.Network = "other"
+				return nil
+			},
+			false,
+		},
+		{
+			"Subnet",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.buildConfig.Subnet = "other"
+				return nil
+			},
+			false,
+		},
+		{
+			"NoExternalIP",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.buildConfig.NoExternalIP = true
+				return nil
+			},
+			false,
+		},
+		{
+			"ServiceAccount",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.buildConfig.ServiceAccount = "builder@p.iam.gserviceaccount.com"
+				return nil
+			},
+			false,
+		},
+		{
+			"Scopes",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.buildConfig.Scopes = []string{"devstorage.read_write"}
+				return nil
+			},
+			false,
+		},
+		{
+			"ContainerImages",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				f.buildConfig.ContainerImages = []config.ContainerImage{{Ref: "busybox"}}
+				return nil
+			},
+			false,
+		},
+		{
+			"GCSFiles",
+			"user_env_1",
+			func(f *inputHashFixture) error {
+				gcsFile := filepath.Join(filepath.Dir(f.files.StateFile), "driver.run")
+				f.buildConfig.GCSFiles = []string{gcsFile}
+				return ioutil.WriteFile(gcsFile, []byte("driver"), 0644)
+			},
+			false,
+		},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, fixture := setupInputHash(t, input.envFile)
+			defer os.RemoveAll(tmpDir)
+			if err := input.modify(fixture); err != nil {
+				t.Fatal(err)
+			}
+			got, err := InputHash(fixture.files, fixture.input, fixture.output, fixture.buildConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotSame := got == want; gotSame != input.wantSame {
+				t.Errorf("InputHash() = %q, unchanged build = %q; want same hash: %v", got, want, input.wantSame)
+			}
+		})
+	}
+}
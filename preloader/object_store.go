@@ -0,0 +1,242 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// cleanupParallelism is the number of objects that are deleted concurrently by cleanup.
+	cleanupParallelism = 8
+
+	// cleanupAttempts is the number of times cleanup tries to delete an object.
+	cleanupAttempts = 4
+)
+
+// cleanupRetryInterval is how long cleanup waits before retrying a failed delete. The wait doubles
+// after each attempt.
+var cleanupRetryInterval = time.Second
+
+// crc32cTable is used to compute the CRC32C checksums of objects, which is the checksum that GCS
+// records for every object.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ObjectStore stores the artifacts that the preload VM downloads during an image build. Objects are
+// named by slash separated paths relative to the root of the store.
+type ObjectStore interface {
+	// Store stores the data read from r as the given object, replacing an existing object.
+	Store(ctx context.Context, r io.Reader, name string) error
+	// URL gets the URL of the given object. The URL of the empty name is the URL of the root of
+	// the store.
+	URL(name string) string
+	// List lists the names of the objects in the store.
+	List(ctx context.Context) ([]string, error)
+	// Delete deletes the given object. Deleting an object that does not exist is not an error.
+	Delete(ctx context.Context, name string) error
+	// Checksum gets the CRC32C checksum of the given object. The returned bool is false if the
+	// object does not exist.
+	Checksum(ctx context.Context, name string) (uint32, bool, error)
+}
+
+// stagedChecksum computes the CRC32C checksum of the object that is created by staging the given
+// file, optionally compressed with gzip.
+func stagedChecksum(file string, compress bool) (uint32, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.New(crc32cTable)
+	if !compress {
+		_, err := io.Copy(h, f)
+		return h.Sum32(), err
+	}
+	gzipWriter := gzip.NewWriter(h)
+	if _, err := io.Copy(gzipWriter, f); err != nil {
+		return 0, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// storeCompressed stores the given data in the given object, compressed with gzip.
+func storeCompressed(ctx context.Context, store ObjectStore, r io.Reader, name string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		gzipWriter := gzip.NewWriter(pw)
+		_, err := io.Copy(gzipWriter, r)
+		if err == nil {
+			err = gzipWriter.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	err := store.Store(ctx, pr, name)
+	// Unblock the compressing goroutine if the store stopped reading early.
+	pr.Close()
+	return err
+}
+
+// cleanup deletes all of the objects in the given store. Objects are deleted concurrently, and
+// deletes that fail with a transient error are retried. Objects that cannot be deleted are logged,
+// and do not stop the deletion of other objects.
+func cleanup(ctx context.Context, store ObjectStore) error {
+	objects, err := store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot list the staged files in %s: %v", store.URL(""), err)
+	}
+	toDelete := make(chan string)
+	errs := make(chan error, len(objects))
+	var wg sync.WaitGroup
+	for i := 0; i < cleanupParallelism && i < len(objects); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for object := range toDelete {
+				if err := deleteWithRetry(ctx, store, object); err != nil {
+					errs <- fmt.Errorf("cannot delete %s: %v", store.URL(object), err)
+				}
+			}
+		}()
+	}
+	for _, object := range objects {
+		toDelete <- object
+	}
+	close(toDelete)
+	wg.Wait()
+	close(errs)
+	failed := 0
+	for err := range errs {
+		log.Println(err)
+		failed++
+	}
+	if failed > 0 {
+		return fmt.Errorf("cannot delete %d of %d staged files in %s", failed, len(objects), store.URL(""))
+	}
+	return nil
+}
+
+// deleteWithRetry deletes the given object from the given store. Deletes that fail with a transient
+// error are retried with exponential backoff.
+func deleteWithRetry(ctx context.Context, store ObjectStore, object string) error {
+	interval := cleanupRetryInterval
+	for attempt := 1; ; attempt++ {
+		err := store.Delete(ctx, object)
+		if err == nil || attempt == cleanupAttempts || !isTransient(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+// LocalStore is an ObjectStore in a directory of the local file system.
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore creates a LocalStore in the given directory. The directory is created when the
+// first object is stored.
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{dir}
+}
+
+func (s *LocalStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+// Store implements ObjectStore.Store.
+func (s *LocalStore) Store(_ context.Context, r io.Reader, name string) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// URL implements ObjectStore.URL. It gets the local path of the given object.
+func (s *LocalStore) URL(name string) string {
+	return s.path(name)
+}
+
+// List implements ObjectStore.List.
+func (s *LocalStore) List(_ context.Context) ([]string, error) {
+	var objects []string
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == s.dir {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// Delete implements ObjectStore.Delete.
+func (s *LocalStore) Delete(_ context.Context, name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Checksum implements ObjectStore.Checksum.
+func (s *LocalStore) Checksum(_ context.Context, name string) (uint32, bool, error) {
+	sum, err := stagedChecksum(s.path(name), false)
+	switch {
+	case os.IsNotExist(err):
+		return 0, false, nil
+	case err != nil:
+		return 0, false, err
+	default:
+		return sum, true, nil
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/api/googleapi"
+)
+
+func TestLocalStore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ctx := context.Background()
+	store := NewLocalStore(filepath.Join(tmpDir, "store"))
+	objects, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("LocalStore{}.List(_) before Store: %v", err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("LocalStore{}.List(_) before Store = %v, want none", objects)
+	}
+	for _, object := range []string{"obj1", "gcs_files/obj2"} {
+		if err := store.Store(ctx, bytes.NewReader([]byte(object)), object); err != nil {
+			t.Fatalf("LocalStore{}.Store(_, _, %s): %v", object, err)
+		}
+	}
+	if got, want := store.URL("gcs_files/obj2"), filepath.Join(tmpDir, "store", "gcs_files", "obj2"); got != want {
+		t.Errorf("LocalStore{}.URL(gcs_files/obj2) = %s, want %s", got, want)
+	}
+	got, err := ioutil.ReadFile(store.URL("gcs_files/obj2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "gcs_files/obj2" {
+		t.Errorf("LocalStore{}.Store(_, gcs_files/obj2, gcs_files/obj2): got %q", string(got))
+	}
+	objects, err = store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(objects)
+	if want := []string{"gcs_files/obj2", "obj1"}; !cmp.Equal(objects, want) {
+		t.Errorf("LocalStore{}.List(_) = %v, want %v", objects, want)
+	}
+	if err := cleanup(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range []string{"obj1", "gcs_files/obj2"} {
+		if _, err := os.Stat(store.URL(object)); !os.IsNotExist(err) {
+			t.Errorf("cleanup(_, _): object %s not deleted", object)
+		}
+	}
+}
+
+func TestStoreCompressedError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// The store cannot create the object, since its parent is a file.
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := NewLocalStore(tmpDir)
+	if err := storeCompressed(context.Background(), store, bytes.NewReader(make([]byte, 1<<20)), "file/obj.gz"); err == nil {
+		t.Errorf("storeCompressed(_, _, _, file/obj.gz) = nil; want error")
+	}
+}
+
+// flakyStore is an ObjectStore that fails to delete objects. Deletes fail with a transient error
+// the given number of times for each object, and always fail for objects in permanent.
+type flakyStore struct {
+	*LocalStore
+	transient int
+	permanent map[string]bool
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func (s *flakyStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	s.attempts[name]++
+	attempt := s.attempts[name]
+	s.mu.Unlock()
+	if s.permanent[name] {
+		return errors.New("permission denied")
+	}
+	if attempt <= s.transient {
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	}
+	return s.LocalStore.Delete(ctx, name)
+}
+
+func TestCleanupRetries(t *testing.T) {
+	defer func(interval time.Duration) { cleanupRetryInterval = interval }(cleanupRetryInterval)
+	cleanupRetryInterval = 0
+	testData := []struct {
+		testName  string
+		transient int
+		permanent map[string]bool
+		wantErr   bool
+		wantLeft  []string
+	}{
+		{"Success", 0, nil, false, nil},
+		{"TransientErrors", cleanupAttempts - 1, nil, false, nil},
+		{"TooManyTransientErrors", cleanupAttempts, nil, true, []string{"obj0", "obj1", "obj2", "obj3", "obj4",
+			"obj5", "obj6", "obj7", "obj8", "obj9"}},
+		{"PermanentError", 0, map[string]bool{"obj3": true}, true, []string{"obj3"}},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			ctx := context.Background()
+			store := &flakyStore{
+				LocalStore: NewLocalStore(tmpDir),
+				transient:  input.transient,
+				permanent:  input.permanent,
+				attempts:   make(map[string]int),
+			}
+			for i := 0; i < 10; i++ {
+				if err := store.Store(ctx, bytes.NewReader(nil), fmt.Sprintf("obj%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = cleanup(ctx, store)
+			if gotErr := err != nil; gotErr != input.wantErr {
+				t.Errorf("cleanup(_, _) = %v; want error: %v", err, input.wantErr)
+			}
+			got, err := store.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(got, input.wantLeft, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("cleanup(_, _): objects left diff (-got, +want): %s", diff)
+			}
+			for name, attempts := range store.attempts {
+				if attempts > cleanupAttempts {
+					t.Errorf("cleanup(_, _): %s deleted %d times; want at most %d", name, attempts, cleanupAttempts)
+				}
+			}
+		})
+	}
+}
@@ -18,22 +18,24 @@ package preloader
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"text/template"
+	"time"
 
 	"cos-customizer/config"
 	"cos-customizer/fs"
 
-	"cloud.google.com/go/storage"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -74,31 +76,31 @@ func buildCloudConfig(script io.Reader, service io.Reader) (string, error) {
 }
 
 // writeCloudConfig composes a cloud-config from the given script and systemd service and writes the result
-// to a temporary file.
-func writeCloudConfig(scriptPath string, servicePath string) (string, error) {
+// to the given output path.
+func writeCloudConfig(scriptPath string, servicePath string, outputPath string) error {
 	scriptReader, err := os.Open(scriptPath)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer scriptReader.Close()
 	serviceReader, err := os.Open(servicePath)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer serviceReader.Close()
 	cloudConfig, err := buildCloudConfig(scriptReader, serviceReader)
 	if err != nil {
-		return "", err
+		return err
 	}
-	w, err := ioutil.TempFile(fs.ScratchDir, "cloudconfig-")
+	return ioutil.WriteFile(outputPath, []byte(cloudConfig), 0644)
+}
+
+// tempFileName creates an empty temporary file with the given prefix and returns its name.
+func tempFileName(prefix string) (string, error) {
+	w, err := ioutil.TempFile(fs.ScratchDir, prefix)
 	if err != nil {
 		return "", err
 	}
-	if _, err := w.WriteString(cloudConfig); err != nil {
-		w.Close()
-		os.Remove(w.Name())
-		return "", err
-	}
 	if err := w.Close(); err != nil {
 		os.Remove(w.Name())
 		return "", err
@@ -106,134 +108,147 @@ func writeCloudConfig(scriptPath string, servicePath string) (string, error) {
 	return w.Name(), nil
 }
 
-// storeInGCS stores the given files in GCS using the given gcsManager.
+// stageFiles stores the given files in the given object store.
 // Files to store are provided in a map where each key is a file on the local
-// file system and each value is the relative path in GCS at which to store the
-// corresponding key. The provided relative paths in GCS must be unique.
-func storeInGCS(ctx context.Context, gcs *gcsManager, files map[string]string) error {
-	gcsRelPaths := make(map[string]bool)
-	for _, gcsRelPath := range files {
-		if gcsRelPaths[gcsRelPath] {
-			return fmt.Errorf("storeInGCS: collision in relative path %q", gcsRelPath)
+// file system and each value is the name of the object at which to store the
+// corresponding key. The provided object names must be unique. Files are
+// compressed with gzip while they are stored if their object name ends with
+// ".gz" and their local path does not.
+//
+// Staging is content-addressed: files whose object already exists with the same
+// checksum, for example because it was kept from an earlier image build, are not
+// stored again. Other objects in the store are left alone; they are deleted when
+// the store is cleaned up. The staged files are returned, sorted by URL.
+func stageFiles(ctx context.Context, store ObjectStore, files map[string]string) ([]StagedFile, error) {
+	objects := make(map[string]bool)
+	for _, object := range files {
+		if objects[object] {
+			return nil, fmt.Errorf("stageFiles: collision in object name %q", object)
 		}
-		gcsRelPaths[gcsRelPath] = true
+		objects[object] = true
 	}
-	for file, gcsRelPath := range files {
-		r, err := os.Open(file)
+	var staged []StagedFile
+	for file, object := range files {
+		compress := path.Ext(object) == ".gz" && filepath.Ext(file) != ".gz"
+		checksum, err := stageFile(ctx, store, file, object, compress)
 		if err != nil {
-			return fmt.Errorf("error opening %q: %v", file, err)
-		}
-		defer r.Close()
-		if err := gcs.store(ctx, r, gcsRelPath); err != nil {
-			return err
+			return nil, err
 		}
+		staged = append(staged, StagedFile{File: file, URL: store.URL(object), CRC32C: fmt.Sprintf("%08x", checksum)})
 	}
-	return nil
+	sort.Slice(staged, func(i, j int) bool { return staged[i].URL < staged[j].URL })
+	return staged, nil
 }
 
-// writeDaisyWorkflow templates the given Daisy workflow and writes the result to a temporary file.
-// The given workflow should be the one at //data/build_image.wf.json.
-func writeDaisyWorkflow(inputWorkflow string, outputImage *config.Image, buildSpec *config.Build) (string, error) {
-	tmplContents, err := ioutil.ReadFile(inputWorkflow)
+// stageFile stores the given file as the given object, unless the object already exists with the
+// same checksum. It returns the checksum of the object.
+func stageFile(ctx context.Context, store ObjectStore, file, object string, compress bool) (uint32, error) {
+	want, err := stagedChecksum(file, compress)
 	if err != nil {
-		return "", err
+		return 0, fmt.Errorf("error reading %q: %v", file, err)
 	}
-	labelsJSON, err := json.Marshal(outputImage.Labels)
+	got, exists, err := store.Checksum(ctx, object)
 	if err != nil {
-		return "", err
-	}
-	acceleratorsJSON, err := json.Marshal([]map[string]interface{}{})
-	if err != nil {
-		return "", err
+		return 0, err
 	}
-	if buildSpec.GPUType != "" {
-		acceleratorType := fmt.Sprintf("projects/%s/zones/%s/acceleratorTypes/%s",
-			buildSpec.Project, buildSpec.Zone, buildSpec.GPUType)
-		acceleratorsJSON, err = json.Marshal([]map[string]interface{}{
-			{"acceleratorType": acceleratorType, "acceleratorCount": 1}})
-		if err != nil {
-			return "", err
-		}
+	if exists && got == want {
+		log.Printf("%s is unchanged in %s; skipping upload\n", file, store.URL(object))
+		return want, nil
 	}
-	licensesJSON, err := json.Marshal(outputImage.Licenses)
+	r, err := os.Open(file)
 	if err != nil {
-		return "", err
+		return 0, fmt.Errorf("error opening %q: %v", file, err)
 	}
-
-	// template content for the step resize-disk.
-	// If the oem-size is set, create the disk with the default size, and then resize the disk.
-	// Otherwise, a place holder is used. The disk is created with provided disk-size-gb or
-	// the default size. And the disk will not be resized.
-	// The place holder is needed because ResizeDisk API requires a larger size than the original disk.
-	var resizeDiskJSON string
-	if buildSpec.OEMSize != "" {
-		// actual disk size
-		resizeDiskJSON = fmt.Sprintf(`"ResizeDisks": [{"Name": "boot-disk","SizeGb": "%d"}]`, buildSpec.DiskSize)
-	} else {
-		// placeholder
-		resizeDiskJSON = `"WaitForInstancesSignal": [{"Name": "preload-vm","Interval": "2s","SerialOutput": {"Port": 3,"SuccessMatch": "BuildStatus:"}}]`
+	defer r.Close()
+	if compress {
+		return want, storeCompressed(ctx, store, r, object)
 	}
-	tmpl, err := template.New("workflow").Parse(string(tmplContents))
-	if err != nil {
-		return "", err
-	}
-	w, err := ioutil.TempFile(fs.ScratchDir, "daisy-")
-	if err != nil {
-		return "", err
-	}
-	if err := tmpl.Execute(w, struct {
-		Labels       string
-		Accelerators string
-		Licenses     string
-		ResizeDisks  string
-	}{
-		string(labelsJSON),
-		string(acceleratorsJSON),
-		string(licensesJSON),
-		resizeDiskJSON,
-	}); err != nil {
-		w.Close()
-		os.Remove(w.Name())
-		return "", err
-	}
-	if err := w.Close(); err != nil {
-		os.Remove(w.Name())
-		return "", err
-	}
-	return w.Name(), nil
+	return want, store.Store(ctx, r, object)
 }
 
-func sanitize(output *config.Image) {
-	var licenses []string
-	for _, l := range output.Licenses {
+// sanitizeLicenses drops empty license names and converts full license URLs to partial URLs.
+func sanitizeLicenses(licenses []string) []string {
+	var sanitized []string
+	for _, l := range licenses {
 		if l != "" {
-			licenses = append(licenses, strings.TrimPrefix(l, "https://www.googleapis.com/compute/v1/"))
+			sanitized = append(sanitized, strings.TrimPrefix(l, "https://www.googleapis.com/compute/v1/"))
 		}
 	}
-	output.Licenses = licenses
+	return sanitized
 }
 
-// daisyArgs computes the parameters to the cos-customizer Daisy workflow (//data/build_image.wf.json)
-// and uploads dependencies to GCS.
-func daisyArgs(ctx context.Context, gcs *gcsManager, files *fs.Files, input *config.Image, output *config.Image, buildSpec *config.Build) ([]string, error) {
-	sanitize(output)
+func sanitize(output *config.Image) {
+	output.Licenses = sanitizeLicenses(output.Licenses)
+}
+
+// userBuildContextObject gets the path of the user build context archive relative to the managed GCS
+// directory. The user build context is uploaded compressed, since it can be large.
+func userBuildContextObject(files *fs.Files) string {
+	return filepath.Base(files.UserBuildContextArchive) + ".gz"
+}
+
+// gcsUploads gets the files that need to be staged for the cos-customizer Daisy workflow. The result
+// maps files on the local file system to object names.
+func gcsUploads(files *fs.Files, buildSpec *config.Build) map[string]string {
 	toUpload := map[string]string{
-		files.UserBuildContextArchive:    filepath.Base(files.UserBuildContextArchive),
+		files.UserBuildContextArchive:    userBuildContextObject(files),
 		files.BuiltinBuildContextArchive: filepath.Base(files.BuiltinBuildContextArchive),
 		files.StateFile:                  filepath.Base(files.StateFile),
 	}
 	for _, gcsFile := range buildSpec.GCSFiles {
 		toUpload[gcsFile] = path.Join("gcs_files", filepath.Base(gcsFile))
 	}
-	if err := storeInGCS(ctx, gcs, toUpload); err != nil {
-		return nil, err
+	return toUpload
+}
+
+// PreloadVMNameRegexp matches the names generated by newPreloadVMName.
+var PreloadVMNameRegexp = regexp.MustCompile(`^preload-vm-[0-9a-f]{8}$`)
+
+// newPreloadVMName generates a name for the preload VM and its boot disk. The name is random, so that
+// preload VMs that are kept after failed image builds do not collide with the ones of later image
+// builds.
+var newPreloadVMName = func() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
 	}
-	daisyWorkflow, err := writeDaisyWorkflow(files.DaisyWorkflow, output, buildSpec)
+	return fmt.Sprintf("preload-vm-%x", suffix), nil
+}
+
+// daisyArgs computes the parameters to the cos-customizer Daisy workflow (see newDaisyWorkflow)
+// and stages dependencies in the given object store. The staged files are returned. The given preload
+// VM name is only used if the preload VM is kept after a failed image build.
+func daisyArgs(ctx context.Context, store ObjectStore, files *fs.Files, input *config.Image, output *config.Image, buildSpec *config.Build,
+	preloadVM string) ([]string, []StagedFile, error) {
+	staged, err := stageFiles(ctx, store, gcsUploads(files, buildSpec))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	daisyWorkflow, err := tempFileName("daisy-")
+	if err != nil {
+		return nil, nil, err
 	}
-	cloudConfigFile, err := writeCloudConfig(files.StartupScript, files.SystemdService)
+	cloudConfigFile, err := tempFileName("cloudconfig-")
 	if err != nil {
+		return nil, nil, err
+	}
+	args, err := workflowArgs(store, files, input, output, buildSpec, preloadVM, daisyWorkflow, cloudConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return args, staged, nil
+}
+
+// workflowArgs writes the templated Daisy workflow and the cloud-config of the preload VM to the given
+// paths, and computes the parameters to the cos-customizer Daisy workflow. It does not stage anything
+// in the given object store.
+func workflowArgs(store ObjectStore, files *fs.Files, input *config.Image, output *config.Image, buildSpec *config.Build,
+	preloadVM, daisyWorkflow, cloudConfigFile string) ([]string, error) {
+	sanitize(output)
+	if err := writeDaisyWorkflow(daisyWorkflow, output, buildSpec); err != nil {
+		return nil, err
+	}
+	if err := writeCloudConfig(files.StartupScript, files.SystemdService, cloudConfigFile); err != nil {
 		return nil, err
 	}
 	var args []string
@@ -249,6 +264,9 @@ func daisyArgs(ctx context.Context, gcs *gcsManager, files *fs.Files, input *con
 	if output.Family != "" {
 		args = append(args, "-var:output_image_family", output.Family)
 	}
+	if buildSpec.KeepOnFailure {
+		args = append(args, "-var:preload_vm_name", preloadVM)
+	}
 	hostMaintenance := "MIGRATE"
 	if buildSpec.GPUType != "" {
 		hostMaintenance = "TERMINATE"
@@ -262,19 +280,19 @@ func daisyArgs(ctx context.Context, gcs *gcsManager, files *fs.Files, input *con
 		"-var:output_image_project",
 		output.Project,
 		"-var:user_build_context",
-		gcs.url(filepath.Base(files.UserBuildContextArchive)),
+		store.URL(userBuildContextObject(files)),
 		"-var:builtin_build_context",
-		gcs.url(filepath.Base(files.BuiltinBuildContextArchive)),
+		store.URL(filepath.Base(files.BuiltinBuildContextArchive)),
 		"-var:state_file",
-		gcs.url(filepath.Base(files.StateFile)),
+		store.URL(filepath.Base(files.StateFile)),
 		"-var:gcs_files",
-		gcs.url("gcs_files"),
+		store.URL("gcs_files"),
 		"-var:cloud_config",
 		cloudConfigFile,
 		"-var:host_maintenance",
 		hostMaintenance,
 		"-gcs_path",
-		gcs.managedDirURL(),
+		store.URL(""),
 		"-project",
 		buildSpec.Project,
 		"-zone",
@@ -286,17 +304,235 @@ func daisyArgs(ctx context.Context, gcs *gcsManager, files *fs.Files, input *con
 	return args, nil
 }
 
-// BuildImage builds a customized image using Daisy.
-func BuildImage(ctx context.Context, gcsClient *storage.Client, files *fs.Files, input, output *config.Image,
-	buildSpec *config.Build) error {
-	gcs := &gcsManager{gcsClient, buildSpec.GCSBucket, buildSpec.GCSDir}
-	defer gcs.cleanup(ctx)
-	args, err := daisyArgs(ctx, gcs, files, input, output, buildSpec)
+// StagedFile is a file that was staged for the preload VM.
+type StagedFile struct {
+	// File is the local path of the file.
+	File string
+	// URL is the URL of the staged object.
+	URL string
+	// CRC32C is the CRC32C checksum of the staged object, as 8 hex digits.
+	CRC32C string
+}
+
+// BuildResult describes how an image build ran.
+type BuildResult struct {
+	// StagedFiles are the files that were staged for the preload VM.
+	StagedFiles []StagedFile
+	// Steps records how the steps of the state file ran on the preload VM, in the order in which they
+	// started.
+	Steps []*StepProgress
+	// DaisyExitCode is the exit code of Daisy. It is nil if Daisy did not run, and -1 if Daisy was
+	// terminated by a signal.
+	DaisyExitCode *int
+	// DebugVM is the name of the preload VM and its boot disk if they were kept after a failed image
+	// build. It is empty otherwise.
+	DebugVM string
+}
+
+// BuildImage builds a customized image using Daisy. The dependencies of the image build are staged in
+// the given object store, which must be reachable from the preload VM. They are deleted afterwards,
+// unless the build config asks to keep them after the outcome of the image build. Failures to delete
+// them are logged, but do not fail the image build. If the build config asks to keep the preload VM
+// after a failed image build, how to connect to it is logged. If the given context is cancelled, Daisy
+// is stopped (see waitDaisy) and the staged files are still deleted. The returned result describes how
+// far the image build got, even if it failed.
+func BuildImage(ctx context.Context, store ObjectStore, files *fs.Files, input, output *config.Image,
+	buildSpec *config.Build) (result *BuildResult, err error) {
+	result = &BuildResult{}
+	defer func() {
+		switch {
+		case err != nil && buildSpec.KeepStagingOnFailure:
+			log.Printf("Keeping the staged files of the failed image build in %s\n", store.URL(""))
+		case err == nil && buildSpec.KeepStaging:
+		default:
+			// The staged files are deleted even if the image build was cancelled.
+			if cleanupErr := cleanup(context.Background(), store); cleanupErr != nil {
+				log.Printf("Cleaning up the staged files failed: %v\n", cleanupErr)
+			}
+		}
+	}()
+	preloadVM, err := newPreloadVMName()
+	if err != nil {
+		return result, err
+	}
+	args, staged, err := daisyArgs(ctx, store, files, input, output, buildSpec, preloadVM)
 	if err != nil {
+		return result, err
+	}
+	result.StagedFiles = staged
+	entries, err := fs.ReadStateFile(files.StateFile)
+	if err != nil {
+		return result, err
+	}
+	result.Steps, err = runDaisy(ctx, files.DaisyBin, args, entries, buildSpec.ProgressFormat, os.Stdout, os.Stderr)
+	result.DaisyExitCode = daisyExitCode(err)
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("image build cancelled: %v", err)
+	}
+	if err != nil && buildSpec.KeepOnFailure && result.DaisyExitCode != nil {
+		result.DebugVM = preloadVM
+		logDebugVM(preloadVM, buildSpec)
+	}
+	return result, err
+}
+
+// logDebugVM logs how to connect to the preload VM that is kept after a failed image build, and how
+// to delete it.
+func logDebugVM(preloadVM string, buildSpec *config.Build) {
+	log.Printf("Keeping the preload VM %s and its boot disk, if they were created, in project %s, zone %s "+
+		"for debugging.\n", preloadVM, buildSpec.Project, buildSpec.Zone)
+	log.Printf("Connect to the preload VM with: gcloud compute ssh %s --project=%s --zone=%s\n", preloadVM,
+		buildSpec.Project, buildSpec.Zone)
+	log.Printf("Delete the preload VM and its boot disk with: cleanup-debug-resources -project=%s -zone=%s "+
+		"-name=%s\n", buildSpec.Project, buildSpec.Zone, preloadVM)
+}
+
+// daisyExitCode gets the exit code of Daisy from the error that running it returned. It returns nil if
+// Daisy did not run.
+func daisyExitCode(err error) *int {
+	code := 0
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil
+		}
+		code = exitErr.ExitCode()
+	}
+	return &code
+}
+
+// daisyGracePeriod is how long Daisy gets to delete the resources it created after the image build is
+// cancelled, before it is killed.
+var daisyGracePeriod = 5 * time.Minute
+
+// waitDaisy waits for the given Daisy process to exit. If the given context is cancelled first, Daisy
+// is interrupted, which makes it delete the resources it created and exit. If Daisy does not exit
+// within daisyGracePeriod, it is killed.
+func waitDaisy(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+	}
+	log.Printf("Image build cancelled, waiting up to %v for Daisy to clean up\n", daisyGracePeriod)
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		log.Printf("Cannot interrupt Daisy: %v\n", err)
+	}
+	timer := time.NewTimer(daisyGracePeriod)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+	log.Printf("Daisy did not exit within %v, killing it. Resources it created may be left behind.\n",
+		daisyGracePeriod)
+	if err := cmd.Process.Kill(); err != nil {
+		log.Printf("Cannot kill Daisy: %v\n", err)
 	}
-	cmd := exec.Command(files.DaisyBin, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
-	return cmd.Run()
+	return <-done
+}
+
+// runDaisy runs Daisy with the given arguments and reports the progress of the steps of the given state
+// file entries on stdout. In the JSON progress format, the output of Daisy is written to stderr so that
+// stdout only contains progress events. Otherwise it is written to stdout. It returns how the steps ran.
+// Daisy is stopped if the given context is cancelled (see waitDaisy).
+func runDaisy(ctx context.Context, daisyBin string, args []string, entries []*fs.StateFileEntry, format string,
+	stdout, stderr io.Writer) ([]*StepProgress, error) {
+	daisyOut := stdout
+	if format == ProgressJSON {
+		daisyOut = stderr
+	}
+	progress := newProgressTracker(format, daisyOut, stdout, entries)
+	pr, pw := io.Pipe()
+	tracked := make(chan error, 1)
+	go func() {
+		err := progress.track(pr)
+		if err != nil {
+			// Keep draining the output of Daisy, so that Daisy does not block. track already copied
+			// the output it could.
+			io.Copy(ioutil.Discard, pr)
+		}
+		tracked <- err
+	}()
+	cmd := exec.Command(daisyBin, args...)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	err := cmd.Start()
+	if err == nil {
+		err = waitDaisy(ctx, cmd)
+	}
+	pw.Close()
+	if trackErr := <-tracked; trackErr != nil {
+		log.Printf("Cannot report the progress of the image build: %v\n", trackErr)
+	}
+	if finishErr := progress.finish(err); finishErr != nil {
+		log.Printf("Cannot report the progress of the image build: %v\n", finishErr)
+	}
+	return progress.steps, err
+}
+
+// DryRun renders the Daisy workflow, the cloud-config of the preload VM and the Daisy arguments that
+// BuildImage would use, writes them to the given output directory and prints them to w. The files that
+// BuildImage would upload to GCS are staged in the "staging" directory of the output directory
+// instead. It neither uploads anything to GCS nor runs Daisy.
+func DryRun(ctx context.Context, files *fs.Files, input, output *config.Image, buildSpec *config.Build, outputDir string,
+	w io.Writer) error {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+	gcs := NewGCSStore(nil, buildSpec.GCSBucket, buildSpec.GCSDir, files.BuildID)
+	daisyWorkflow := filepath.Join(outputDir, daisyWorkflowName)
+	cloudConfigFile := filepath.Join(outputDir, "cloud_config.yaml")
+	preloadVM, err := newPreloadVMName()
+	if err != nil {
+		return err
+	}
+	args, err := workflowArgs(gcs, files, input, output, buildSpec, preloadVM, daisyWorkflow, cloudConfigFile)
+	if err != nil {
+		return err
+	}
+	argsFile := filepath.Join(outputDir, "daisy_args")
+	if err := ioutil.WriteFile(argsFile, []byte(strings.Join(args, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	stagingDir := filepath.Join(outputDir, "staging")
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return err
+	}
+	staging := NewLocalStore(stagingDir)
+	uploads := gcsUploads(files, buildSpec)
+	// Dry runs leave the build state untouched, so the builtin build context archive is created in the
+	// output directory. The archive of an earlier dry run into the same directory is replaced.
+	builtinArchive := filepath.Join(outputDir, filepath.Base(files.BuiltinBuildContextArchive))
+	if err := fs.RemoveBuildContextArchive(builtinArchive); err != nil {
+		return err
+	}
+	if err := fs.CreateBuildContextArchive(files.PersistBuiltinBuildContext, builtinArchive); err != nil {
+		return err
+	}
+	uploads[builtinArchive] = uploads[files.BuiltinBuildContextArchive]
+	delete(uploads, files.BuiltinBuildContextArchive)
+	if _, err := stageFiles(ctx, staging, uploads); err != nil {
+		return err
+	}
+	var uploadLines []string
+	for file, object := range uploads {
+		uploadLines = append(uploadLines, fmt.Sprintf("%s -> %s (staged at %s)", file, gcs.URL(object), staging.URL(object)))
+	}
+	sort.Strings(uploadLines)
+	fmt.Fprintf(w, "GCS uploads:\n%s\n\n", strings.Join(uploadLines, "\n"))
+	fmt.Fprintf(w, "Daisy command (%s):\n%s %s\n", argsFile, files.DaisyBin, strings.Join(args, " "))
+	for _, f := range []string{daisyWorkflow, cloudConfigFile} {
+		contents, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\n%s:\n%s\n", f, string(contents))
+	}
+	return nil
 }
@@ -15,19 +15,24 @@
 package preloader
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"cos-customizer/config"
 	"cos-customizer/fakes"
 	"cos-customizer/fs"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	compute "google.golang.org/api/compute/v1"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -48,7 +53,7 @@ func setupFiles() (string, *fs.Files, error) {
 	if err != nil {
 		return "", nil, err
 	}
-	files := &fs.Files{}
+	files := &fs.Files{BuildID: fs.DefaultBuildID}
 	files.UserBuildContextArchive, err = createTempFile(tmpDir)
 	if err != nil {
 		os.RemoveAll(tmpDir)
@@ -64,11 +69,6 @@ func setupFiles() (string, *fs.Files, error) {
 		os.RemoveAll(tmpDir)
 		return "", nil, err
 	}
-	files.DaisyWorkflow, err = createTempFile(tmpDir)
-	if err != nil {
-		os.RemoveAll(tmpDir)
-		return "", nil, err
-	}
 	files.StartupScript, err = createTempFile(tmpDir)
 	if err != nil {
 		os.RemoveAll(tmpDir)
@@ -92,16 +92,18 @@ func TestDaisyArgsGCSUpload(t *testing.T) {
 		t.Fatal(err)
 	}
 	var testData = []struct {
-		testName string
-		file     string
-		object   string
-		contents []byte
+		testName   string
+		file       string
+		object     string
+		contents   []byte
+		compressed bool
 	}{
 		{
-			testName: "UserBuildContextArchive",
-			file:     files.UserBuildContextArchive,
-			object:   filepath.Base(files.UserBuildContextArchive),
-			contents: []byte("abc"),
+			testName:   "UserBuildContextArchive",
+			file:       files.UserBuildContextArchive,
+			object:     filepath.Base(files.UserBuildContextArchive) + ".gz",
+			contents:   []byte("abc"),
+			compressed: true,
 		},
 		{
 			testName: "BuiltinBuildContextArchive",
@@ -127,27 +129,306 @@ func TestDaisyArgsGCSUpload(t *testing.T) {
 	for _, input := range testData {
 		t.Run(input.testName, func(t *testing.T) {
 			gcs.Objects = make(map[string][]byte)
-			gm := &gcsManager{gcsClient: gcs.Client, gcsBucket: "bucket"}
+			gm := NewGCSStore(gcs.Client, "bucket", "", "default")
 			if err := ioutil.WriteFile(input.file, input.contents, 0744); err != nil {
 				t.Fatal(err)
 			}
 			buildSpec := &config.Build{
 				GCSFiles: []string{filepath.Join(tmpDir, "test-file")},
 			}
-			if _, err := daisyArgs(context.Background(), gm, files, config.NewImage("", ""), config.NewImage("", ""), buildSpec); err != nil {
+			if _, _, err := daisyArgs(context.Background(), gm, files, config.NewImage("", ""), config.NewImage("", ""), buildSpec, ""); err != nil {
 				t.Fatalf("daisyArgs: %v", err)
 			}
-			got, ok := gcs.Objects[fmt.Sprintf("/bucket/cos-customizer/%s", input.object)]
+			got, ok := gcs.Objects[fmt.Sprintf("/bucket/cos-customizer/default/%s", input.object)]
 			if !ok {
-				t.Fatalf("daisyArgs: write /bucket/cos-customizer/%s: not found", input.object)
+				t.Fatalf("daisyArgs: write /bucket/cos-customizer/default/%s: not found", input.object)
+			}
+			if input.compressed {
+				gzipReader, err := gzip.NewReader(bytes.NewReader(got))
+				if err != nil {
+					t.Fatalf("daisyArgs: write /bucket/cos-customizer/default/%s: %v", input.object, err)
+				}
+				if got, err = ioutil.ReadAll(gzipReader); err != nil {
+					t.Fatalf("daisyArgs: write /bucket/cos-customizer/default/%s: %v", input.object, err)
+				}
 			}
 			if !cmp.Equal(got, input.contents) {
-				t.Errorf("daisyArgs: write /bucket/cos-customizer/%s: got %s, want %s", input.object, string(got), string(input.contents))
+				t.Errorf("daisyArgs: write /bucket/cos-customizer/default/%s: got %s, want %s", input.object, string(got), string(input.contents))
+			}
+		})
+	}
+}
+
+func TestDaisyArgsLocalStore(t *testing.T) {
+	tmpDir, files, err := setupFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := ioutil.WriteFile(files.StateFile, []byte("state"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := NewLocalStore(filepath.Join(tmpDir, "staging"))
+	args, _, err := daisyArgs(context.Background(), store, files, config.NewImage("", ""), config.NewImage("", ""), &config.Build{}, "")
+	if err != nil {
+		t.Fatalf("daisyArgs: %v", err)
+	}
+	stateFile, ok := getDaisyVarValue("state_file", args)
+	if want := store.URL(filepath.Base(files.StateFile)); !ok || stateFile != want {
+		t.Fatalf("daisyArgs: state_file = %q, want %q", stateFile, want)
+	}
+	got, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "state" {
+		t.Errorf("daisyArgs: staged state file = %q, want %q", string(got), "state")
+	}
+}
+
+func TestStageFilesSkipsUnchanged(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gcs := fakes.GCSForTest(t)
+	defer gcs.Close()
+	store := NewGCSStore(gcs.Client, "bucket", "dir", "default")
+	ctx := context.Background()
+	toStage := map[string]string{
+		filepath.Join(tmpDir, "a"): "a",
+		filepath.Join(tmpDir, "b"): "b.gz",
+	}
+	if _, err := stageFiles(ctx, store, toStage); err != nil {
+		t.Fatal(err)
+	}
+	if gcs.Uploads != 2 {
+		t.Fatalf("stageFiles(_, _, %v): got %d uploads, want 2", toStage, gcs.Uploads)
+	}
+	if _, err := stageFiles(ctx, store, toStage); err != nil {
+		t.Fatal(err)
+	}
+	if gcs.Uploads != 2 {
+		t.Errorf("stageFiles(_, _, %v) of unchanged files: got %d uploads, want none", toStage, gcs.Uploads-2)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "b"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	toStage = map[string]string{
+		filepath.Join(tmpDir, "b"): "b.gz",
+		filepath.Join(tmpDir, "c"): "c",
+	}
+	if _, err := stageFiles(ctx, store, toStage); err != nil {
+		t.Fatal(err)
+	}
+	if gcs.Uploads != 4 {
+		t.Errorf("stageFiles(_, _, %v) of a changed and a new file: got %d uploads, want 2", toStage, gcs.Uploads-2)
+	}
+	if _, ok := gcs.Objects["/bucket/dir/cos-customizer/default/a"]; !ok {
+		t.Errorf("stageFiles(_, _, %v): object a of an earlier staging was deleted", toStage)
+	}
+}
+
+func TestStageFilesBuildIDs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	gcs := fakes.GCSForTest(t)
+	defer gcs.Close()
+	ctx := context.Background()
+	for _, buildID := range []string{"base", "gpu"} {
+		file := filepath.Join(tmpDir, buildID)
+		if err := ioutil.WriteFile(file, []byte(buildID), 0644); err != nil {
+			t.Fatal(err)
+		}
+		store := NewGCSStore(gcs.Client, "bucket", "dir", buildID)
+		if _, err := stageFiles(ctx, store, map[string]string{file: "state_file"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, buildID := range []string{"base", "gpu"} {
+		object := fmt.Sprintf("/bucket/dir/cos-customizer/%s/state_file", buildID)
+		if got, ok := gcs.Objects[object]; !ok || string(got) != buildID {
+			t.Errorf("stageFiles: object %s = %q, %t; want %q, true", object, string(got), ok, buildID)
+		}
+	}
+	cleanup(ctx, NewGCSStore(gcs.Client, "bucket", "dir", "base"))
+	if _, ok := gcs.Objects["/bucket/dir/cos-customizer/base/state_file"]; ok {
+		t.Errorf("cleanup: object of build base was not deleted")
+	}
+	if _, ok := gcs.Objects["/bucket/dir/cos-customizer/gpu/state_file"]; !ok {
+		t.Errorf("cleanup: object of build gpu was deleted by the cleanup of build base")
+	}
+}
+
+func TestBuildImageKeepStaging(t *testing.T) {
+	for _, input := range []struct {
+		testName             string
+		daisyBin             string
+		keepStaging          bool
+		keepStagingOnFailure bool
+		wantKept             bool
+	}{
+		{"Default", "/bin/true", false, false, false},
+		{"DefaultFailure", "/bin/false", false, false, false},
+		{"KeepStaging", "/bin/true", true, false, true},
+		{"KeepStagingFailure", "/bin/false", true, false, false},
+		{"KeepStagingOnFailure", "/bin/false", false, true, true},
+		{"KeepStagingOnFailureSuccess", "/bin/true", false, true, false},
+	} {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			files.DaisyBin = input.daisyBin
+			store := NewLocalStore(filepath.Join(tmpDir, "staging"))
+			buildSpec := &config.Build{KeepStaging: input.keepStaging, KeepStagingOnFailure: input.keepStagingOnFailure}
+			BuildImage(context.Background(), store, files, config.NewImage("", ""), config.NewImage("", ""), buildSpec)
+			objects, err := store.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotKept := len(objects) > 0; gotKept != input.wantKept {
+				t.Errorf("BuildImage(%s, %+v): staged objects %v; want kept: %v", input.daisyBin, buildSpec,
+					objects, input.wantKept)
+			}
+		})
+	}
+}
+
+func TestNewPreloadVMName(t *testing.T) {
+	name, err := newPreloadVMName()
+	if err != nil {
+		t.Fatalf("newPreloadVMName: %v", err)
+	}
+	if !PreloadVMNameRegexp.MatchString(name) {
+		t.Errorf("newPreloadVMName() = %q; want a match of %s", name, PreloadVMNameRegexp)
+	}
+}
+
+func TestBuildImageKeepOnFailure(t *testing.T) {
+	for _, input := range []struct {
+		testName      string
+		daisyBin      string
+		keepOnFailure bool
+		want          string
+	}{
+		{"Default", "/bin/false", false, ""},
+		{"KeepOnFailure", "/bin/false", true, "preload-vm-test"},
+		{"KeepOnFailureSuccess", "/bin/true", true, ""},
+	} {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, files, err := setupFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			defer func(f func() (string, error)) { newPreloadVMName = f }(newPreloadVMName)
+			newPreloadVMName = func() (string, error) { return "preload-vm-test", nil }
+			files.DaisyBin = input.daisyBin
+			store := NewLocalStore(filepath.Join(tmpDir, "staging"))
+			buildSpec := &config.Build{KeepOnFailure: input.keepOnFailure}
+			result, _ := BuildImage(context.Background(), store, files, config.NewImage("", ""), config.NewImage("", ""), buildSpec)
+			if result.DebugVM != input.want {
+				t.Errorf("BuildImage(%s, %+v): DebugVM = %q; want %q", input.daisyBin, buildSpec, result.DebugVM, input.want)
+			}
+		})
+	}
+}
+
+func TestRunDaisyCancel(t *testing.T) {
+	for _, input := range []struct {
+		testName    string
+		trap        string
+		gracePeriod time.Duration
+		wantCleanup bool
+		wantCode    int
+	}{
+		{"Interrupted", "echo cleaned up > cleanup; exit 3", time.Minute, true, 3},
+		{"Killed", "", 100 * time.Millisecond, false, -1},
+	} {
+		t.Run(input.testName, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			defer func(d time.Duration) { daisyGracePeriod = d }(daisyGracePeriod)
+			daisyGracePeriod = input.gracePeriod
+			daisyBin := filepath.Join(tmpDir, "daisy")
+			// The child process does not hold on to the output of Daisy, so that Daisy's output is closed
+			// when Daisy is killed.
+			script := fmt.Sprintf("#!/bin/bash\ncd %s\ntrap '%s' INT\ntouch ready\nsleep 60 >/dev/null 2>&1 &\nwait\n",
+				tmpDir, input.trap)
+			if err := ioutil.WriteFile(daisyBin, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				for {
+					if _, err := os.Stat(filepath.Join(tmpDir, "ready")); err == nil {
+						cancel()
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+			_, err = runDaisy(ctx, daisyBin, nil, nil, ProgressText, ioutil.Discard, ioutil.Discard)
+			if code := daisyExitCode(err); code == nil || *code != input.wantCode {
+				t.Errorf("runDaisy(%s) = %v; want exit code %d", daisyBin, err, input.wantCode)
+			}
+			_, err = os.Stat(filepath.Join(tmpDir, "cleanup"))
+			if gotCleanup := err == nil; gotCleanup != input.wantCleanup {
+				t.Errorf("runDaisy(%s): Daisy cleaned up: %v; want %v", daisyBin, gotCleanup, input.wantCleanup)
 			}
 		})
 	}
 }
 
+func TestBuildImageCancelled(t *testing.T) {
+	tmpDir, files, err := setupFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	files.DaisyBin = filepath.Join(tmpDir, "daisy")
+	script := fmt.Sprintf("#!/bin/bash\ntrap 'exit 1' INT\ntouch %s/ready\nsleep 60 >/dev/null 2>&1 &\nwait\n", tmpDir)
+	if err := ioutil.WriteFile(files.DaisyBin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gcs := fakes.GCSForTest(t)
+	defer gcs.Close()
+	store := NewGCSStore(gcs.Client, "bucket", "dir", "default")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			if _, err := os.Stat(filepath.Join(tmpDir, "ready")); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if _, err := BuildImage(ctx, store, files, config.NewImage("", ""), config.NewImage("", ""), &config.Build{}); err == nil {
+		t.Error("BuildImage(cancelled context) = nil; want error")
+	}
+	if len(gcs.Objects) != 0 {
+		t.Errorf("BuildImage(cancelled context): staged objects %v; want none", gcs.Objects)
+	}
+}
+
 func getDaisyVarValue(variable string, args []string) (string, bool) {
 	for i, arg := range args {
 		if arg == fmt.Sprintf("-var:%s", variable) {
@@ -221,14 +502,14 @@ func TestDaisyArgsCloudConfig(t *testing.T) {
 			}
 			defer os.RemoveAll(tmpDir)
 			gcs.Objects = make(map[string][]byte)
-			gm := &gcsManager{gcsClient: gcs.Client, gcsBucket: "bucket"}
+			gm := NewGCSStore(gcs.Client, "bucket", "", "default")
 			if err := ioutil.WriteFile(files.StartupScript, input.startupScript, 0744); err != nil {
 				t.Fatal(err)
 			}
 			if err := ioutil.WriteFile(files.SystemdService, input.systemdService, 0744); err != nil {
 				t.Fatal(err)
 			}
-			args, err := daisyArgs(context.Background(), gm, files, config.NewImage("", ""), config.NewImage("", ""), &config.Build{})
+			args, _, err := daisyArgs(context.Background(), gm, files, config.NewImage("", ""), config.NewImage("", ""), &config.Build{}, "")
 			if err != nil {
 				t.Fatalf("daisyArgs: %v", err)
 			}
@@ -254,69 +535,63 @@ func TestDaisyArgsCloudConfig(t *testing.T) {
 	}
 }
 
-func TestDaisyArgsWorkflowTemplate(t *testing.T) {
+func TestDaisyArgsWorkflow(t *testing.T) {
 	var testData = []struct {
-		testName    string
-		outputImage *config.Image
-		buildConfig *config.Build
-		workflow    []byte
-		want        []byte
+		testName         string
+		outputImage      *config.Image
+		buildConfig      *config.Build
+		wantLicenses     []string
+		wantLabels       map[string]string
+		wantAccelerators []*daisyAccelerator
 	}{
 		{
 			testName:    "Empty",
 			outputImage: config.NewImage("", ""),
 			buildConfig: &config.Build{GCSBucket: "bucket"},
-			workflow:    []byte("{{.Licenses}} {{.Labels}} {{.Accelerators}}"),
-			want:        []byte("null {} []"),
 		},
 		{
-			testName:    "OneLicense",
-			outputImage: &config.Image{&compute.Image{Licenses: []string{"my-license"}}, ""},
-			buildConfig: &config.Build{GCSBucket: "bucket"},
-			workflow:    []byte("{{.Licenses}}"),
-			want:        []byte("[\"my-license\"]"),
+			testName:     "OneLicense",
+			outputImage:  &config.Image{&compute.Image{Licenses: []string{"my-license"}}, ""},
+			buildConfig:  &config.Build{GCSBucket: "bucket"},
+			wantLicenses: []string{"my-license"},
 		},
 		{
-			testName:    "TwoLicenses",
-			outputImage: &config.Image{&compute.Image{Licenses: []string{"license-1", "license-2"}}, ""},
-			buildConfig: &config.Build{GCSBucket: "bucket"},
-			workflow:    []byte("{{.Licenses}}"),
-			want:        []byte("[\"license-1\",\"license-2\"]"),
+			testName:     "TwoLicenses",
+			outputImage:  &config.Image{&compute.Image{Licenses: []string{"license-1", "license-2"}}, ""},
+			buildConfig:  &config.Build{GCSBucket: "bucket"},
+			wantLicenses: []string{"license-1", "license-2"},
 		},
 		{
 			testName:    "EmptyStringLicense",
 			outputImage: &config.Image{&compute.Image{Licenses: []string{""}}, ""},
 			buildConfig: &config.Build{GCSBucket: "bucket"},
-			workflow:    []byte("{{.Licenses}}"),
-			want:        []byte("null"),
 		},
 		{
-			testName:    "OneEmptyLicense",
-			outputImage: &config.Image{&compute.Image{Licenses: []string{"license-1", ""}}, ""},
-			buildConfig: &config.Build{GCSBucket: "bucket"},
-			workflow:    []byte("{{.Licenses}}"),
-			want:        []byte("[\"license-1\"]"),
+			testName:     "OneEmptyLicense",
+			outputImage:  &config.Image{&compute.Image{Licenses: []string{"license-1", ""}}, ""},
+			buildConfig:  &config.Build{GCSBucket: "bucket"},
+			wantLicenses: []string{"license-1"},
 		},
 		{
-			testName:    "URLLicense",
-			outputImage: &config.Image{&compute.Image{Licenses: []string{"https://www.googleapis.com/compute/v1/projects/my-proj/global/licenses/my-license"}}, ""},
-			buildConfig: &config.Build{GCSBucket: "bucket"},
-			workflow:    []byte("{{.Licenses}}"),
-			want:        []byte("[\"projects/my-proj/global/licenses/my-license\"]"),
+			testName:     "URLLicense",
+			outputImage:  &config.Image{&compute.Image{Licenses: []string{"https://www.googleapis.com/compute/v1/projects/my-proj/global/licenses/my-license"}}, ""},
+			buildConfig:  &config.Build{GCSBucket: "bucket"},
+			wantLicenses: []string{"projects/my-proj/global/licenses/my-license"},
 		},
 		{
 			testName:    "Labels",
 			outputImage: &config.Image{&compute.Image{Labels: map[string]string{"key": "value"}}, ""},
 			buildConfig: &config.Build{GCSBucket: "bucket"},
-			workflow:    []byte("{{.Labels}}"),
-			want:        []byte("{\"key\":\"value\"}"),
+			wantLabels:  map[string]string{"key": "value"},
 		},
 		{
 			testName:    "Accelerators",
 			outputImage: config.NewImage("", ""),
 			buildConfig: &config.Build{GCSBucket: "bucket", GPUType: "nvidia-tesla-k80", Project: "p", Zone: "z"},
-			workflow:    []byte("{{.Accelerators}}"),
-			want:        []byte("[{\"acceleratorCount\":1,\"acceleratorType\":\"projects/p/zones/z/acceleratorTypes/nvidia-tesla-k80\"}]"),
+			wantAccelerators: []*daisyAccelerator{{
+				AcceleratorType:  "projects/p/zones/z/acceleratorTypes/nvidia-tesla-k80",
+				AcceleratorCount: 1,
+			}},
 		},
 	}
 	gcs := fakes.GCSForTest(t)
@@ -329,20 +604,29 @@ func TestDaisyArgsWorkflowTemplate(t *testing.T) {
 			}
 			defer os.RemoveAll(tmpDir)
 			gcs.Objects = make(map[string][]byte)
-			gm := &gcsManager{gcs.Client, input.buildConfig.GCSBucket, input.buildConfig.GCSDir}
-			if err := ioutil.WriteFile(files.DaisyWorkflow, input.workflow, 0744); err != nil {
-				t.Fatal(err)
-			}
-			args, err := daisyArgs(context.Background(), gm, files, config.NewImage("", ""), input.outputImage, input.buildConfig)
+			gm := NewGCSStore(gcs.Client, input.buildConfig.GCSBucket, input.buildConfig.GCSDir, "default")
+			args, _, err := daisyArgs(context.Background(), gm, files, config.NewImage("", ""), input.outputImage, input.buildConfig, "")
 			if err != nil {
 				t.Fatalf("daisyArgs: %v", err)
 			}
-			got, err := ioutil.ReadFile(args[len(args)-1])
+			data, err := ioutil.ReadFile(args[len(args)-1])
 			if err != nil {
 				t.Fatal(err)
 			}
-			if !cmp.Equal(got, input.want) {
-				t.Errorf("daisyArgs: template Daisy: got %s, want %s", string(got), string(input.want))
+			var got daisyWorkflow
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("daisyArgs: workflow %q: %v", string(data), err)
+			}
+			image := got.Steps["image"].CreateImages[0]
+			if diff := cmp.Diff(image.Licenses, input.wantLicenses); diff != "" {
+				t.Errorf("daisyArgs: workflow licenses diff (-got, +want): %s", diff)
+			}
+			if diff := cmp.Diff(image.Labels, input.wantLabels, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("daisyArgs: workflow labels diff (-got, +want): %s", diff)
+			}
+			instance := got.Steps["run"].CreateInstances[0]
+			if diff := cmp.Diff(instance.GuestAccelerators, input.wantAccelerators); diff != "" {
+				t.Errorf("daisyArgs: workflow accelerators diff (-got, +want): %s", diff)
 			}
 		})
 	}
@@ -426,7 +710,7 @@ func TestDaisyArgs(t *testing.T) {
 			buildConfig: &config.Build{GCSBucket: "bucket", GCSDir: "dir"},
 			want: []string{
 				"-var:user_build_context",
-				fmt.Sprintf("gs://bucket/dir/cos-customizer/%s", filepath.Base(files.UserBuildContextArchive)),
+				fmt.Sprintf("gs://bucket/dir/cos-customizer/default/%s.gz", filepath.Base(files.UserBuildContextArchive)),
 			},
 		},
 		{
@@ -436,7 +720,7 @@ func TestDaisyArgs(t *testing.T) {
 			buildConfig: &config.Build{GCSBucket: "bucket", GCSDir: "dir"},
 			want: []string{
 				"-var:builtin_build_context",
-				fmt.Sprintf("gs://bucket/dir/cos-customizer/%s", filepath.Base(files.BuiltinBuildContextArchive)),
+				fmt.Sprintf("gs://bucket/dir/cos-customizer/default/%s", filepath.Base(files.BuiltinBuildContextArchive)),
 			},
 		},
 		{
@@ -446,7 +730,7 @@ func TestDaisyArgs(t *testing.T) {
 			buildConfig: &config.Build{GCSBucket: "bucket", GCSDir: "dir"},
 			want: []string{
 				"-var:state_file",
-				fmt.Sprintf("gs://bucket/dir/cos-customizer/%s", filepath.Base(files.StateFile)),
+				fmt.Sprintf("gs://bucket/dir/cos-customizer/default/%s", filepath.Base(files.StateFile)),
 			},
 		},
 		{
@@ -468,7 +752,7 @@ func TestDaisyArgs(t *testing.T) {
 			inputImage:  config.NewImage("", ""),
 			outputImage: config.NewImage("", ""),
 			buildConfig: &config.Build{GCSBucket: "bucket", GCSDir: "dir"},
-			want:        []string{"-gcs_path", "gs://bucket/dir/cos-customizer"},
+			want:        []string{"-gcs_path", "gs://bucket/dir/cos-customizer/default"},
 		},
 		{
 			testName:    "Project",
@@ -496,7 +780,14 @@ func TestDaisyArgs(t *testing.T) {
 			inputImage:  config.NewImage("", ""),
 			outputImage: config.NewImage("", ""),
 			buildConfig: &config.Build{GCSBucket: "bucket", GCSDir: "dir"},
-			want:        []string{"-var:gcs_files", "gs://bucket/dir/cos-customizer/gcs_files"},
+			want:        []string{"-var:gcs_files", "gs://bucket/dir/cos-customizer/default/gcs_files"},
+		},
+		{
+			testName:    "KeepOnFailure",
+			inputImage:  config.NewImage("", ""),
+			outputImage: config.NewImage("", ""),
+			buildConfig: &config.Build{KeepOnFailure: true, GCSBucket: "bucket", GCSDir: "dir"},
+			want:        []string{"-var:preload_vm_name", "preload-vm-test"},
 		},
 	}
 	gcs := fakes.GCSForTest(t)
@@ -504,8 +795,9 @@ func TestDaisyArgs(t *testing.T) {
 	for _, input := range testData {
 		t.Run(input.testName, func(t *testing.T) {
 			gcs.Objects = make(map[string][]byte)
-			gm := &gcsManager{gcs.Client, input.buildConfig.GCSBucket, input.buildConfig.GCSDir}
-			got, err := daisyArgs(context.Background(), gm, files, input.inputImage, input.outputImage, input.buildConfig)
+			gm := NewGCSStore(gcs.Client, input.buildConfig.GCSBucket, input.buildConfig.GCSDir, "default")
+			got, _, err := daisyArgs(context.Background(), gm, files, input.inputImage, input.outputImage, input.buildConfig,
+				"preload-vm-test")
 			if err != nil {
 				t.Fatalf("daisyArgs: %v", err)
 			}
@@ -516,3 +808,79 @@ func TestDaisyArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestDryRun(t *testing.T) {
+	tmpDir, files, err := setupFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := ioutil.WriteFile(files.StartupScript, []byte("echo hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputImage := config.NewImage("out", "out-project")
+	outputImage.Labels["hello"] = "world"
+	buildSpec := &config.Build{GCSBucket: "bucket", GCSDir: "dir", Project: "p", Zone: "z", Timeout: "1h"}
+	files.PersistBuiltinBuildContext = filepath.Join(tmpDir, "builtin_build_context")
+	if err := os.Mkdir(files.PersistBuiltinBuildContext, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files.StateFile, []byte("state"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputDir := filepath.Join(tmpDir, "dry_run")
+	output := new(strings.Builder)
+	if err := DryRun(context.Background(), files, config.NewImage("in", "in-project"), outputImage, buildSpec, outputDir, output); err != nil {
+		t.Fatalf("DryRun: %v", err)
+	}
+	argsData, err := ioutil.ReadFile(filepath.Join(outputDir, "daisy_args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Split(strings.TrimSpace(string(argsData)), "\n")
+	cloudConfig, ok := getDaisyVarValue("cloud_config", args)
+	if !ok || cloudConfig != filepath.Join(outputDir, "cloud_config.yaml") {
+		t.Errorf("DryRun: daisy_args: cloud_config = %q, want %q", cloudConfig, filepath.Join(outputDir, "cloud_config.yaml"))
+	}
+	workflow := args[len(args)-1]
+	if want := filepath.Join(outputDir, daisyWorkflowName); workflow != want {
+		t.Errorf("DryRun: daisy_args: workflow = %q, want %q", workflow, want)
+	}
+	workflowData, err := ioutil.ReadFile(workflow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotWorkflow daisyWorkflow
+	if err := json.Unmarshal(workflowData, &gotWorkflow); err != nil {
+		t.Fatalf("DryRun: workflow %q: %v", string(workflowData), err)
+	}
+	if got, want := gotWorkflow.Steps["image"].CreateImages[0].Labels, outputImage.Labels; !cmp.Equal(got, want) {
+		t.Errorf("DryRun: workflow labels = %v, want %v", got, want)
+	}
+	cloudConfigData, err := ioutil.ReadFile(cloudConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(cloudConfigData), "echo hello") {
+		t.Errorf("DryRun: cloud config %q does not contain the startup script", string(cloudConfigData))
+	}
+	wantUpload := fmt.Sprintf("%s -> gs://bucket/dir/cos-customizer/default/%s", files.StateFile, filepath.Base(files.StateFile))
+	if !strings.Contains(output.String(), wantUpload) {
+		t.Errorf("DryRun: output %q does not contain %q", output.String(), wantUpload)
+	}
+	staged, err := ioutil.ReadFile(filepath.Join(outputDir, "staging", filepath.Base(files.StateFile)))
+	if err != nil {
+		t.Fatalf("DryRun: staged state file: %v", err)
+	}
+	if string(staged) != "state" {
+		t.Errorf("DryRun: staged state file = %q, want %q", string(staged), "state")
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "staging", filepath.Base(files.BuiltinBuildContextArchive))); err != nil {
+		t.Errorf("DryRun: staged builtin build context archive: %v", err)
+	}
+	// A dry run into the directory of an earlier dry run replaces its output.
+	if err := DryRun(context.Background(), files, config.NewImage("in", "in-project"), outputImage, buildSpec, outputDir,
+		new(strings.Builder)); err != nil {
+		t.Errorf("DryRun: second dry run into %s: %v", outputDir, err)
+	}
+}
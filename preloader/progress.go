@@ -0,0 +1,370 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"cos-customizer/fs"
+)
+
+const (
+	// ProgressText reports the progress of an image build as human readable lines that are
+	// interleaved with the output of Daisy.
+	ProgressText = "text"
+
+	// ProgressJSON reports the progress of an image build as a stream of JSON encoded
+	// ProgressEvents, one per line. The output of Daisy is written separately.
+	ProgressJSON = "json"
+)
+
+// Types of ProgressEvents.
+const (
+	StepStarted    = "step_started"
+	StepFinished   = "step_finished"
+	StepFailed     = "step_failed"
+	BuildSucceeded = "build_succeeded"
+	BuildFailed    = "build_failed"
+)
+
+// Prefixes of the serial port output of the preload VM that Daisy reports. They are matched by the
+// WaitForInstancesSignal steps of the Daisy workflow.
+const (
+	buildStatusPrefix    = "BuildStatus:"
+	buildSucceededPrefix = "BuildSucceeded:"
+	buildFailedPrefix    = "BuildFailed:"
+)
+
+// progressMarker starts the status lines that startup.sh writes when a step of the state file starts,
+// finishes or fails, like "__cos_customizer_progress__ step 3 started", and the lines that
+// preload_container_images.sh writes when it pulled a container image, like
+// "__cos_customizer_progress__ image busybox ["busybox@sha256:..."]". It is unusual enough that the
+// output of the scripts run by the steps doesn't contain it by accident.
+const progressMarker = "__cos_customizer_progress__"
+
+// ProgressEvent is an event in the progress of an image build.
+type ProgressEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Step is the ID of the step that the event is about. Zero for events about the whole build.
+	Step int `json:"step,omitempty"`
+	// Index is the position of the step in the state file, starting at 1.
+	Index int `json:"index,omitempty"`
+	// Total is the number of steps in the state file.
+	Total        int     `json:"total,omitempty"`
+	BuildContext string  `json:"buildContext,omitempty"`
+	Script       string  `json:"script,omitempty"`
+	DurationSec  float64 `json:"durationSec,omitempty"`
+	Message      string  `json:"message,omitempty"`
+}
+
+// StepProgress records how a step of the state file ran on the preload VM.
+type StepProgress struct {
+	Entry *fs.StateFileEntry
+	Start time.Time
+	// End is zero if the step did not finish.
+	End    time.Time
+	Failed bool
+	// RepoDigests maps the container images that the step pulled to their repository digests, as
+	// reported by 'docker inspect' on the preload VM.
+	RepoDigests map[string][]string
+}
+
+// Duration returns how long the step ran for.
+func (s *StepProgress) Duration() time.Duration {
+	if s.End.IsZero() {
+		return 0
+	}
+	return s.End.Sub(s.Start)
+}
+
+// progressTracker follows the output of Daisy and reports the progress of the steps that run on the
+// preload VM. The output of Daisy is copied to daisyOut.
+type progressTracker struct {
+	format   string
+	daisyOut io.Writer
+	out      io.Writer
+	now      func() time.Time
+	entries  []*fs.StateFileEntry
+	steps    []*StepProgress
+	current  *StepProgress
+	start    time.Time
+	// done is set once the result of the image build has been reported.
+	done bool
+}
+
+// newProgressTracker creates a progressTracker for the given state file entries. Progress is written
+// to out in the given format.
+func newProgressTracker(format string, daisyOut, out io.Writer, entries []*fs.StateFileEntry) *progressTracker {
+	return &progressTracker{
+		format:   format,
+		daisyOut: daisyOut,
+		out:      out,
+		now:      time.Now,
+		entries:  entries,
+	}
+}
+
+// serialOutput extracts the serial port output that starts with the given prefix from a line of
+// Daisy output. Daisy may quote the serial port output that it reports.
+func serialOutput(line, prefix string) (string, bool) {
+	i := strings.Index(line, prefix)
+	if i < 0 {
+		return "", false
+	}
+	if i > 0 && line[i-1] == '"' {
+		if s, err := strconv.Unquote(strings.TrimSpace(line[i-1:])); err == nil {
+			return strings.TrimSpace(strings.TrimPrefix(s, prefix)), true
+		}
+	}
+	return strings.TrimSpace(line[i+len(prefix):]), true
+}
+
+func (p *progressTracker) stepEvent(eventType string, step *StepProgress, t time.Time) *ProgressEvent {
+	event := &ProgressEvent{
+		Time:         t,
+		Type:         eventType,
+		Step:         step.Entry.ID,
+		Total:        len(p.entries),
+		BuildContext: string(step.Entry.BuildContext),
+		Script:       step.Entry.Script,
+		DurationSec:  step.Duration().Seconds(),
+	}
+	for i, entry := range p.entries {
+		if entry.ID == step.Entry.ID {
+			event.Index = i + 1
+		}
+	}
+	return event
+}
+
+func (p *progressTracker) emit(event *ProgressEvent) error {
+	if p.format == ProgressJSON {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(p.out, "%s\n", data)
+		return err
+	}
+	duration := time.Duration(event.DurationSec * float64(time.Second)).Round(time.Second)
+	elapsed := event.Time.Sub(p.start).Round(time.Second)
+	var msg string
+	switch event.Type {
+	case StepStarted:
+		msg = "started"
+	case StepFinished:
+		msg = fmt.Sprintf("finished in %v", duration)
+	case StepFailed:
+		msg = fmt.Sprintf("failed after %v", duration)
+	case BuildSucceeded:
+		_, err := fmt.Fprintf(p.out, "Progress: build succeeded after %v\n", elapsed)
+		return err
+	case BuildFailed:
+		_, err := fmt.Fprintf(p.out, "Progress: build failed after %v: %s\n", elapsed, event.Message)
+		return err
+	}
+	_, err := fmt.Fprintf(p.out, "Progress: [%d/%d] %s script %s (step %d) %s\n", event.Index, event.Total,
+		event.BuildContext, event.Script, event.Step, msg)
+	return err
+}
+
+// finishStep finishes the current step, if there is one.
+func (p *progressTracker) finishStep(failed bool, t time.Time) error {
+	if p.current == nil {
+		return nil
+	}
+	step := p.current
+	p.current = nil
+	step.End = t
+	step.Failed = failed
+	eventType := StepFinished
+	if failed {
+		eventType = StepFailed
+	}
+	return p.emit(p.stepEvent(eventType, step, t))
+}
+
+// startStep makes the step with the given ID the current step. If the step already started, for
+// example before the preload VM rebooted, it is resumed.
+func (p *progressTracker) startStep(id int, t time.Time) error {
+	if p.current != nil && p.current.Entry.ID != id {
+		if err := p.finishStep(false, t); err != nil {
+			return err
+		}
+	}
+	var step *StepProgress
+	for _, s := range p.steps {
+		if s.Entry.ID == id {
+			step = s
+		}
+	}
+	if step == nil {
+		entry := &fs.StateFileEntry{ID: id}
+		for _, e := range p.entries {
+			if e.ID == id {
+				entry = e
+			}
+		}
+		step = &StepProgress{Entry: entry, Start: t}
+		p.steps = append(p.steps, step)
+	}
+	step.End = time.Time{}
+	step.Failed = false
+	p.current = step
+	return p.emit(p.stepEvent(StepStarted, step, t))
+}
+
+// recordRepoDigests records the repository digests of a container image that the current step
+// pulled. Digests that cannot be parsed are skipped; the preload VM logs them anyway.
+func (p *progressTracker) recordRepoDigests(image, digestsJSON string) {
+	if p.current == nil {
+		return
+	}
+	var digests []string
+	if err := json.Unmarshal([]byte(digestsJSON), &digests); err != nil {
+		return
+	}
+	if p.current.RepoDigests == nil {
+		p.current.RepoDigests = make(map[string][]string)
+	}
+	p.current.RepoDigests[image] = digests
+}
+
+// parseProgressMarker splits a status line that starts with progressMarker into the fields that
+// follow the marker.
+func parseProgressMarker(status string) ([]string, bool) {
+	if !strings.HasPrefix(status, progressMarker+" ") {
+		return nil, false
+	}
+	return strings.Fields(strings.TrimPrefix(status, progressMarker)), true
+}
+
+// handleLine processes a line of Daisy output. Daisy may report the result of the image build more
+// than once, for example again in its final error message, so only the first report is used.
+func (p *progressTracker) handleLine(line string) error {
+	if p.done {
+		return nil
+	}
+	t := p.now()
+	if msg, ok := serialOutput(line, buildFailedPrefix); ok {
+		if err := p.finishStep(true, t); err != nil {
+			return err
+		}
+		p.done = true
+		return p.emit(&ProgressEvent{Time: t, Type: BuildFailed, Message: msg})
+	}
+	if msg, ok := serialOutput(line, buildSucceededPrefix); ok {
+		if err := p.finishStep(false, t); err != nil {
+			return err
+		}
+		p.done = true
+		return p.emit(&ProgressEvent{Time: t, Type: BuildSucceeded, Message: msg})
+	}
+	status, ok := serialOutput(line, buildStatusPrefix)
+	if !ok {
+		return nil
+	}
+	fields, ok := parseProgressMarker(status)
+	if !ok || len(fields) != 3 {
+		return nil
+	}
+	switch fields[0] {
+	case "image":
+		p.recordRepoDigests(fields[1], fields[2])
+	case "step":
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil
+		}
+		switch fields[2] {
+		case "started":
+			return p.startStep(id, t)
+		case "finished":
+			return p.finishStep(false, t)
+		case "failed":
+			return p.finishStep(true, t)
+		}
+	}
+	return nil
+}
+
+// track copies the output of Daisy from r to the Daisy output writer and reports the progress of the
+// image build until r is exhausted. If the progress cannot be reported, the rest of the output of Daisy
+// is still copied, since it is most useful when something went wrong.
+func (p *progressTracker) track(r io.Reader) error {
+	p.start = p.now()
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			if _, err := io.WriteString(p.daisyOut, line); err != nil {
+				return err
+			}
+			if err := p.handleLine(strings.TrimRight(line, "\r\n")); err != nil {
+				io.Copy(p.daisyOut, br)
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// finish reports the result of the image build, given the error that Daisy exited with, if the
+// output of Daisy did not report it. In the text format, it then writes the durations of the steps
+// that ran.
+func (p *progressTracker) finish(daisyErr error) error {
+	if !p.done && daisyErr != nil {
+		t := p.now()
+		if err := p.finishStep(true, t); err != nil {
+			return err
+		}
+		p.done = true
+		if err := p.emit(&ProgressEvent{Time: t, Type: BuildFailed, Message: daisyErr.Error()}); err != nil {
+			return err
+		}
+	}
+	if p.format == ProgressJSON || len(p.steps) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintln(p.out, "Progress: step durations:"); err != nil {
+		return err
+	}
+	for _, step := range p.steps {
+		status := step.Duration().Round(time.Second).String()
+		switch {
+		case step.Failed:
+			status = "failed after " + status
+		case step.End.IsZero():
+			status = "did not finish"
+		}
+		if _, err := fmt.Fprintf(p.out, "Progress:   step %d, %s script %s: %s\n", step.Entry.ID,
+			step.Entry.BuildContext, step.Entry.Script, status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cos-customizer/fs"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// daisyStatus formats serial port output of the preload VM like Daisy reports it.
+func daisyStatus(match, output string) string {
+	return fmt.Sprintf("[Daisy] [build-image]: 2020-01-01T00:00:00Z WaitForInstancesSignal: Instance "+
+		"\"preload-vm\": %s found: %q", match, output)
+}
+
+var progressEntries = []*fs.StateFileEntry{
+	{ID: 1, BuildContext: fs.User, Script: "install.sh"},
+	{ID: 3, BuildContext: fs.Builtin, Script: "seal_oem.sh"},
+}
+
+// fakeClock returns a clock that advances by a minute on every read.
+func fakeClock() func() time.Time {
+	t := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		t = t.Add(time.Minute)
+		return t
+	}
+}
+
+func TestSerialOutput(t *testing.T) {
+	testData := []struct {
+		testName string
+		line     string
+		wantOK   bool
+		want     string
+	}{
+		{"Quoted", daisyStatus("StatusMatch", "BuildStatus: a \"quoted\" word"), true, "a \"quoted\" word"},
+		{"Unquoted", "BuildStatus: " + progressMarker + " step 1 started", true, progressMarker + " step 1 started"},
+		{"NoMatch", "[Daisy] Running step \"create-disk\"", false, ""},
+	}
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			got, ok := serialOutput(input.line, buildStatusPrefix)
+			if ok != input.wantOK || got != input.want {
+				t.Errorf("serialOutput(%q, %q) = (%q, %v); want (%q, %v)", input.line, buildStatusPrefix, got, ok,
+					input.want, input.wantOK)
+			}
+		})
+	}
+}
+
+func TestProgressJSON(t *testing.T) {
+	lines := []string{
+		"[Daisy] Running step \"wait-preload-finished\"",
+		daisyStatus("StatusMatch", "BuildStatus: Executing instruction id=$'1' ctx=$'user'..."),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 1 started"),
+		daisyStatus("StatusMatch", "BuildStatus: Executing step 2"),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" image busybox [\"busybox@sha256:"+
+			strings.Repeat("a", 64)+"\"]"),
+		daisyStatus("StatusMatch", "BuildStatus: Done executing instruction id=$'1' ctx=$'user'"),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 1 finished"),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 3 started"),
+		daisyStatus("StatusMatch", "BuildStatus: Script seal_oem.sh failed after 1 attempt(s)."),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 3 failed"),
+		daisyStatus("FailureMatch", "BuildFailed: seal_oem.sh failed"),
+		"[Daisy] Error: FailureMatch found: \"BuildFailed: seal_oem.sh failed\"",
+	}
+	var daisyOut, out bytes.Buffer
+	progress := newProgressTracker(ProgressJSON, &daisyOut, &out, progressEntries)
+	progress.now = fakeClock()
+	if err := progress.track(strings.NewReader(strings.Join(lines, "\n") + "\n")); err != nil {
+		t.Fatalf("track: %v", err)
+	}
+	if err := progress.finish(errors.New("exit status 1")); err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	if got, want := daisyOut.String(), strings.Join(lines, "\n")+"\n"; got != want {
+		t.Errorf("track: Daisy output = %q; want %q", got, want)
+	}
+	var got []ProgressEvent
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var event ProgressEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("progress event %q: %v", line, err)
+		}
+		event.Time = time.Time{}
+		got = append(got, event)
+	}
+	want := []ProgressEvent{
+		{Type: StepStarted, Step: 1, Index: 1, Total: 2, BuildContext: "user", Script: "install.sh"},
+		{Type: StepFinished, Step: 1, Index: 1, Total: 2, BuildContext: "user", Script: "install.sh", DurationSec: 240},
+		{Type: StepStarted, Step: 3, Index: 2, Total: 2, BuildContext: "builtin", Script: "seal_oem.sh"},
+		{Type: StepFailed, Step: 3, Index: 2, Total: 2, BuildContext: "builtin", Script: "seal_oem.sh", DurationSec: 120},
+		{Type: BuildFailed, Message: "seal_oem.sh failed"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("track: progress events diff (-got, +want): %s", diff)
+	}
+	wantDigests := map[string][]string{"busybox": {"busybox@sha256:" + strings.Repeat("a", 64)}}
+	if diff := cmp.Diff(progress.steps[0].RepoDigests, wantDigests); diff != "" {
+		t.Errorf("track: step 1 repo digests diff (-got, +want): %s", diff)
+	}
+}
+
+func TestProgressText(t *testing.T) {
+	lines := []string{
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 1 started"),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 1 finished"),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 3 started"),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 3 finished"),
+		daisyStatus("SuccessMatch", "BuildSucceeded: Build completed with no errors. Shutting down..."),
+	}
+	var out bytes.Buffer
+	progress := newProgressTracker(ProgressText, &out, &out, progressEntries)
+	progress.now = fakeClock()
+	if err := progress.track(strings.NewReader(strings.Join(lines, "\n") + "\n")); err != nil {
+		t.Fatalf("track: %v", err)
+	}
+	if err := progress.finish(nil); err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	want := strings.Join([]string{
+		lines[0],
+		"Progress: [1/2] user script install.sh (step 1) started",
+		lines[1],
+		"Progress: [1/2] user script install.sh (step 1) finished in 1m0s",
+		lines[2],
+		"Progress: [2/2] builtin script seal_oem.sh (step 3) started",
+		lines[3],
+		"Progress: [2/2] builtin script seal_oem.sh (step 3) finished in 1m0s",
+		lines[4],
+		"Progress: build succeeded after 5m0s",
+		"Progress: step durations:",
+		"Progress:   step 1, user script install.sh: 1m0s",
+		"Progress:   step 3, builtin script seal_oem.sh: 1m0s",
+	}, "\n") + "\n"
+	if diff := cmp.Diff(out.String(), want); diff != "" {
+		t.Errorf("track: output diff (-got, +want): %s", diff)
+	}
+}
+
+// TestProgressResume checks that a step that starts again, like after the preload VM rebooted to
+// finish installing GPU drivers, is reported as one step.
+func TestProgressResume(t *testing.T) {
+	lines := []string{
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 1 started"),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 1 started"),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 1 finished"),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 3 started"),
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 3 finished"),
+		daisyStatus("SuccessMatch", "BuildSucceeded: Build completed with no errors. Shutting down..."),
+	}
+	var out bytes.Buffer
+	progress := newProgressTracker(ProgressJSON, ioutil.Discard, &out, progressEntries)
+	progress.now = fakeClock()
+	if err := progress.track(strings.NewReader(strings.Join(lines, "\n") + "\n")); err != nil {
+		t.Fatalf("track: %v", err)
+	}
+	steps := progress.steps
+	if len(steps) != 2 || steps[0].Entry.ID != 1 || steps[1].Entry.ID != 3 {
+		t.Fatalf("track: steps = %v; want steps 1 and 3", steps)
+	}
+	if got, want := steps[0].End.Sub(steps[0].Start), 2*time.Minute; got != want {
+		t.Errorf("track: step 1 took %v; want %v", got, want)
+	}
+	if steps[0].Failed {
+		t.Errorf("track: step 1 failed; want it to succeed")
+	}
+}
+
+func TestRunDaisyJSON(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	daisyBin := filepath.Join(tmpDir, "daisy")
+	script := fmt.Sprintf("#!/bin/bash\necho %q\necho 'an error' >&2\nexit 1\n",
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 1 started"))
+	if err := ioutil.WriteFile(daisyBin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	steps, err := runDaisy(context.Background(), daisyBin, nil, progressEntries, ProgressJSON, &stdout, &stderr)
+	if err == nil {
+		t.Errorf("runDaisy(%s) = nil; want error", daisyBin)
+	}
+	if len(steps) != 1 || steps[0].Entry.ID != 1 || !steps[0].Failed {
+		t.Errorf("runDaisy(%s): steps = %v; want step 1 failed", daisyBin, steps)
+	}
+	var gotTypes []string
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		var event ProgressEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("runDaisy(%s): stdout line %q is not a progress event: %v", daisyBin, line, err)
+		}
+		gotTypes = append(gotTypes, event.Type)
+	}
+	if diff := cmp.Diff(gotTypes, []string{StepStarted, StepFailed, BuildFailed}); diff != "" {
+		t.Errorf("runDaisy(%s): progress event types diff (-got, +want): %s", daisyBin, diff)
+	}
+	if !strings.Contains(stderr.String(), "an error") || !strings.Contains(stderr.String(), "step 1 started") {
+		t.Errorf("runDaisy(%s): stderr = %q; want the Daisy output", daisyBin, stderr.String())
+	}
+}
+
+// failingWriter is an io.Writer that always fails.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+// TestRunDaisyTrackError checks that the output of Daisy is still copied after progress can no longer
+// be reported.
+func TestRunDaisyTrackError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	daisyBin := filepath.Join(tmpDir, "daisy")
+	script := fmt.Sprintf("#!/bin/bash\necho %q\necho 'later output'\nexit 1\n",
+		daisyStatus("StatusMatch", "BuildStatus: "+progressMarker+" step 1 started"))
+	if err := ioutil.WriteFile(daisyBin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	if _, err := runDaisy(context.Background(), daisyBin, nil, progressEntries, ProgressJSON, failingWriter{},
+		&stderr); err == nil {
+		t.Errorf("runDaisy(%s) = nil; want error", daisyBin)
+	}
+	if !strings.Contains(stderr.String(), "later output") {
+		t.Errorf("runDaisy(%s): stderr = %q; want the Daisy output after the progress error", daisyBin,
+			stderr.String())
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"cos-customizer/config"
+)
+
+// daisyWorkflowName is the file name of the Daisy workflow that builds the image.
+const daisyWorkflowName = "build_image.wf.json"
+
+// scopePrefix is the prefix of the URLs of OAuth scopes. Scopes can be given without it.
+const scopePrefix = "https://www.googleapis.com/auth/"
+
+// defaultScopes are the OAuth scopes of the service account of the preload VM, unless the build config
+// sets others.
+var defaultScopes = []string{
+	scopePrefix + "devstorage.read_write",
+	scopePrefix + "cloud-platform",
+}
+
+// The types below model the parts of the Daisy workflow format that are used to build images. See
+// https://github.com/GoogleCloudPlatform/compute-image-tools/tree/master/daisy for the format.
+
+// daisyWorkflow is a Daisy workflow.
+type daisyWorkflow struct {
+	Name         string
+	Vars         map[string]daisyVar
+	Sources      map[string]string
+	Steps        map[string]*daisyStep
+	Dependencies map[string][]string
+}
+
+// daisyVar is a variable of a Daisy workflow, which is set with a "-var:<name>" argument.
+type daisyVar struct {
+	Value       string `json:",omitempty"`
+	Required    bool   `json:",omitempty"`
+	Description string
+}
+
+// daisyStep is a step of a Daisy workflow. Exactly one of its fields is set.
+type daisyStep struct {
+	CreateDisks            []*daisyDisk           `json:",omitempty"`
+	CreateInstances        []*daisyInstance       `json:",omitempty"`
+	WaitForInstancesSignal []*daisyInstanceSignal `json:",omitempty"`
+	ResizeDisks            []*daisyResizeDisk     `json:",omitempty"`
+	CopyGCSObjects         []*daisyCopyGCSObject  `json:",omitempty"`
+	CreateImages           []*daisyImage          `json:",omitempty"`
+	DeleteResources        *daisyDeleteResources  `json:",omitempty"`
+}
+
+type daisyDisk struct {
+	Name        string
+	RealName    string `json:",omitempty"`
+	NoCleanup   bool   `json:",omitempty"`
+	SourceImage string
+	SizeGb      string
+}
+
+type daisyAttachedDisk struct {
+	Source string
+}
+
+type daisyAccelerator struct {
+	AcceleratorType  string `json:"acceleratorType"`
+	AcceleratorCount int64  `json:"acceleratorCount"`
+}
+
+type daisyScheduling struct {
+	OnHostMaintenance string `json:"onHostMaintenance"`
+}
+
+// daisyAccessConfig is an external IP address configuration of a network interface.
+type daisyAccessConfig struct {
+	Type string `json:"type"`
+}
+
+type daisyNetworkInterface struct {
+	Network    string `json:"network,omitempty"`
+	Subnetwork string `json:"subnetwork,omitempty"`
+	// AccessConfigs is nil for Daisy's default of one external IP address, and empty for none.
+	AccessConfigs []*daisyAccessConfig `json:"accessConfigs"`
+}
+
+type daisyServiceAccount struct {
+	Email  string   `json:"email"`
+	Scopes []string `json:"scopes"`
+}
+
+type daisyInstance struct {
+	Name              string
+	RealName          string `json:",omitempty"`
+	NoCleanup         bool   `json:",omitempty"`
+	Disks             []*daisyAttachedDisk
+	MachineType       string                   `json:"machineType,omitempty"`
+	NetworkInterfaces []*daisyNetworkInterface `json:"networkInterfaces,omitempty"`
+	GuestAccelerators []*daisyAccelerator      `json:"guestAccelerators,omitempty"`
+	Scheduling        *daisyScheduling         `json:"scheduling"`
+	Metadata          map[string]string
+	ServiceAccounts   []*daisyServiceAccount `json:"serviceAccounts,omitempty"`
+	Scopes            []string
+}
+
+type daisySerialOutput struct {
+	Port         int
+	FailureMatch string `json:",omitempty"`
+	SuccessMatch string `json:",omitempty"`
+	StatusMatch  string `json:",omitempty"`
+}
+
+type daisyInstanceSignal struct {
+	Name         string
+	Interval     string
+	SerialOutput *daisySerialOutput `json:",omitempty"`
+	Stopped      bool               `json:",omitempty"`
+}
+
+type daisyResizeDisk struct {
+	Name   string
+	SizeGb string
+}
+
+type daisyCopyGCSObject struct {
+	Source      string
+	Destination string
+}
+
+type daisyImage struct {
+	RealName    string
+	Project     string
+	NoCleanup   bool
+	SourceDisk  string
+	Labels      map[string]string `json:"labels,omitempty"`
+	Description string            `json:"description"`
+	Family      string            `json:"family"`
+	Licenses    []string          `json:"licenses,omitempty"`
+}
+
+type daisyDeleteResources struct {
+	Instances []string `json:",omitempty"`
+	Disks     []string `json:",omitempty"`
+}
+
+// addStep adds a step to the workflow that runs after the given steps.
+func (w *daisyWorkflow) addStep(name string, step *daisyStep, after ...string) {
+	w.Steps[name] = step
+	if len(after) > 0 {
+		w.Dependencies[name] = after
+	}
+}
+
+// scopeURLs converts the given OAuth scopes to URLs. Scopes that are already URLs are kept.
+func scopeURLs(scopes []string) []string {
+	var urls []string
+	for _, scope := range scopes {
+		if !strings.Contains(scope, "/") {
+			scope = scopePrefix + scope
+		}
+		urls = append(urls, scope)
+	}
+	return urls
+}
+
+// newDaisyWorkflow creates the Daisy workflow that preloads the given output image. The preload VM
+// waits for an acknowledgement from Daisy before it runs the state file, so that the boot disk can
+// be resized first when the OEM partition is extended.
+//
+// If the build config asks to keep the preload VM after a failed image build, the preload VM and its
+// boot disk are named with the "preload_vm_name" variable and are not cleaned up by Daisy. Instead,
+// they are deleted by the last step of the workflow, which only runs if the image build succeeded.
+func newDaisyWorkflow(outputImage *config.Image, buildSpec *config.Build) *daisyWorkflow {
+	w := &daisyWorkflow{
+		Name: "build-image",
+		Vars: map[string]daisyVar{
+			"source_image":          {Required: true, Description: "URL of the source image to preload."},
+			"output_image_name":     {Required: true, Description: "Name of output image."},
+			"output_image_family":   {Description: "Family of output image."},
+			"output_image_project":  {Required: true, Description: "Project of output image."},
+			"disk_size_gb":          {Value: "10", Description: "The disk size to use for preloading."},
+			"oem_size":              {Description: "The size for extended OEM partition."},
+			"oem_fs_size_4k":        {Value: "0", Description: "The filesystem size of extended OEM partition in unit of 4K sectors."},
+			"host_maintenance":      {Value: "MIGRATE", Description: "VM behavior when there is maintenance."},
+			"user_build_context":    {Required: true, Description: "GCS URL of the user build context."},
+			"builtin_build_context": {Required: true, Description: "GCS URL of the builtin build context."},
+			"state_file":            {Required: true, Description: "GCS URL of the state file."},
+			"gcs_files": {Required: true, Description: "GCS URL of the directory containing arbitrary, step-specific " +
+				"data that does not belong in one of the build contexts."},
+			"cloud_config": {Required: true, Description: "cloud-config file to run."},
+		},
+		Sources: map[string]string{
+			"cloud-config": "${cloud_config}",
+			"daisy_ack":    "/data/daisy_ack",
+		},
+		Steps:        make(map[string]*daisyStep),
+		Dependencies: make(map[string][]string),
+	}
+	disk := &daisyDisk{
+		Name:        "boot-disk",
+		SourceImage: "${source_image}",
+		SizeGb:      "${disk_size_gb}",
+	}
+	w.addStep("setup", &daisyStep{CreateDisks: []*daisyDisk{disk}})
+	instance := &daisyInstance{
+		Name:       "preload-vm",
+		Disks:      []*daisyAttachedDisk{{Source: "boot-disk"}},
+		Scheduling: &daisyScheduling{OnHostMaintenance: "${host_maintenance}"},
+		Metadata: map[string]string{
+			"UserBuildContext":       "${user_build_context}",
+			"BuiltinBuildContext":    "${builtin_build_context}",
+			"StateFile":              "${state_file}",
+			"GCSFiles":               "${gcs_files}",
+			"DaisyAck":               "${SCRATCHPATH}/daisy_ack",
+			"OEMSize":                "${oem_size}",
+			"OEMFSSize4K":            "${oem_fs_size_4k}",
+			"user-data":              "${SOURCE:cloud-config}",
+			"block-project-ssh-keys": "TRUE",
+			"cos-update-strategy":    "update_disabled",
+		},
+		MachineType: buildSpec.MachineType,
+		Scopes:      defaultScopes,
+	}
+	if len(buildSpec.Scopes) > 0 {
+		instance.Scopes = scopeURLs(buildSpec.Scopes)
+	}
+	if buildSpec.ServiceAccount != "" {
+		instance.ServiceAccounts = []*daisyServiceAccount{{Email: buildSpec.ServiceAccount, Scopes: instance.Scopes}}
+	}
+	if buildSpec.Network != "" || buildSpec.Subnet != "" || buildSpec.NoExternalIP {
+		nic := &daisyNetworkInterface{Network: buildSpec.Network, Subnetwork: buildSpec.Subnet}
+		if buildSpec.NoExternalIP {
+			nic.AccessConfigs = []*daisyAccessConfig{}
+		}
+		instance.NetworkInterfaces = []*daisyNetworkInterface{nic}
+	}
+	if buildSpec.KeepOnFailure {
+		w.Vars["preload_vm_name"] = daisyVar{Required: true, Description: "Name of the preload VM and its " +
+			"boot disk, which are kept if the image build fails."}
+		disk.RealName, disk.NoCleanup = "${preload_vm_name}", true
+		instance.RealName, instance.NoCleanup = "${preload_vm_name}", true
+	}
+	if buildSpec.GPUType != "" {
+		instance.GuestAccelerators = []*daisyAccelerator{{
+			AcceleratorType: fmt.Sprintf("projects/%s/zones/%s/acceleratorTypes/%s", buildSpec.Project,
+				buildSpec.Zone, buildSpec.GPUType),
+			AcceleratorCount: 1,
+		}}
+	}
+	w.addStep("run", &daisyStep{CreateInstances: []*daisyInstance{instance}}, "setup")
+	w.addStep("wait-preload-start", &daisyStep{WaitForInstancesSignal: []*daisyInstanceSignal{{
+		Name:         "preload-vm",
+		Interval:     "2s",
+		SerialOutput: &daisySerialOutput{Port: 3, SuccessMatch: buildStatusPrefix},
+	}}}, "run")
+	ackAfter := "wait-preload-start"
+	if buildSpec.OEMSize != "" {
+		// The boot disk is created with the default size, and resized to the requested size while
+		// the preload VM waits, so that the OEM partition can be extended into the new space.
+		w.addStep("resize-disk", &daisyStep{ResizeDisks: []*daisyResizeDisk{{
+			Name:   "boot-disk",
+			SizeGb: strconv.Itoa(buildSpec.DiskSize),
+		}}}, ackAfter)
+		ackAfter = "resize-disk"
+	}
+	w.addStep("send-ack", &daisyStep{CopyGCSObjects: []*daisyCopyGCSObject{{
+		Source:      "${SOURCESPATH}/daisy_ack",
+		Destination: "${SCRATCHPATH}/daisy_ack",
+	}}}, ackAfter)
+	w.addStep("wait-preload-finished", &daisyStep{WaitForInstancesSignal: []*daisyInstanceSignal{{
+		Name:     "preload-vm",
+		Interval: "2s",
+		SerialOutput: &daisySerialOutput{
+			Port:         3,
+			FailureMatch: buildFailedPrefix,
+			SuccessMatch: buildSucceededPrefix,
+			StatusMatch:  buildStatusPrefix,
+		},
+	}}}, "send-ack")
+	w.addStep("wait-vm-shutdown", &daisyStep{WaitForInstancesSignal: []*daisyInstanceSignal{{
+		Name:     "preload-vm",
+		Interval: "2s",
+		Stopped:  true,
+	}}}, "wait-preload-finished")
+	w.addStep("image", &daisyStep{CreateImages: []*daisyImage{{
+		RealName:    "${output_image_name}",
+		Project:     "${output_image_project}",
+		NoCleanup:   true,
+		SourceDisk:  "boot-disk",
+		Labels:      outputImage.Labels,
+		Description: "Derivative of ${source_image}.",
+		Family:      "${output_image_family}",
+		Licenses:    outputImage.Licenses,
+	}}}, "wait-vm-shutdown")
+	if buildSpec.KeepOnFailure {
+		w.addStep("delete-preload-vm", &daisyStep{DeleteResources: &daisyDeleteResources{
+			Instances: []string{"preload-vm"},
+			Disks:     []string{"boot-disk"},
+		}}, "image")
+	}
+	return w
+}
+
+// writeDaisyWorkflow writes the Daisy workflow that preloads the given output image to the given path.
+func writeDaisyWorkflow(outputPath string, outputImage *config.Image, buildSpec *config.Build) error {
+	data, err := json.MarshalIndent(newDaisyWorkflow(outputImage, buildSpec), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outputPath, append(data, '\n'), 0644)
+}
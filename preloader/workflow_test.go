@@ -0,0 +1,90 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preloader
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cos-customizer/config"
+
+	"github.com/google/go-cmp/cmp"
+	compute "google.golang.org/api/compute/v1"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestWriteDaisyWorkflow compares the generated workflows with the golden files in testdata. Sealing
+// the OEM partition is a step of the state file, so its golden files match the ones without sealing.
+func TestWriteDaisyWorkflow(t *testing.T) {
+	var testData = []struct {
+		testName    string
+		buildConfig *config.Build
+	}{
+		{"Default", &config.Build{}},
+		{"Seal", &config.Build{SealOEM: true}},
+		{"OEM", &config.Build{DiskSize: 20, OEMSize: "5G", OEMFSSize4K: 1310720}},
+		{"OEMSeal", &config.Build{DiskSize: 20, OEMSize: "5G", OEMFSSize4K: 1310720, SealOEM: true}},
+		{"GPU", &config.Build{GPUType: "nvidia-tesla-k80", Project: "p", Zone: "z"}},
+		{"GPUSeal", &config.Build{GPUType: "nvidia-tesla-k80", Project: "p", Zone: "z", SealOEM: true}},
+		{"GPUOEM", &config.Build{GPUType: "nvidia-tesla-k80", Project: "p", Zone: "z", DiskSize: 20, OEMSize: "5G",
+			OEMFSSize4K: 1310720}},
+		{"GPUOEMSeal", &config.Build{GPUType: "nvidia-tesla-k80", Project: "p", Zone: "z", DiskSize: 20, OEMSize: "5G",
+			OEMFSSize4K: 1310720, SealOEM: true}},
+		{"KeepOnFailure", &config.Build{KeepOnFailure: true}},
+		{"VM", &config.Build{MachineType: "n1-standard-4", Network: "net", Subnet: "subnet", NoExternalIP: true,
+			ServiceAccount: "builder@p.iam.gserviceaccount.com", Scopes: []string{"devstorage.read_write",
+				"https://www.googleapis.com/auth/logging.write"}}},
+		{"Network", &config.Build{Network: "projects/host/global/networks/shared"}},
+		{"KeepOnFailureOEM", &config.Build{DiskSize: 20, OEMSize: "5G", OEMFSSize4K: 1310720, KeepOnFailure: true}},
+	}
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, input := range testData {
+		t.Run(input.testName, func(t *testing.T) {
+			outputImage := &config.Image{&compute.Image{
+				Labels:   map[string]string{"key": "value"},
+				Licenses: []string{"projects/my-proj/global/licenses/my-license"},
+			}, ""}
+			path := filepath.Join(tmpDir, input.testName)
+			if err := writeDaisyWorkflow(path, outputImage, input.buildConfig); err != nil {
+				t.Fatalf("writeDaisyWorkflow: %v", err)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", input.testName+".wf.json")
+			if *update {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(got), string(want)); diff != "" {
+				t.Errorf("writeDaisyWorkflow: diff with %s (-got, +want): %s", golden, diff)
+			}
+		})
+	}
+}